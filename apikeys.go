@@ -0,0 +1,465 @@
+/*
+
+API keys of machine clients: scopes, rate limits and key management calls.
+
+*/
+
+package productws
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyHeader is the HTTP header carrying the API key of a call.
+const APIKeyHeader = "X-API-Key"
+
+// Prefix of API keys, followed by the key ID, an underscore and the secret part
+const apiKeyPrefix = "pk_"
+
+// Min interval of saving the last use time of API keys to the APIKeyStore
+const lastUsedSaveInterval = time.Minute
+
+// APIKey is an API key of a machine client.
+type APIKey struct {
+	ID   string // Unique ID of the key, generated by the server (also part of the key)
+	Name string // Name of the key, e.g. the client using it
+
+	// Identity of the caller who created the key, set by the server
+	Owner string `json:",omitempty"`
+
+	// The key, generated by the server; only returned by the create and rotate calls.
+	Key string `json:",omitempty"`
+
+	// SHA-256 hash of the key (hex), only the hash is stored; not returned by the API calls.
+	Hash string `json:",omitempty"`
+
+	// Operations (names of API calls) the key may perform, "*" for all
+	Scopes []string
+
+	// Optional tags the scopes are restricted to, see SetAuthorizer()
+	Tags []string `json:",omitempty"`
+
+	// Max sustained rate of calls per second, unlimited if 0
+	RateLimit float64 `json:",omitempty"`
+
+	// Max burst of calls, defaults to RateLimit rounded up
+	Burst int `json:",omitempty"`
+
+	Created  time.Time // Time of creation
+	Rotated  time.Time // Time of the last rotation, zero if never rotated
+	LastUsed time.Time // Time of the last use, zero if never used (saved at most every minute)
+}
+
+// authorize tells if the key may perform the operation op,
+// and the tags the permission is restricted to.
+func (k *APIKey) authorize(op string) (allowed bool, tags []string) {
+	for _, s := range k.Scopes {
+		if s == op || s == "*" {
+			return true, k.Tags
+		}
+	}
+	return false, nil
+}
+
+// Errors to use by API key store implementations.
+var (
+	ErrInvalidAPIKeyID = errors.New("Invalid API key ID")
+)
+
+// APIKeyStore defines the interface for the persistent layer of API keys.
+type APIKeyStore interface {
+	// AllAPIKeys returns all API keys.
+	AllAPIKeys() ([]*APIKey, error)
+
+	// LoadAPIKey loads the API key with the specified ID.
+	// ErrInvalidAPIKeyID should be returned if no key exists with the ID.
+	LoadAPIKey(id string) (*APIKey, error)
+
+	// SaveAPIKey saves an API key (existing key with the same ID is replaced).
+	SaveAPIKey(k *APIKey) error
+
+	// DeleteAPIKey deletes an API key.
+	// ErrInvalidAPIKeyID should be returned if no key exists with the ID.
+	DeleteAPIKey(id string) error
+}
+
+// apiKeyAuth is the API key Authenticator, also enforcing the rate limits of keys.
+type apiKeyAuth struct {
+	ks APIKeyStore
+
+	// Mutex to protect the fields below, and to serialize modifications of keys
+	mux sync.Mutex
+
+	buckets  map[string]*tokenBucket // Rate limiters of keys, mapped from key ID
+	lastUsed map[string]time.Time    // Last use time of keys (not yet saved), mapped from key ID
+	saved    map[string]time.Time    // Time of saving the last use time of keys, mapped from key ID
+}
+
+// API key authenticator, API keys are disabled if nil
+var apiKeys *apiKeyAuth
+
+// EnableAPIKeys enables API keys, keys are persisted in the specified APIKeyStore.
+//
+// API keys are created, listed, revoked and rotated with API calls (addapikey, apikeys, revokeapikey
+// and rotateapikey). Calls may then be authenticated with a key, sent in the APIKeyHeader header;
+// the principal of such calls is "apikey:<ID>". Keys are accepted in addition to other credentials
+// (see SetAuthenticator() and EnableTokens()). Calls authenticated with a key are authorized by the
+// scopes of the key instead of the Authorizer, and are subject to the rate limit of the key.
+// This includes the change events: keys need the events scope to receive them, and keys restricted
+// to tags only receive events of products having any of the tags.
+// See package apikeystore for APIKeyStore implementations.
+// Must be done prior to starting the web service.
+func EnableAPIKeys(ks APIKeyStore) {
+	apiKeys = &apiKeyAuth{
+		ks:       ks,
+		buckets:  map[string]*tokenBucket{},
+		lastUsed: map[string]time.Time{},
+		saved:    map[string]time.Time{},
+	}
+}
+
+// newAPIKey returns a new key value for the specified key ID.
+func newAPIKey(id string) string {
+	return apiKeyPrefix + id + "_" + newToken()
+}
+
+// apiKeyID returns the ID part of a key value.
+func apiKeyID(key string) (id string, ok bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+	id, _, ok = strings.Cut(key[len(apiKeyPrefix):], "_")
+	return id, ok && id != ""
+}
+
+// Authenticate implements Authenticator.Authenticate().
+// The principal is "apikey:<ID>". The key is recorded in the callInfo of the request (if it has one).
+func (a *apiKeyAuth) Authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return "", ErrNoCredentials
+	}
+	id, ok := apiKeyID(key)
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+
+	k, err := a.ks.LoadAPIKey(id)
+	if err != nil {
+		if err == ErrInvalidAPIKeyID {
+			return "", ErrInvalidCredentials
+		}
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(k.Hash)) != 1 {
+		return "", ErrInvalidCredentials
+	}
+
+	a.touch(r, k)
+	if ci, ok := r.Context().Value(callInfoKey{}).(*callInfo); ok {
+		ci.apiKey = k
+	}
+	return "apikey:" + k.ID, nil
+}
+
+// Challenge implements Authenticator.Challenge().
+func (a *apiKeyAuth) Challenge() string {
+	return `APIKey realm="productws", header="` + APIKeyHeader + `"`
+}
+
+// touch records the use of a key. The last use time is saved to the store at most every lastUsedSaveInterval.
+func (a *apiKeyAuth) touch(r *http.Request, k *APIKey) {
+	now := time.Now()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.lastUsed[k.ID] = now
+	if now.Sub(a.saved[k.ID]) < lastUsedSaveInterval {
+		return
+	}
+	a.saved[k.ID] = now
+
+	// Reload under the mutex, so a concurrent rotation is not reverted
+	k2, err := a.ks.LoadAPIKey(k.ID)
+	if err != nil {
+		return // Revoked in the mean time
+	}
+	k2.LastUsed = now
+	if err := a.ks.SaveAPIKey(k2); err != nil {
+		logOf(r).Warn("Error saving API key", "id", k.ID, "err", err)
+	}
+}
+
+// limit enforces the rate limit of a key.
+// Returns the JSON response to send if the limit is exceeded, nil otherwise.
+func (a *apiKeyAuth) limit(w http.ResponseWriter, k *APIKey) *JSONResp {
+	if k.RateLimit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	a.mux.Lock()
+	b := a.buckets[k.ID]
+	if b == nil || b.rate != k.RateLimit {
+		b = newTokenBucket(k.RateLimit, k.Burst, now)
+		a.buckets[k.ID] = b
+	}
+	ok, wait := b.take(now)
+	setRateLimitHeaders(w.Header(), b)
+	a.mux.Unlock()
+
+	if ok {
+		return nil
+	}
+	return tooManyRequests(w, wait, MsgRateLimitErr)
+}
+
+// forget drops the runtime state of a key.
+// Must be called with the mutex held.
+func (a *apiKeyAuth) forget(id string) {
+	delete(a.buckets, id)
+	delete(a.lastUsed, id)
+	delete(a.saved, id)
+}
+
+// limitAPIKey enforces the rate limit of the API key of the call, if it is authenticated with one.
+// Returns the JSON response to send if the limit is exceeded, nil otherwise.
+func limitAPIKey(w http.ResponseWriter, ch *callHandler, ci *callInfo) *JSONResp {
+	if ci.apiKey == nil {
+		return nil
+	}
+	if jsonResp := apiKeys.limit(w, ci.apiKey); jsonResp != nil {
+		ci.log.Warn("API key rate limit exceeded", "caller", ci.caller)
+		requestsRejected.add(1, ch.op, "apikey")
+		return jsonResp
+	}
+	return nil
+}
+
+// grantable tells if the caller of ci may grant the scopes and tags of k: the permissions given by k
+// must not be wider than the caller's own, so callers can't escalate their privileges with API keys.
+func grantable(ci *callInfo, k *APIKey) bool {
+	ops := k.Scopes
+	for _, s := range k.Scopes {
+		if s == "*" {
+			ops = make([]string, 0, len(callOps))
+			for op := range callOps {
+				ops = append(ops, op)
+			}
+			break
+		}
+	}
+
+	for _, op := range ops {
+		allowed, tags := permission(ci, op)
+		if !allowed || !tagsWithin(k.Tags, tags) {
+			ci.log.Warn("API key scopes exceed the permissions of the caller", "caller", ci.caller, "op", op)
+			return false
+		}
+	}
+	return true
+}
+
+// isAdmin tells if the caller of ci is an administrator: it may perform all operations, unrestricted.
+// All callers are administrators if authorization is disabled.
+func isAdmin(ci *callInfo) bool {
+	for op := range callOps {
+		if allowed, tags := permission(ci, op); !allowed || len(tags) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tagsWithin tells if a permission restricted to tags is within a permission restricted to
+// the limit tags (an empty tag list means unrestricted).
+func tagsWithin(tags, limit []string) bool {
+	if len(limit) == 0 {
+		return true
+	}
+	if len(tags) == 0 {
+		return false
+	}
+	for _, t := range tags {
+		found := false
+		for _, l := range limit {
+			if t == l {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// addAPIKeyLogic implements creating an API key.
+// Expects the request body to be a JSON API key; only Name, Scopes, Tags, RateLimit and Burst are used.
+// Scopes must be registered operations, and the key must not give wider permissions than the caller has.
+// Returns the API key including its (generated) ID and Key.
+func addAPIKeyLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if apiKeys == nil {
+		return &JSONResp{Error: "API keys are not enabled!"}
+	}
+
+	k := new(APIKey)
+	if err := json.NewDecoder(r.Body).Decode(k); err != nil {
+		logOf(r).Warn("Error decoding request", "err", err)
+		http.Error(w, "Can't decode input JSON", http.StatusBadRequest)
+		return nil
+	}
+
+	if k.Name == "" {
+		return &JSONResp{Error: "Name must be specified!"}
+	}
+	if len(k.Scopes) == 0 {
+		return &JSONResp{Error: "Scopes must be specified!"}
+	}
+	if k.RateLimit < 0 || k.Burst < 0 {
+		return &JSONResp{Error: "RateLimit and Burst must not be negative!"}
+	}
+	for _, s := range k.Scopes {
+		if s != "*" && !callOps[s] {
+			return &JSONResp{Error: "Invalid scope: " + s}
+		}
+	}
+	if !grantable(callInfoOf(r), k) {
+		return forbidden(w)
+	}
+
+	k.ID, k.Owner, k.Created = newRandomID(), callInfoOf(r).caller, time.Now()
+	k.Rotated, k.LastUsed = time.Time{}, time.Time{}
+	k.Key = newAPIKey(k.ID)
+	k.Hash = hashToken(k.Key)
+
+	stored := *k
+	stored.Key = "" // Only the hash is stored
+	if err := apiKeys.ks.SaveAPIKey(&stored); err != nil {
+		logOf(r).Error("Error saving API key", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	k.Hash = ""
+	return &JSONResp{Success: true, Data: k}
+}
+
+// listAPIKeysLogic implements listing API keys.
+// Hashes are not returned.
+func listAPIKeysLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if apiKeys == nil {
+		return &JSONResp{Error: "API keys are not enabled!"}
+	}
+
+	ks, err := apiKeys.ks.AllAPIKeys()
+	if err != nil {
+		logOf(r).Error("Error getting API keys", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	apiKeys.mux.Lock()
+	res := make([]APIKey, len(ks))
+	for i, k := range ks {
+		res[i] = *k
+		res[i].Hash = ""
+		if t := apiKeys.lastUsed[k.ID]; t.After(k.LastUsed) {
+			res[i].LastUsed = t // Not yet saved
+		}
+	}
+	apiKeys.mux.Unlock()
+
+	return &JSONResp{Success: true, Data: res}
+}
+
+// revokeAPIKeyLogic implements revoking (deleting) an API key.
+// Expects the request body to be a JSON API key, only its ID is used.
+// Callers may only revoke their own keys, administrators (see isAdmin()) may revoke any key.
+func revokeAPIKeyLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if apiKeys == nil {
+		return &JSONResp{Error: "API keys are not enabled!"}
+	}
+
+	k := new(APIKey)
+	if err := json.NewDecoder(r.Body).Decode(k); err != nil {
+		logOf(r).Warn("Error decoding request", "err", err)
+		http.Error(w, "Can't decode input JSON", http.StatusBadRequest)
+		return nil
+	}
+
+	apiKeys.mux.Lock()
+	defer apiKeys.mux.Unlock()
+
+	k, err := apiKeys.ks.LoadAPIKey(k.ID)
+	if err != nil {
+		if err == ErrInvalidAPIKeyID {
+			return &JSONResp{Error: "Invalid API key ID!"}
+		}
+		logOf(r).Error("Error loading API key", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+	if ci := callInfoOf(r); k.Owner != ci.caller && !isAdmin(ci) {
+		ci.log.Warn("API key of another owner can't be revoked", "caller", ci.caller, "id", k.ID)
+		return forbidden(w)
+	}
+
+	if err := apiKeys.ks.DeleteAPIKey(k.ID); err != nil {
+		if err == ErrInvalidAPIKeyID {
+			return &JSONResp{Error: "Invalid API key ID!"}
+		}
+		logOf(r).Error("Error deleting API key", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+	apiKeys.forget(k.ID)
+
+	return &JSONResp{Success: true}
+}
+
+// rotateAPIKeyLogic implements rotating an API key: a new key is generated (keeping the ID and
+// the settings of the key), the old key is no longer valid.
+// Expects the request body to be a JSON API key, only its ID is used.
+// Returns the API key including its new Key.
+func rotateAPIKeyLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if apiKeys == nil {
+		return &JSONResp{Error: "API keys are not enabled!"}
+	}
+
+	req := new(APIKey)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		logOf(r).Warn("Error decoding request", "err", err)
+		http.Error(w, "Can't decode input JSON", http.StatusBadRequest)
+		return nil
+	}
+
+	apiKeys.mux.Lock()
+	defer apiKeys.mux.Unlock()
+
+	k, err := apiKeys.ks.LoadAPIKey(req.ID)
+	if err != nil {
+		if err == ErrInvalidAPIKeyID {
+			return &JSONResp{Error: "Invalid API key ID!"}
+		}
+		logOf(r).Error("Error loading API key", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+	if !grantable(callInfoOf(r), k) {
+		return forbidden(w) // Rotating would reveal a key with wider permissions
+	}
+
+	key := newAPIKey(k.ID)
+	k.Hash, k.Rotated = hashToken(key), time.Now()
+	if err := apiKeys.ks.SaveAPIKey(k); err != nil {
+		logOf(r).Error("Error saving API key", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	k.Key, k.Hash = key, ""
+	return &JSONResp{Success: true, Data: k}
+}
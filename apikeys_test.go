@@ -0,0 +1,276 @@
+package productws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testKeyStore is an in-memory APIKeyStore.
+type testKeyStore struct {
+	mux sync.Mutex
+	m   map[string]*APIKey
+}
+
+func newTestKeyStore() *testKeyStore {
+	return &testKeyStore{m: map[string]*APIKey{}}
+}
+
+func (s *testKeyStore) AllAPIKeys() ([]*APIKey, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var ks []*APIKey
+	for _, k := range s.m {
+		k2 := *k
+		ks = append(ks, &k2)
+	}
+	return ks, nil
+}
+
+func (s *testKeyStore) LoadAPIKey(id string) (*APIKey, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	k := s.m[id]
+	if k == nil {
+		return nil, ErrInvalidAPIKeyID
+	}
+	k2 := *k
+	return &k2, nil
+}
+
+func (s *testKeyStore) SaveAPIKey(k *APIKey) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	k2 := *k
+	s.m[k.ID] = &k2
+	return nil
+}
+
+func (s *testKeyStore) DeleteAPIKey(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.m[id] == nil {
+		return ErrInvalidAPIKeyID
+	}
+	delete(s.m, id)
+	return nil
+}
+
+// addTestKey saves a key with the specified scopes and tags to the store, returns the key value.
+func (s *testKeyStore) addTestKey(scopes, tags []string) string {
+	k := &APIKey{ID: newRandomID(), Name: "test", Scopes: scopes, Tags: tags}
+	key := newAPIKey(k.ID)
+	k.Hash = hashToken(key)
+	s.SaveAPIKey(k)
+	return key
+}
+
+// callAs performs the call logic with the request body as the caller, returns the response.
+func callAs(caller string, logic callLogic, body interface{}) (*JSONResp, *httptest.ResponseRecorder) {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(data)))
+	r = withCallInfo(r, &callInfo{caller: caller, log: logger})
+	w := httptest.NewRecorder()
+	return logic(w, r, nil), w
+}
+
+func TestRevokeAPIKeyOwner(t *testing.T) {
+	defer func(a *apiKeyAuth, z Authorizer) { apiKeys, authorizer = a, z }(apiKeys, authorizer)
+
+	EnableAPIKeys(newTestKeyStore())
+	authorizer = mapAuthorizer{
+		"admin": {ops: []string{"*"}},
+		"bob":   {ops: []string{opAddAPIKey, opRevokeAPIKey, opList}},
+		"carol": {ops: []string{opAddAPIKey, opRevokeAPIKey, opList}},
+		"books": {ops: []string{"*"}, tags: []string{"books"}},
+	}
+
+	newKey := func(owner string) string {
+		resp, _ := callAs(owner, addAPIKeyLogic, &APIKey{Name: "k", Scopes: []string{opList}})
+		if !resp.Success {
+			t.Fatalf("Failed to create key of %s: %+v", owner, resp)
+		}
+		return resp.Data.(*APIKey).ID
+	}
+
+	cases := []struct {
+		owner, caller string
+		expOK         bool
+	}{
+		{"bob", "bob", true},
+		{"bob", "carol", false},
+		{"bob", "books", false}, // Restricted to tags, not an admin
+		{"bob", "admin", true},
+		{"admin", "bob", false},
+		{"admin", "admin", true},
+	}
+
+	for _, c := range cases {
+		id := newKey(c.owner)
+		resp, w := callAs(c.caller, revokeAPIKeyLogic, &APIKey{ID: id})
+		if resp.Success != c.expOK {
+			t.Errorf("[owner: %s, caller: %s] Expected success: %v, got: %+v", c.owner, c.caller, c.expOK, resp)
+		}
+		if !c.expOK && (w.Code != http.StatusForbidden || resp.Error != MsgForbiddenErr) {
+			t.Errorf("[owner: %s, caller: %s] Expected forbidden, got: %d, %+v", c.owner, c.caller, w.Code, resp)
+		}
+		if _, err := apiKeys.ks.LoadAPIKey(id); (err == nil) == c.expOK {
+			t.Errorf("[owner: %s, caller: %s] Expected key revoked: %v, got error: %v", c.owner, c.caller, c.expOK, err)
+		}
+	}
+}
+
+func TestAddAPIKeyScopes(t *testing.T) {
+	defer func(a *apiKeyAuth, z Authorizer) { apiKeys, authorizer = a, z }(apiKeys, authorizer)
+
+	EnableAPIKeys(newTestKeyStore())
+	authorizer = mapAuthorizer{
+		"admin": {ops: []string{"*"}},
+		"bob":   {ops: []string{opAddAPIKey, opList, opDetails}},
+		"books": {ops: []string{opAddAPIKey, opList, opDetails, opSetPrices}, tags: []string{"books", "toys"}},
+	}
+
+	cases := []struct {
+		caller string
+		key    APIKey
+		expErr string // Empty if success is expected
+	}{
+		{"admin", APIKey{Name: "k", Scopes: []string{"*"}}, ""},
+		{"admin", APIKey{Name: "k", Scopes: []string{opRestore, opEvents}}, ""},
+		{"admin", APIKey{Name: "k", Scopes: []string{"nosuchop"}}, "Invalid scope: nosuchop"},
+		{"admin", APIKey{Name: "k"}, "Scopes must be specified!"},
+		{"admin", APIKey{Scopes: []string{opList}}, "Name must be specified!"},
+		{"admin", APIKey{Name: "k", Scopes: []string{opList}, RateLimit: -1}, "RateLimit and Burst must not be negative!"},
+		{"bob", APIKey{Name: "k", Scopes: []string{opList, opDetails}}, ""},
+		{"bob", APIKey{Name: "k", Scopes: []string{opList}, Tags: []string{"books"}}, ""}, // Narrower
+		{"bob", APIKey{Name: "k", Scopes: []string{opCreate}}, MsgForbiddenErr},
+		{"bob", APIKey{Name: "k", Scopes: []string{opList, opRestore}}, MsgForbiddenErr},
+		{"bob", APIKey{Name: "k", Scopes: []string{"*"}}, MsgForbiddenErr},
+		{"books", APIKey{Name: "k", Scopes: []string{opList}, Tags: []string{"books"}}, ""},
+		{"books", APIKey{Name: "k", Scopes: []string{opSetPrices}, Tags: []string{"books", "toys"}}, ""},
+		{"books", APIKey{Name: "k", Scopes: []string{opList}}, MsgForbiddenErr}, // Unrestricted
+		{"books", APIKey{Name: "k", Scopes: []string{opList}, Tags: []string{"books", "food"}}, MsgForbiddenErr},
+		{"books", APIKey{Name: "k", Scopes: []string{opAddAPIKey}, Tags: []string{"books"}}, MsgForbiddenErr},
+	}
+
+	for i, c := range cases {
+		resp, _ := callAs(c.caller, addAPIKeyLogic, &c.key)
+		if c.expErr == "" {
+			if !resp.Success {
+				t.Errorf("[%d, %s] Expected success, got: %+v", i, c.caller, resp)
+				continue
+			}
+			k := resp.Data.(*APIKey)
+			if k.Owner != c.caller || k.Hash != "" || !strings.HasPrefix(k.Key, apiKeyPrefix+k.ID+"_") {
+				t.Errorf("[%d, %s] Invalid key: %+v", i, c.caller, k)
+			}
+			continue
+		}
+		if resp.Success || resp.Error != c.expErr {
+			t.Errorf("[%d, %s] Expected error: %q, got: %+v", i, c.caller, c.expErr, resp)
+		}
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	defer func(a *apiKeyAuth, z Authorizer) { apiKeys, authorizer = a, z }(apiKeys, authorizer)
+
+	ks := newTestKeyStore()
+	EnableAPIKeys(ks)
+	authorizer = mapAuthorizer{
+		"admin": {ops: []string{"*"}},
+		"bob":   {ops: []string{opRotateAPIKey, opList}},
+	}
+
+	// authenticate authenticates a call with the key, returns the error and the permission for op.
+	authenticate := func(key, op string) (err error, allowed bool) {
+		r := httptest.NewRequest("GET", "/"+op, nil)
+		r.Header.Set(APIKeyHeader, key)
+		ci := &callInfo{log: logger}
+		if ci.caller, err = apiKeys.Authenticate(withCallInfo(r, ci)); err != nil {
+			return err, false
+		}
+		allowed, _ = permission(ci, op)
+		return nil, allowed
+	}
+
+	resp, _ := callAs("admin", addAPIKeyLogic, &APIKey{Name: "k", Scopes: []string{opList}})
+	k := resp.Data.(*APIKey)
+	if err, allowed := authenticate(k.Key, opList); err != nil || !allowed {
+		t.Errorf("Expected key to be allowed to list, got: %v, %v", err, allowed)
+	}
+	if err, allowed := authenticate(k.Key, opCreate); err != nil || allowed {
+		t.Errorf("Expected key not to be allowed to create, got: %v, %v", err, allowed)
+	}
+	if err, _ := authenticate(k.Key+"x", opList); err != ErrInvalidCredentials {
+		t.Errorf("Expected invalid key to be rejected, got: %v", err)
+	}
+	if err, _ := authenticate("not a key", opList); err != ErrInvalidCredentials {
+		t.Errorf("Expected malformed key to be rejected, got: %v", err)
+	}
+
+	// Rotation: the old key is invalidated
+	resp, _ = callAs("admin", rotateAPIKeyLogic, &APIKey{ID: k.ID})
+	if !resp.Success {
+		t.Fatalf("Expected successful rotation, got: %+v", resp)
+	}
+	rotated := resp.Data.(*APIKey)
+	if err, _ := authenticate(k.Key, opList); err != ErrInvalidCredentials {
+		t.Errorf("Expected old key to be rejected after rotation, got: %v", err)
+	}
+	if err, _ := authenticate(rotated.Key, opList); err != nil {
+		t.Errorf("Expected rotated key to be accepted, got: %v", err)
+	}
+
+	// Rotating a key with wider permissions than the caller's is denied
+	resp, _ = callAs("admin", addAPIKeyLogic, &APIKey{Name: "wide", Scopes: []string{"*"}})
+	wide := resp.Data.(*APIKey)
+	if resp, w := callAs("bob", rotateAPIKeyLogic, &APIKey{ID: wide.ID}); resp.Success || w.Code != http.StatusForbidden {
+		t.Errorf("Expected forbidden rotation, got: %d, %+v", w.Code, resp)
+	}
+	if err, _ := authenticate(wide.Key, opList); err != nil {
+		t.Errorf("Expected key to stay valid after denied rotation, got: %v", err)
+	}
+
+	// Revoked keys are rejected
+	if resp, _ := callAs("admin", revokeAPIKeyLogic, &APIKey{ID: k.ID}); !resp.Success {
+		t.Fatalf("Expected successful revocation, got: %+v", resp)
+	}
+	if err, _ := authenticate(rotated.Key, opList); err != ErrInvalidCredentials {
+		t.Errorf("Expected revoked key to be rejected, got: %v", err)
+	}
+	if resp, _ := callAs("admin", revokeAPIKeyLogic, &APIKey{ID: k.ID}); resp.Success {
+		t.Errorf("Expected second revocation to fail, got: %+v", resp)
+	}
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	defer func(a *apiKeyAuth) { apiKeys = a }(apiKeys)
+
+	EnableAPIKeys(newTestKeyStore())
+	k := &APIKey{ID: "k1", RateLimit: 1, Burst: 2}
+	ci := &callInfo{apiKey: k, log: logger}
+	ch := &callHandler{op: opList}
+
+	for i := 0; i < 2; i++ {
+		if jsonResp := limitAPIKey(httptest.NewRecorder(), ch, ci); jsonResp != nil {
+			t.Errorf("[call %d] Expected call within burst to be allowed, got: %+v", i, jsonResp)
+		}
+	}
+	w := httptest.NewRecorder()
+	jsonResp := limitAPIKey(w, ch, ci)
+	if jsonResp == nil || jsonResp.Error != MsgRateLimitErr || w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got: %d, %+v", w.Code, jsonResp)
+	}
+	if v := w.Header().Get("Retry-After"); v != "1" {
+		t.Errorf("Expected Retry-After: 1, got: %q", v)
+	}
+
+	// Calls without a key are not limited
+	if jsonResp := limitAPIKey(httptest.NewRecorder(), ch, &callInfo{log: logger}); jsonResp != nil {
+		t.Errorf("Expected call without key to be allowed, got: %+v", jsonResp)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+
+Package apikeystore contains productws.APIKeyStore implementations, safe for concurrent use.
+
+*/
+package apikeystore
+
+import (
+	"encoding/json"
+	"github.com/icza/productws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// memStore is an in-memory API key store implementation.
+// Optionally it persists API keys to a file.
+type memStore struct {
+	// Map storing API keys, mapped from their ID
+	m map[string]*productws.APIKey
+
+	// Mutex to protect concurrent access to the store
+	mux sync.RWMutex
+
+	// Optional name of the file to persist API keys to
+	name string
+}
+
+// NewMemStore returns a new in-memory APIKeyStore implementation.
+// Safe for concurrent use.
+func NewMemStore() productws.APIKeyStore {
+	return &memStore{m: map[string]*productws.APIKey{}}
+}
+
+// NewFileStore returns a new APIKeyStore implementation which persists
+// API keys to the named file (as a JSON array). The file is created with 0600 permissions.
+// Existing API keys are loaded from the file if it exists.
+// Safe for concurrent use.
+func NewFileStore(name string) (productws.APIKeyStore, error) {
+	s := &memStore{m: map[string]*productws.APIKey{}, name: name}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	var ks []*productws.APIKey
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, err
+	}
+	for _, k := range ks {
+		s.m[k.ID] = k
+	}
+
+	return s, nil
+}
+
+// AllAPIKeys implements APIKeyStore.AllAPIKeys().
+// API keys are returned in order of creation.
+// This implementation never returns an error.
+func (s *memStore) AllAPIKeys() ([]*productws.APIKey, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.all(), nil
+}
+
+// LoadAPIKey implements APIKeyStore.LoadAPIKey().
+// productws.ErrInvalidAPIKeyID is returned if no API key exists with the specified ID.
+func (s *memStore) LoadAPIKey(id string) (*productws.APIKey, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	k := s.m[id]
+	if k == nil {
+		return nil, productws.ErrInvalidAPIKeyID
+	}
+	return clone(k), nil // Clone to be safe!
+}
+
+// SaveAPIKey implements APIKeyStore.SaveAPIKey().
+func (s *memStore) SaveAPIKey(k *productws.APIKey) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	old := s.m[k.ID]
+	s.m[k.ID] = clone(k) // Clone to be safe!
+
+	if err := s.persist(); err != nil {
+		// Restore previous state
+		if old == nil {
+			delete(s.m, k.ID)
+		} else {
+			s.m[k.ID] = old
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteAPIKey implements APIKeyStore.DeleteAPIKey().
+// productws.ErrInvalidAPIKeyID is returned if no API key exists with the specified ID.
+func (s *memStore) DeleteAPIKey(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	old := s.m[id]
+	if old == nil {
+		return productws.ErrInvalidAPIKeyID
+	}
+	delete(s.m, id)
+
+	if err := s.persist(); err != nil {
+		s.m[id] = old // Restore previous state
+		return err
+	}
+	return nil
+}
+
+// clone returns a deep copy of an API key.
+func clone(k *productws.APIKey) *productws.APIKey {
+	k2 := *k
+	k2.Scopes = append([]string(nil), k.Scopes...)
+	k2.Tags = append([]string(nil), k.Tags...)
+	return &k2
+}
+
+// all returns copies of all API keys in order of creation.
+// Must be called with the mutex held.
+func (s *memStore) all() []*productws.APIKey {
+	ks := make([]*productws.APIKey, 0, len(s.m))
+	for _, k := range s.m {
+		ks = append(ks, clone(k))
+	}
+	sort.Slice(ks, func(i, j int) bool { return ks[i].Created.Before(ks[j].Created) })
+	return ks
+}
+
+// persist writes all API keys to the file if the store has one.
+// The file is replaced atomically.
+// Must be called with the write lock held.
+func (s *memStore) persist() error {
+	if s.name == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.all(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// TempFile creates the file with 0600 permissions, API key hashes are not for everyone
+	tmp, err := ioutil.TempFile(filepath.Dir(s.name), filepath.Base(s.name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.name)
+}
@@ -0,0 +1,219 @@
+/*
+
+Audit log of the mutating API calls.
+
+*/
+
+package productws
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AuditEntry is a record of a mutating API call.
+type AuditEntry struct {
+	Time   time.Time // Time of the call
+	Caller string    // Identity of the caller
+	Op     string    // Operation (name of the API call)
+	ID     ID        // ID of the affected product
+
+	// State of the product before and after the call.
+	// Before is nil for create calls.
+	Before *Product `json:",omitempty"`
+	After  *Product `json:",omitempty"`
+
+	// Changes made by the call
+	Diff []FieldChange `json:",omitempty"`
+}
+
+// FieldChange describes the change of a field of a product.
+type FieldChange struct {
+	// Name of the changed field; price points are named like "Prices.USD"
+	Field string
+
+	// Value of the field before and after the change (nil if not present)
+	Before interface{} `json:",omitempty"`
+	After  interface{} `json:",omitempty"`
+}
+
+// AuditFilter defines criteria for querying audit entries.
+// Zero value fields do not filter.
+type AuditFilter struct {
+	ID     ID        // Affected product ID
+	Op     string    // Operation
+	Caller string    // Identity of the caller
+	Since  time.Time // Entries at or after this time
+	Until  time.Time // Entries before this time
+
+	// Max number of entries to return (the most recent ones are kept)
+	Limit int
+}
+
+// Match tells if the entry matches the filter (Limit is not considered).
+func (f *AuditFilter) Match(e *AuditEntry) bool {
+	switch {
+	case f.ID != 0 && e.ID != f.ID:
+		return false
+	case f.Op != "" && e.Op != f.Op:
+		return false
+	case f.Caller != "" && e.Caller != f.Caller:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// AuditSink defines the interface of an append-only audit log storage.
+type AuditSink interface {
+	// Append appends an entry to the audit log.
+	Append(e *AuditEntry) error
+
+	// Query returns the entries matching the filter, in chronological order.
+	Query(f *AuditFilter) ([]*AuditEntry, error)
+}
+
+// AuditSink to record mutating API calls to, optional
+var auditSink AuditSink
+
+// SetAuditSink sets the AuditSink where mutating API calls are recorded.
+// If not set (or set to nil), calls are not audited.
+// Must be done prior to starting the web service.
+func SetAuditSink(s AuditSink) {
+	auditSink = s
+}
+
+// diffProducts returns the changes between 2 versions of a product.
+// before may be nil, in which case all fields of after are reported.
+// Audit metadata fields are not compared.
+func diffProducts(before, after *Product) (diff []FieldChange) {
+	if before == nil {
+		before = &Product{}
+	}
+
+	add := func(field string, b, a interface{}) {
+		diff = append(diff, FieldChange{Field: field, Before: b, After: a})
+	}
+
+	if before.Name != after.Name {
+		add("Name", before.Name, after.Name)
+	}
+	if before.Desc != after.Desc {
+		add("Desc", before.Desc, after.Desc)
+	}
+	if !reflect.DeepEqual(before.Tags, after.Tags) && (len(before.Tags) > 0 || len(after.Tags) > 0) {
+		add("Tags", before.Tags, after.Tags)
+	}
+
+	// Compare price points in deterministic (sorted) currency order
+	currs := []string{}
+	for k := range before.Prices {
+		currs = append(currs, k)
+	}
+	for k := range after.Prices {
+		if _, ok := before.Prices[k]; !ok {
+			currs = append(currs, k)
+		}
+	}
+	sort.Strings(currs)
+	for _, curr := range currs {
+		b, bok := before.Prices[curr]
+		a, aok := after.Prices[curr]
+		switch {
+		case !bok:
+			add("Prices."+curr, nil, a)
+		case !aok:
+			add("Prices."+curr, b, nil)
+		case a != b:
+			add("Prices."+curr, b, a)
+		}
+	}
+
+	return
+}
+
+// audit records the product changes of a successful mutating API call to the audit sink.
+func audit(ch *callHandler, ci *callInfo) {
+	if auditSink == nil {
+		return
+	}
+
+	for _, c := range ci.changes {
+		t := c.at
+		if t.IsZero() {
+			t = c.after.UpdatedAt
+		}
+		e := &AuditEntry{
+			Time:   t,
+			Caller: ci.caller,
+			Op:     ch.op,
+			ID:     c.after.ID,
+			Before: c.before,
+			After:  c.after,
+			Diff:   diffProducts(c.before, c.after),
+		}
+		if err := auditSink.Append(e); err != nil {
+			ci.log.Error("Error appending audit entry", "id", e.ID, "err", err)
+		}
+	}
+}
+
+// auditLogic implements querying the audit log.
+// Filters may be specified as URL query parameters:
+//     id      ID of the affected product
+//     op      operation
+//     caller  identity of the caller
+//     since   entries at or after this time (RFC 3339)
+//     until   entries before this time (RFC 3339)
+//     limit   max number of entries to return (the most recent ones)
+func auditLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if auditSink == nil {
+		return &JSONResp{Error: "Audit log is not enabled!"}
+	}
+
+	q := r.URL.Query()
+	f := &AuditFilter{Op: q.Get("op"), Caller: q.Get("caller")}
+	if v := q.Get("id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return &JSONResp{Error: "Invalid id parameter!"}
+		}
+		f.ID = ID(id)
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return &JSONResp{Error: "Invalid limit parameter!"}
+		}
+		f.Limit = limit
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return &JSONResp{Error: "Invalid " + p.name + " parameter, must be an RFC 3339 time!"}
+			}
+			*p.t = t
+		}
+	}
+
+	entries, err := auditSink.Query(f)
+	if err != nil {
+		logOf(r).Error("Error querying audit log", "err", err)
+		return &JSONResp{Error: "Audit log unavailable"}
+	}
+	if entries == nil {
+		entries = []*AuditEntry{}
+	}
+
+	return &JSONResp{Success: true, Data: entries}
+}
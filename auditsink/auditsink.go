@@ -0,0 +1,271 @@
+/*
+
+Package auditsink contains productws.AuditSink implementations, safe for concurrent use.
+
+*/
+package auditsink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/icza/productws"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// memSink is an in-memory audit sink implementation.
+type memSink struct {
+	// Audit entries in chronological order
+	entries []*productws.AuditEntry
+
+	// Mutex to protect concurrent access to the sink
+	mux sync.RWMutex
+}
+
+// NewMemSink returns a new in-memory AuditSink implementation.
+// Safe for concurrent use.
+func NewMemSink() productws.AuditSink {
+	return &memSink{}
+}
+
+// Append implements AuditSink.Append().
+// This implementation never returns an error.
+func (s *memSink) Append(e *productws.AuditEntry) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+// Query implements AuditSink.Query().
+// This implementation never returns an error.
+func (s *memSink) Query(f *productws.AuditFilter) ([]*productws.AuditEntry, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	var res []*productws.AuditEntry
+	for _, e := range s.entries {
+		if f.Match(e) {
+			res = append(res, e)
+		}
+	}
+
+	return limit(res, f.Limit), nil
+}
+
+// fileSink is an audit sink implementation which stores entries in a file,
+// one JSON entry per line.
+type fileSink struct {
+	// Name of the audit log file
+	name string
+
+	// File opened for appending
+	f *os.File
+
+	// Size of the complete entries in the file
+	size int64
+
+	// Error making the sink unusable: a failed write could not be undone
+	failed error
+
+	// Mutex to protect concurrent access to the sink
+	mux sync.Mutex
+}
+
+// NewFileSink returns a new AuditSink implementation which appends entries
+// to the named file (which is created if does not exist).
+// A partial last entry (e.g. left by a crash) is removed from the file.
+// Safe for concurrent use.
+func NewFileSink(name string) (productws.AuditSink, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size, err := completeSize(f, fi.Size())
+	if err == nil && size < fi.Size() {
+		productws.Logger().Warn("Removing partial last audit entry", "file", name, "size", fi.Size()-size)
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileSink{name: name, f: f, size: size}, nil
+}
+
+// completeSize returns the size of the complete lines in the first size bytes of f:
+// the offset after the last newline.
+func completeSize(f *os.File, size int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// Append implements AuditSink.Append().
+// If writing fails, the file is truncated to the last complete entry,
+// so a torn entry is not left behind.
+func (s *fileSink) Append(e *productws.AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.failed != nil {
+		return s.failed
+	}
+	n, err := s.f.Write(data)
+	if err == nil {
+		s.size += int64(n)
+		return nil
+	}
+	if n > 0 {
+		if err2 := s.f.Truncate(s.size); err2 != nil {
+			s.failed = fmt.Errorf("audit log is unusable, failed to remove partial entry: %v", err2)
+		}
+	}
+	return err
+}
+
+// Query implements AuditSink.Query().
+// Scans the audit log file without blocking Append(): only entries appended
+// before the query started are read. A partial last entry (not terminated by
+// a newline) is skipped.
+func (s *fileSink) Query(f *productws.AuditFilter) ([]*productws.AuditEntry, error) {
+	s.mux.Lock()
+	size := s.size
+	s.mux.Unlock()
+
+	file, err := os.Open(s.name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var res []*productws.AuditEntry
+	br := bufio.NewReader(io.LimitReader(file, size))
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break // Partial (or no) last entry
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := new(productws.AuditEntry)
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, err
+		}
+		if f.Match(e) {
+			res = append(res, e)
+		}
+	}
+
+	return limit(res, f.Limit), nil
+}
+
+// Close closes the audit log file.
+func (s *fileSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.f.Close()
+}
+
+// storeSink is an audit sink implementation which stores entries in a productws.Store,
+// each entry encoded as JSON in the Desc field of a product.
+type storeSink struct {
+	// Store holding the entries
+	st productws.Store
+}
+
+// NewStoreSink returns a new AuditSink implementation which stores entries in st.
+// st must be dedicated to the audit log (it must not be the store of the products),
+// e.g. a durable in-memory store in a separate directory.
+// Entries are saved as new products: their ID is the sequence number of the entry,
+// Name is the operation and Desc is the JSON encoded entry. These products have no
+// prices, so st must not validate products (e.g. a remote store can't be used: the
+// remote node rejects them).
+// Safe for concurrent use if st is.
+func NewStoreSink(st productws.Store) productws.AuditSink {
+	return &storeSink{st: st}
+}
+
+// Append implements AuditSink.Append().
+func (s *storeSink) Append(e *productws.AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.st.Save(&productws.Product{Name: e.Op, Desc: string(data)})
+}
+
+// Query implements AuditSink.Query().
+// Loads all entries from the store.
+func (s *storeSink) Query(f *productws.AuditFilter) ([]*productws.AuditEntry, error) {
+	ids, err := s.st.AllIDs()
+	if err != nil {
+		return nil, err
+	}
+	// IDs are assigned in the order of saving
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var res []*productws.AuditEntry
+	for _, id := range ids {
+		p, err := s.st.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		e := new(productws.AuditEntry)
+		if err := json.Unmarshal([]byte(p.Desc), e); err != nil {
+			return nil, err
+		}
+		if f.Match(e) {
+			res = append(res, e)
+		}
+	}
+
+	return limit(res, f.Limit), nil
+}
+
+// Close closes the store if it is an io.Closer.
+func (s *storeSink) Close() error {
+	if c, ok := s.st.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// limit returns the last max entries, or all if max is 0.
+func limit(entries []*productws.AuditEntry, max int) []*productws.AuditEntry {
+	if max > 0 && len(entries) > max {
+		return entries[len(entries)-max:]
+	}
+	return entries
+}
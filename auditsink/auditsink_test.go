@@ -0,0 +1,72 @@
+package auditsink
+
+import (
+	"github.com/icza/productws"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkPartialEntry(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+
+	s, err := NewFileSink(name)
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := s.Append(&productws.AuditEntry{Op: "create", ID: productws.ID(i)}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	s.(io.Closer).Close()
+
+	// Simulate a crash in the middle of writing an entry:
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	f.WriteString(`{"Op":"upd`)
+	f.Close()
+
+	s, err = NewFileSink(name)
+	if err != nil {
+		t.Fatalf("Failed to reopen sink: %v", err)
+	}
+	defer s.(io.Closer).Close()
+	if err := s.Append(&productws.AuditEntry{Op: "update", ID: 3}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	es, err := s.Query(&productws.AuditFilter{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(es) != 3 || es[0].ID != 1 || es[1].ID != 2 || es[2].ID != 3 {
+		t.Errorf("Expected entries 1, 2 and 3, got: %d entries", len(es))
+		for _, e := range es {
+			t.Logf("%+v", e)
+		}
+	}
+}
+
+func TestFileSinkQueryPartialLine(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileSink(name)
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	defer s.(io.Closer).Close()
+	s.Append(&productws.AuditEntry{Op: "create", ID: 1})
+
+	// A size not at an entry boundary (e.g. file modified externally) must not break queries:
+	fs := s.(*fileSink)
+	fs.f.WriteString(`{"Op":"upd`)
+	fs.size += 10
+
+	es, err := s.Query(&productws.AuditFilter{})
+	if err != nil || len(es) != 1 {
+		t.Errorf("Expected 1 entry, got: %d, %v", len(es), err)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+
+Authentication of API calls.
+
+*/
+
+package productws
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Errors returned by Authenticators
+var (
+	// ErrNoCredentials tells that the request carries no credentials the Authenticator handles.
+	ErrNoCredentials = errors.New("No credentials")
+
+	// ErrInvalidCredentials tells that the credentials of the request are invalid.
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+)
+
+// Authenticator authenticates API call requests.
+type Authenticator interface {
+	// Authenticate authenticates the request, returns the principal (identity) of the caller.
+	// ErrNoCredentials should be returned if the request has no credentials,
+	// ErrInvalidCredentials if they are invalid.
+	Authenticate(r *http.Request) (principal string, err error)
+
+	// Challenge returns the value of the WWW-Authenticate header sent along with
+	// 401 Unauthorized responses, e.g. `Basic realm="productws"`.
+	Challenge() string
+}
+
+// Authenticator to use, authentication is disabled if nil
+var authenticator Authenticator
+
+// SetAuthenticator sets the Authenticator used to authenticate API calls.
+// Authentication is disabled by default (and if a is nil).
+// If enabled, unauthenticated API calls are rejected with 401 Unauthorized, and the
+// authenticated principal identifies the caller (e.g. in the audit log and as UpdatedBy).
+// Package htpasswd contains an Authenticator implementation.
+// Must be done prior to starting the web service.
+func SetAuthenticator(a Authenticator) {
+	authenticator = a
+}
+
+// authenticators returns the enabled Authenticators: the token authenticator
+// (see EnableTokens()), the API key authenticator (see EnableAPIKeys()) and the one set by SetAuthenticator().
+func authenticators() []Authenticator {
+	var as []Authenticator
+	if tokens != nil {
+		as = append(as, tokens)
+	}
+	if apiKeys != nil {
+		as = append(as, apiKeys)
+	}
+	if authenticator != nil {
+		as = append(as, authenticator)
+	}
+	return as
+}
+
+// authenticate authenticates a request if authentication is enabled.
+// The enabled Authenticators are tried in order until one finds credentials in the request.
+// Returns the principal, or the empty string if authentication is disabled.
+// If authentication fails, a 401 Unauthorized response is sent (with the challenges of
+// all enabled Authenticators) and ok is false.
+func authenticate(w http.ResponseWriter, r *http.Request) (principal string, ok bool) {
+	as := authenticators()
+	if len(as) == 0 {
+		return "", true
+	}
+
+	err := ErrNoCredentials
+	for _, a := range as {
+		if principal, err = a.Authenticate(r); err != ErrNoCredentials {
+			break
+		}
+	}
+	if err == nil {
+		return principal, true
+	}
+
+	if err != ErrNoCredentials {
+		logOf(r).Warn("Authentication failed", "remoteAddr", r.RemoteAddr, "err", err)
+	}
+	for _, a := range as {
+		w.Header().Add("WWW-Authenticate", a.Challenge())
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return "", false
+}
@@ -0,0 +1,126 @@
+/*
+
+Authorization of API calls.
+
+*/
+
+package productws
+
+import (
+	"net/http"
+)
+
+// Authorizer authorizes API calls of (authenticated) callers.
+type Authorizer interface {
+	// Authorize tells if the caller may perform the operation op (name of the API call,
+	// e.g. "list" or "setprices"). caller is the authenticated principal (or the identity
+	// of the caller if authentication is disabled, see SetAuthenticator()).
+	// If tags is not empty, the permission is restricted to products having any of the tags.
+	Authorize(caller, op string) (allowed bool, tags []string)
+}
+
+// Authorizer to use, authorization is disabled if nil
+var authorizer Authorizer
+
+// SetAuthorizer sets the Authorizer used to authorize API calls.
+// Authorization is disabled by default (and if a is nil): all authenticated callers may perform all calls.
+// If enabled, calls not allowed for the caller are rejected with 403 Forbidden (before the call logic runs).
+//
+// Tag-restricted permissions only apply to the product calls (create, list, details, update and setprices):
+// products not having any of the tags are not listed and cannot be accessed, created products must have
+// any of the tags, and updates must not take products out of the tags. They also apply to the events
+// operation, which is required to receive change events (the events path and the subscribe operation of
+// the WebSocket API): only events of products having any of the tags are sent. Tag-restricted permissions
+// of other calls are not granted.
+// Calls authenticated with API keys are authorized by the scopes of the key instead, see EnableAPIKeys().
+// Package rbac contains a role-based Authorizer implementation.
+// Must be done prior to starting the web service.
+func SetAuthorizer(a Authorizer) {
+	authorizer = a
+}
+
+// authorize authorizes the call of ci if authorization is enabled (or the call is authenticated
+// with an API key), and records the tag restriction of the permission in ci.
+// Returns the JSON response to send if the call is not allowed, nil otherwise.
+func authorize(w http.ResponseWriter, ch *callHandler, ci *callInfo) *JSONResp {
+	if ch.noAuth || ch.noAuthz {
+		return nil
+	}
+
+	allowed, tags := permission(ci, ch.op)
+	if !allowed {
+		ci.log.Warn("Permission denied", "caller", ci.caller)
+		return forbidden(w)
+	}
+
+	ci.tags = tags
+	return nil
+}
+
+// permission returns the permission of the caller of ci to perform the operation op:
+// the scopes of its API key if it is authenticated with one, else the permission given by the Authorizer.
+// All operations are allowed if authorization is disabled.
+func permission(ci *callInfo, op string) (allowed bool, tags []string) {
+	switch {
+	case ci.apiKey != nil:
+		allowed, tags = ci.apiKey.authorize(op)
+	case authorizer != nil:
+		allowed, tags = authorizer.Authorize(ci.caller, op)
+	default:
+		return true, nil
+	}
+	if allowed && len(tags) > 0 && !tagScoped(op) {
+		allowed = false // Tag restrictions only apply to product calls and change events
+	}
+	return
+}
+
+// tagScoped tells if tag-restricted permissions apply to the operation op:
+// to the product calls and to the change events.
+func tagScoped(op string) bool {
+	return productCalls[op] != nil || op == opEvents
+}
+
+// forbidden sets the 403 Forbidden status, and returns the JSON response telling the permission is denied.
+func forbidden(w http.ResponseWriter) *JSONResp {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	return &JSONResp{Error: MsgForbiddenErr}
+}
+
+// permits tells if the call may access product p,
+// that is, if p has any of the tags the permission of the call is restricted to.
+func (ci *callInfo) permits(p *Product) bool {
+	return ci.permitsTags(p.Tags)
+}
+
+// permitsTags tells if the call may access a product having the specified tags.
+func (ci *callInfo) permitsTags(tags []string) bool {
+	if len(ci.tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		for _, t := range ci.tags {
+			if tag == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopeEvent returns the event e as the subscriber of ci may see it, checking the tags of the
+// product both before and after the change: nil is returned if the product is outside the tags the
+// permission is restricted to both before and after the change. If the product moved out of the
+// tags, a copy of e without the product is returned, so its new state is not leaked.
+func (ci *callInfo) scopeEvent(e *Event) *Event {
+	if len(ci.tags) == 0 || e.Product != nil && ci.permits(e.Product) {
+		return e
+	}
+	if !ci.permitsTags(e.prevTags) {
+		return nil
+	}
+	e2 := *e
+	e2.Product = nil
+	return &e2
+}
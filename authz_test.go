@@ -0,0 +1,120 @@
+package productws_test
+
+import (
+	"encoding/json"
+	"github.com/icza/productws"
+	"github.com/icza/productws/inmemstore"
+	"github.com/icza/productws/rbac"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// userAuth is an Authenticator taking the principal from the X-User header.
+type userAuth struct{}
+
+func (userAuth) Authenticate(r *http.Request) (string, error) {
+	if user := r.Header.Get("X-User"); user != "" {
+		return user, nil
+	}
+	return "", productws.ErrNoCredentials
+}
+
+func (userAuth) Challenge() string { return "User" }
+
+func TestAuthorization(t *testing.T) {
+	defer func(st productws.Store, a productws.Authenticator, z productws.Authorizer) {
+		productws.SetStore(st)
+		productws.SetAuthenticator(a)
+		productws.SetAuthorizer(z)
+	}(productws.CurrentStore(), productws.CurrentAuthenticator(), productws.CurrentAuthorizer())
+
+	st := inmemstore.NewInmemStore()
+	books, toys := testProduct(0, "book"), testProduct(0, "toy")
+	books.Tags, toys.Tags = []string{"books"}, []string{"toys"}
+	st.Save(books) // Gets ID 1
+	st.Save(toys)  // Gets ID 2
+	productws.SetStore(st)
+	productws.SetAuthenticator(userAuth{})
+	productws.SetAuthorizer(&rbac.Policy{
+		Roles: map[string]*rbac.Role{
+			"reader":  {Ops: []string{"list", "details"}},
+			"pricing": {Ops: []string{"list", "details", "create", "update", "setprices", "audit"}, Tags: []string{"books"}},
+			"admin":   {Ops: []string{rbac.Any}},
+		},
+		Users: map[string][]string{"alice": {"admin"}, "bob": {"reader"}, "carol": {"pricing"}},
+	})
+
+	const (
+		bookJSON     = `{"ID":1,"Name":"book","Desc":"d","Tags":["books"],"Prices":{"USD":{"Value":2,"Multiplier":1}}}`
+		bookToToys   = `{"ID":1,"Name":"book","Desc":"d","Tags":["toys"],"Prices":{"USD":{"Value":2,"Multiplier":1}}}`
+		toyJSON      = `{"ID":2,"Name":"toy","Desc":"d","Tags":["toys"],"Prices":{"USD":{"Value":2,"Multiplier":1}}}`
+		newBookJSON  = `{"Name":"book2","Desc":"d","Tags":["books"],"Prices":{"USD":{"Value":2,"Multiplier":1}}}`
+		newToyJSON   = `{"Name":"toy2","Desc":"d","Tags":["toys"],"Prices":{"USD":{"Value":2,"Multiplier":1}}}`
+		bookPrices   = `{"ID":1,"Prices":{"EUR":{"Value":2,"Multiplier":1}}}`
+		toyPrices    = `{"ID":2,"Prices":{"EUR":{"Value":2,"Multiplier":1}}}`
+		statusDenied = http.StatusForbidden
+	)
+
+	cases := []struct {
+		user, method, path, body string
+		expStatus                int
+		expData                  string // Expected JSON data if not empty
+	}{
+		{"", "GET", "/list", "", http.StatusUnauthorized, ""},
+		{"eve", "GET", "/list", "", statusDenied, ""}, // No roles
+		{"bob", "GET", "/list", "", http.StatusOK, "[1,2]"},
+		{"bob", "GET", "/details/2", "", http.StatusOK, ""},
+		{"bob", "POST", "/create", newBookJSON, statusDenied, ""},
+		{"bob", "PUT", "/setprices", bookPrices, statusDenied, ""},
+		{"bob", "GET", "/audit", "", statusDenied, ""},
+		{"carol", "GET", "/list", "", http.StatusOK, "[1]"},
+		{"carol", "GET", "/details/1", "", http.StatusOK, ""},
+		{"carol", "GET", "/details/2", "", statusDenied, ""},
+		{"carol", "PUT", "/setprices", bookPrices, http.StatusOK, `{"ID":1}`},
+		{"carol", "PUT", "/setprices", toyPrices, statusDenied, ""},
+		{"carol", "PUT", "/update", bookJSON, http.StatusOK, `{"ID":1}`},
+		{"carol", "PUT", "/update", toyJSON, statusDenied, ""},
+		{"carol", "PUT", "/update", bookToToys, statusDenied, ""}, // Moving out of the tags
+		{"carol", "POST", "/create", newToyJSON, statusDenied, ""},
+		{"carol", "POST", "/create", newBookJSON, http.StatusOK, `{"ID":3}`},
+		{"carol", "GET", "/audit", "", statusDenied, ""}, // Tag restriction of non-product calls is not granted
+		{"alice", "PUT", "/update", bookToToys, http.StatusOK, `{"ID":1}`},
+		{"alice", "GET", "/audit", "", http.StatusOK, ""},
+		{"carol", "GET", "/details/1", "", statusDenied, ""}, // Moved out of the tags by alice
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		if c.user != "" {
+			r.Header.Set("X-User", c.user)
+		}
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, r)
+
+		if w.Code != c.expStatus {
+			t.Errorf("[%s %s %s] Expected status: %d, got: %d, %s", c.user, c.method, c.path, c.expStatus, w.Code, w.Body)
+			continue
+		}
+		if c.expStatus == statusDenied && !strings.Contains(w.Body.String(), productws.MsgForbiddenErr) {
+			t.Errorf("[%s %s %s] Expected error: %q, got: %s", c.user, c.method, c.path, productws.MsgForbiddenErr, w.Body)
+		}
+		if c.expData != "" {
+			var resp struct {
+				productws.JSONResp
+				Data json.RawMessage
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			var ids []int
+			if err == nil && json.Unmarshal(resp.Data, &ids) == nil {
+				sort.Ints(ids) // Order of listed IDs is not specified
+				resp.Data, _ = json.Marshal(ids)
+			}
+			if err != nil || string(resp.Data) != c.expData {
+				t.Errorf("[%s %s %s] Expected data: %s, got: %s, %v", c.user, c.method, c.path, c.expData, w.Body, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+
+Package cachestore contains a read-through caching Store decorator, safe for concurrent use.
+
+Loaded products are cached in a bounded LRU cache with TTL, so repeated loads do not
+hit the (possibly slow) backend store. Cached entries are invalidated when saved through
+the cache store; changes made to the backend by others are only seen after the TTL expires.
+
+*/
+package cachestore
+
+import (
+	"container/list"
+	"context"
+	"github.com/icza/productws"
+	"io"
+	"sync"
+	"time"
+)
+
+// Options holds options of the cache store.
+type Options struct {
+	Size int           // Max number of cached products, default: 1000
+	TTL  time.Duration // Time-to-live of cached products and IDs, default: 1m
+}
+
+// Stats holds cache statistics.
+type Stats struct {
+	Hits      uint64 // Loads served from the cache
+	Misses    uint64 // Loads served by the backend
+	Evictions uint64 // Entries evicted due to the size limit
+	IDsHits   uint64 // AllIDs calls served from the cache
+	IDsMisses uint64 // AllIDs calls served by the backend
+	Size      int    // Number of cached products
+}
+
+// entry is a cached product.
+type entry struct {
+	p       *productws.Product
+	expires time.Time
+}
+
+// CacheStore is a Store implementation which caches the results of a backend Store.
+// Like inmemStore, it returns clones, so returned products can be modified freely.
+type CacheStore struct {
+	backend productws.Store
+	opts    Options
+
+	// Mutex to protect concurrent access to the cache
+	mux sync.Mutex
+
+	// LRU list of cached entries (front is the most recently used), and the map of its elements
+	lru   *list.List
+	elems map[productws.ID]*list.Element
+
+	// Cached IDs (nil if not cached), and their expiration time
+	ids        []productws.ID
+	idsExpires time.Time
+
+	// Generation counter, incremented on each invalidation.
+	// Backend results are only cached if no invalidation happened while they were fetched.
+	gen uint64
+
+	stats Stats
+}
+
+// NewCacheStore returns a new CacheStore which caches the results of backend.
+// opts is optional, defaults are used for zero values.
+// Safe for concurrent use (if backend is).
+func NewCacheStore(backend productws.Store, opts *Options) *CacheStore {
+	s := &CacheStore{backend: backend, lru: list.New(), elems: map[productws.ID]*list.Element{}}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.Size <= 0 {
+		s.opts.Size = 1000
+	}
+	if s.opts.TTL <= 0 {
+		s.opts.TTL = time.Minute
+	}
+	return s
+}
+
+// AllIDs implements Store.AllIDs().
+// IDs are cached until the TTL expires or a product is created through the cache.
+func (s *CacheStore) AllIDs() ([]productws.ID, error) {
+	s.mux.Lock()
+	if s.ids != nil && time.Now().Before(s.idsExpires) {
+		s.stats.IDsHits++
+		ids := append([]productws.ID(nil), s.ids...)
+		s.mux.Unlock()
+		return ids, nil
+	}
+	s.stats.IDsMisses++
+	gen := s.gen
+	s.mux.Unlock()
+
+	ids, err := s.backend.AllIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.Lock()
+	if gen == s.gen {
+		s.ids = append([]productws.ID(nil), ids...)
+		s.idsExpires = time.Now().Add(s.opts.TTL)
+	}
+	s.mux.Unlock()
+
+	return ids, nil
+}
+
+// Save implements Store.Save().
+// The cached entry of the product is invalidated, and so are the cached IDs if
+// a new product is created.
+func (s *CacheStore) Save(p *productws.Product) error {
+	isNew := p.ID == 0
+	err := s.backend.Save(p)
+
+	// Invalidate even on error, the backend may have partially succeeded
+	s.mux.Lock()
+	s.invalidate(p.ID, isNew)
+	s.mux.Unlock()
+
+	return err
+}
+
+// Load implements Store.Load().
+// productws.ErrInvalidId results are not cached.
+func (s *CacheStore) Load(id productws.ID) (*productws.Product, error) {
+	s.mux.Lock()
+	if el := s.elems[id]; el != nil {
+		e := el.Value.(*entry)
+		if time.Now().Before(e.expires) {
+			s.stats.Hits++
+			s.lru.MoveToFront(el)
+			p := e.p.Clone()
+			s.mux.Unlock()
+			return p, nil
+		}
+		s.remove(el)
+	}
+	s.stats.Misses++
+	gen := s.gen
+	s.mux.Unlock()
+
+	p, err := s.backend.Load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if gen == s.gen {
+		if el := s.elems[id]; el != nil {
+			s.remove(el) // Cached by a concurrent load
+		}
+		s.elems[id] = s.lru.PushFront(&entry{p: p.Clone(), expires: time.Now().Add(s.opts.TTL)})
+		for s.lru.Len() > s.opts.Size {
+			s.remove(s.lru.Back())
+			s.stats.Evictions++
+		}
+	}
+
+	return p, nil
+}
+
+// Put implements productws.Putter if the backend store implements it,
+// else productws.ErrPutUnsupported is returned.
+func (s *CacheStore) Put(p *productws.Product) error {
+	putter, ok := s.backend.(productws.Putter)
+	if !ok {
+		return productws.ErrPutUnsupported
+	}
+	err := putter.Put(p)
+
+	s.mux.Lock()
+	s.invalidate(p.ID, true)
+	s.mux.Unlock()
+
+	return err
+}
+
+// Ping implements productws.Pinger, pings the backend store if it implements productws.Pinger.
+func (s *CacheStore) Ping(ctx context.Context) error {
+	if p, ok := s.backend.(productws.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Unwrap returns the backend store.
+func (s *CacheStore) Unwrap() productws.Store {
+	return s.backend
+}
+
+// Close implements io.Closer, closes the backend store if it implements io.Closer.
+func (s *CacheStore) Close() error {
+	if c, ok := s.backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Stats returns the cache statistics.
+func (s *CacheStore) Stats() Stats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	st := s.stats
+	st.Size = s.lru.Len()
+	return st
+}
+
+// Purge removes all cached entries.
+func (s *CacheStore) Purge() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.gen++
+	s.lru.Init()
+	s.elems = map[productws.ID]*list.Element{}
+	s.ids = nil
+}
+
+// invalidate invalidates the cached entry of a product, and the cached IDs if ids is true.
+// Must be called with the mutex held.
+func (s *CacheStore) invalidate(id productws.ID, ids bool) {
+	s.gen++
+	if el := s.elems[id]; el != nil {
+		s.remove(el)
+	}
+	if ids {
+		s.ids = nil
+	}
+}
+
+// remove removes an element from the cache.
+// Must be called with the mutex held.
+func (s *CacheStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.elems, el.Value.(*entry).p.ID)
+}
@@ -0,0 +1,21 @@
+package cachestore
+
+import (
+	"github.com/icza/productws"
+	"github.com/icza/productws/inmemstore"
+	"github.com/icza/productws/storetest"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) productws.Store {
+		return NewCacheStore(inmemstore.NewInmemStore(), nil)
+	})
+}
+
+func TestStoreSmallCache(t *testing.T) {
+	// Evictions must not break the contract
+	storetest.TestStore(t, func(t *testing.T) productws.Store {
+		return NewCacheStore(inmemstore.NewInmemStore(), &Options{Size: 2})
+	})
+}
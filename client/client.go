@@ -0,0 +1,430 @@
+/*
+
+Package client contains a Go client of the product web service API.
+
+Example usage:
+
+	c := client.New("http://localhost:8081")
+	id, err := c.Create(ctx, &productws.Product{Name: "Mouse", Desc: "Optical mouse",
+		Prices: map[string]productws.Price{"USD": {Value: 2782, Multiplier: 100}}})
+	...
+	p, err := c.Details(ctx, id)
+
+Errors reported by the service are returned as *APIError, except the well-known
+error messages which are mapped to errors: productws.MsgInvalidIDErr is mapped to
+productws.ErrInvalidId, productws.MsgGeneralStoreErr to ErrStoreUnavailable.
+Failed authentication (HTTP 401) is reported as ErrUnauthorized, denied permission
+(HTTP 403) as ErrForbidden, and rejections by rate limits (HTTP 429) as *RateLimitError.
+
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/icza/productws"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrStoreUnavailable is returned if the service reports that its product store is unavailable.
+var ErrStoreUnavailable = errors.New(productws.MsgGeneralStoreErr)
+
+// ErrUnauthorized is returned if the service rejects the call because authentication failed.
+var ErrUnauthorized = errors.New("Unauthorized!")
+
+// ErrForbidden is returned if the service reports the caller has no permission to perform the call.
+var ErrForbidden = errors.New(productws.MsgForbiddenErr)
+
+// RateLimitError is returned if the service rejects the call due to rate limiting
+// (or too many calls in flight).
+type RateLimitError struct {
+	Op         string        // Operation (name of the API call)
+	Msg        string        // Error message reported by the service
+	RetryAfter time.Duration // Wait time before retrying as told by the service, 0 if not told
+}
+
+// Error implements error.
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("productws %s: %s (retry after %v)", e.Op, e.Msg, e.RetryAfter)
+}
+
+// APIError is an error reported by the service.
+type APIError struct {
+	Op         string // Operation (name of the API call)
+	StatusCode int    // HTTP status code of the response
+	Msg        string // Error message reported by the service
+}
+
+// Error implements error.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("productws %s: %s (HTTP %d)", e.Op, e.Msg, e.StatusCode)
+}
+
+// Client is a client of the product web service API.
+// Safe for concurrent use.
+type Client struct {
+	// Base URL of the service, e.g. "http://localhost:8081"
+	BaseURL string
+
+	// HTTP client to use, its Timeout applies to each attempt.
+	HTTPClient *http.Client
+
+	// Number of retries of failed idempotent (GET and PUT) requests.
+	// Requests are retried on network errors, HTTP 5xx and 429 responses, and
+	// if the service reports its store is unavailable. Retries of 429 responses
+	// wait at least for the duration given in their Retry-After header.
+	Retries int
+
+	// Wait time before the first retry, doubled for each further retry.
+	RetryWait time.Duration
+
+	// Optional function to prepare requests before sending them, e.g. to add
+	// authentication headers.
+	PrepareRequest func(r *http.Request)
+
+	// Optional token to authenticate with, sent as a bearer token.
+	// See Login().
+	Token string
+
+	// Optional API key to authenticate with, sent in the productws.APIKeyHeader header.
+	APIKey string
+}
+
+// New returns a new Client using the specified base URL of the service,
+// with 10 seconds timeout and 2 retries.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Retries:    2,
+		RetryWait:  200 * time.Millisecond,
+	}
+}
+
+// ListFilter holds optional filters of the list call.
+type ListFilter struct {
+	ModifiedSince time.Time // Only products modified at or after this time
+	CreatedSince  time.Time // Only products created at or after this time
+	UpdatedBy     string    // Only products last modified by this caller
+}
+
+// Create creates a new product, returns its ID.
+func (c *Client) Create(ctx context.Context, p *productws.Product) (productws.ID, error) {
+	var data struct{ ID productws.ID }
+	err := c.Do(ctx, http.MethodPost, "create", nil, p, &data)
+	return data.ID, err
+}
+
+// List returns the IDs of all products, optionally filtered (f may be nil).
+func (c *Client) List(ctx context.Context, f *ListFilter) ([]productws.ID, error) {
+	q := url.Values{}
+	if f != nil {
+		if !f.ModifiedSince.IsZero() {
+			q.Set("modifiedSince", f.ModifiedSince.Format(time.RFC3339))
+		}
+		if !f.CreatedSince.IsZero() {
+			q.Set("createdSince", f.CreatedSince.Format(time.RFC3339))
+		}
+		if f.UpdatedBy != "" {
+			q.Set("updatedBy", f.UpdatedBy)
+		}
+	}
+
+	var ids []productws.ID
+	err := c.Do(ctx, http.MethodGet, "list", q, nil, &ids)
+	return ids, err
+}
+
+// Details returns the details of a product.
+func (c *Client) Details(ctx context.Context, id productws.ID) (*productws.Product, error) {
+	p := new(productws.Product)
+	if err := c.Do(ctx, http.MethodGet, "details/"+strconv.FormatInt(int64(id), 10), nil, nil, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Update updates an existing product.
+func (c *Client) Update(ctx context.Context, p *productws.Product) error {
+	return c.Do(ctx, http.MethodPut, "update", nil, p, nil)
+}
+
+// SetPrices sets (merges) price points of a product.
+func (c *Client) SetPrices(ctx context.Context, id productws.ID, prices map[string]productws.Price) error {
+	return c.Do(ctx, http.MethodPut, "setprices", nil, &productws.Product{ID: id, Prices: prices}, nil)
+}
+
+// Audit queries the audit log (f may be nil).
+func (c *Client) Audit(ctx context.Context, f *productws.AuditFilter) ([]*productws.AuditEntry, error) {
+	q := url.Values{}
+	if f != nil {
+		if f.ID != 0 {
+			q.Set("id", strconv.FormatInt(int64(f.ID), 10))
+		}
+		if f.Op != "" {
+			q.Set("op", f.Op)
+		}
+		if f.Caller != "" {
+			q.Set("caller", f.Caller)
+		}
+		if !f.Since.IsZero() {
+			q.Set("since", f.Since.Format(time.RFC3339))
+		}
+		if !f.Until.IsZero() {
+			q.Set("until", f.Until.Format(time.RFC3339))
+		}
+		if f.Limit > 0 {
+			q.Set("limit", strconv.Itoa(f.Limit))
+		}
+	}
+
+	var entries []*productws.AuditEntry
+	err := c.Do(ctx, http.MethodGet, "audit", q, nil, &entries)
+	return entries, err
+}
+
+// AddWebhook subscribes a webhook, returns the subscription including its ID and Secret.
+func (c *Client) AddWebhook(ctx context.Context, wh *productws.Webhook) (*productws.Webhook, error) {
+	res := new(productws.Webhook)
+	if err := c.Do(ctx, http.MethodPost, "addwebhook", nil, wh, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Webhooks returns the webhook subscriptions.
+func (c *Client) Webhooks(ctx context.Context) ([]*productws.Webhook, error) {
+	var whs []*productws.Webhook
+	err := c.Do(ctx, http.MethodGet, "webhooks", nil, nil, &whs)
+	return whs, err
+}
+
+// DelWebhook deletes a webhook subscription.
+func (c *Client) DelWebhook(ctx context.Context, id string) error {
+	return c.Do(ctx, http.MethodPost, "delwebhook", nil, &productws.Webhook{ID: id}, nil)
+}
+
+// Deliveries returns webhook deliveries, optionally filtered by webhook ID and status.
+func (c *Client) Deliveries(ctx context.Context, webhookID, status string) ([]*productws.Delivery, error) {
+	q := url.Values{}
+	if webhookID != "" {
+		q.Set("webhook", webhookID)
+	}
+	if status != "" {
+		q.Set("status", status)
+	}
+
+	var dls []*productws.Delivery
+	err := c.Do(ctx, http.MethodGet, "deliveries", q, nil, &dls)
+	return dls, err
+}
+
+// Login exchanges credentials for an authentication token, returns the token and
+// its expiration time. The credentials (e.g. HTTP Basic auth) are to be added by PrepareRequest.
+// The returned token is not set to c.Token.
+func (c *Client) Login(ctx context.Context) (token string, expires time.Time, err error) {
+	var data struct {
+		Token   string
+		Expires time.Time
+	}
+	err = c.Do(ctx, http.MethodPost, "login", nil, nil, &data)
+	return data.Token, data.Expires, err
+}
+
+// Logout revokes the authentication token of the client (c.Token).
+func (c *Client) Logout(ctx context.Context) error {
+	return c.Do(ctx, http.MethodPost, "logout", nil, nil, nil)
+}
+
+// AddAPIKey creates an API key, returns the API key including its ID and Key.
+// Only Name, Scopes, Tags, RateLimit and Burst of k are used.
+func (c *Client) AddAPIKey(ctx context.Context, k *productws.APIKey) (*productws.APIKey, error) {
+	res := new(productws.APIKey)
+	if err := c.Do(ctx, http.MethodPost, "addapikey", nil, k, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// APIKeys returns the API keys (without their keys).
+func (c *Client) APIKeys(ctx context.Context) ([]*productws.APIKey, error) {
+	var ks []*productws.APIKey
+	err := c.Do(ctx, http.MethodGet, "apikeys", nil, nil, &ks)
+	return ks, err
+}
+
+// RevokeAPIKey revokes an API key.
+func (c *Client) RevokeAPIKey(ctx context.Context, id string) error {
+	return c.Do(ctx, http.MethodPost, "revokeapikey", nil, &productws.APIKey{ID: id}, nil)
+}
+
+// RotateAPIKey replaces the key of an API key, returns the API key including its new Key.
+func (c *Client) RotateAPIKey(ctx context.Context, id string) (*productws.APIKey, error) {
+	res := new(productws.APIKey)
+	if err := c.Do(ctx, http.MethodPost, "rotateapikey", nil, &productws.APIKey{ID: id}, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Ready checks if the service is ready to serve requests (its store is usable).
+// Returns nil if it is.
+func (c *Client) Ready(ctx context.Context) error {
+	return c.Do(ctx, http.MethodGet, "readyz", nil, nil, nil)
+}
+
+// Do performs an API call. path is relative to the base URL, query is optional.
+// body (if not nil) is sent as JSON, and the Data of the response is decoded into data (if not nil).
+// Can be used to perform API calls not (yet) covered by dedicated methods.
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, body, data interface{}) error {
+	var bodyData []byte
+	if body != nil {
+		var err error
+		if bodyData, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	u := c.BaseURL + "/" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	retries := c.Retries
+	if method == http.MethodPost {
+		retries = 0 // Not idempotent
+	}
+
+	op := strings.SplitN(path, "/", 2)[0]
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		retry, err := c.do(ctx, op, method, u, bodyData, data)
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+
+		w := wait
+		if rl, ok := err.(*RateLimitError); ok && rl.RetryAfter > w {
+			w = rl.RetryAfter
+		}
+		select {
+		case <-time.After(w):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// do makes an attempt of an API call. Tells if the call may be retried in case of error.
+func (c *Client) do(ctx context.Context, op, method, u string, bodyData []byte, data interface{}) (retry bool, err error) {
+	var body io.Reader
+	if bodyData != nil {
+		body = bytes.NewReader(bodyData)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return false, err
+	}
+	if bodyData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	productws.InjectTraceparent(ctx, req.Header) // Continue the trace of the caller, if any
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.APIKey != "" {
+		req.Header.Set(productws.APIKeyHeader, c.APIKey)
+	}
+	if c.PrepareRequest != nil {
+		c.PrepareRequest(req)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return false, ErrUnauthorized
+	case http.StatusForbidden:
+		return false, ErrForbidden
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		// Not a JSON response, e.g. an HTTP error
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return true, &RateLimitError{Op: op, Msg: strings.TrimSpace(string(msg)), RetryAfter: retryAfter(resp.Header)}
+		}
+		return retry, &APIError{Op: op, StatusCode: resp.StatusCode, Msg: strings.TrimSpace(string(msg))}
+	}
+
+	// Data is decoded later, when we know the call succeeded (it may also be null):
+	var jr struct {
+		productws.JSONResp
+		Data json.RawMessage
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jr); err != nil {
+		return retry, fmt.Errorf("productws %s: can't decode response: %v", op, err)
+	}
+
+	if !jr.Success {
+		switch jr.Error {
+		case productws.MsgInvalidIDErr:
+			return false, productws.ErrInvalidId
+		case productws.MsgGeneralStoreErr:
+			return true, ErrStoreUnavailable
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return true, &RateLimitError{Op: jr.Op, Msg: jr.Error, RetryAfter: retryAfter(resp.Header)}
+		}
+		return retry, &APIError{Op: jr.Op, StatusCode: resp.StatusCode, Msg: jr.Error}
+	}
+
+	if data != nil && len(jr.Data) > 0 {
+		if err := json.Unmarshal(jr.Data, data); err != nil {
+			return false, fmt.Errorf("productws %s: can't decode response data: %v", jr.Op, err)
+		}
+	}
+
+	return false, nil
+}
+
+// retryAfter returns the wait time told by the Retry-After header (in seconds or as an HTTP date),
+// 0 if it is missing or invalid.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
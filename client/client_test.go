@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"github.com/icza/productws"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseData(t *testing.T) {
+	cases := []struct {
+		resp   string
+		expErr bool
+		expLen int
+	}{
+		{`{"Op":"list","Success":true,"Data":[1,2,3]}`, false, 3},
+		{`{"Op":"list","Success":true,"Data":null}`, false, 0},
+		{`{"Op":"list","Success":true}`, false, 0},
+		{`{"Op":"list","Success":false,"Error":"Oops","Data":null}`, true, 0},
+		{`{"Op":"list","Success":true,"Data":"x"}`, true, 0},
+	}
+
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(c.resp))
+		}))
+		ids, err := New(srv.URL).List(context.Background(), nil)
+		srv.Close()
+
+		if (err != nil) != c.expErr {
+			t.Errorf("[resp: %s] Expected error: %v, got: %v", c.resp, c.expErr, err)
+		}
+		if len(ids) != c.expLen {
+			t.Errorf("[resp: %s] Expected %d IDs, got: %v", c.resp, c.expLen, ids)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	cases := []struct {
+		status     int
+		json       bool
+		body       string
+		retryAfter string
+		expErr     error // Expected error, nil if a *RateLimitError is expected
+	}{
+		{http.StatusUnauthorized, false, "Unauthorized", "", ErrUnauthorized},
+		{http.StatusForbidden, true, `{"Op":"list","Error":"` + productws.MsgForbiddenErr + `"}`, "", ErrForbidden},
+		{http.StatusOK, true, `{"Op":"list","Error":"` + productws.MsgInvalidIDErr + `"}`, "", productws.ErrInvalidId},
+		{http.StatusTooManyRequests, true, `{"Op":"list","Error":"` + productws.MsgRateLimitErr + `"}`, "3", nil},
+		{http.StatusTooManyRequests, true, `{"Op":"list","Error":"` + productws.MsgTooBusyErr + `"}`, "", nil},
+		{http.StatusTooManyRequests, false, "Slow down", "3", nil},
+	}
+
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.json {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			if c.retryAfter != "" {
+				w.Header().Set("Retry-After", c.retryAfter)
+			}
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+		cl := New(srv.URL)
+		cl.Retries = 0
+		_, err := cl.List(context.Background(), nil)
+		srv.Close()
+
+		if c.expErr != nil {
+			if err != c.expErr {
+				t.Errorf("[resp: %d %s] Expected error: %v, got: %v", c.status, c.body, c.expErr, err)
+			}
+			continue
+		}
+		rl, ok := err.(*RateLimitError)
+		if !ok {
+			t.Errorf("[resp: %d %s] Expected *RateLimitError, got: %v", c.status, c.body, err)
+			continue
+		}
+		if exp := retryAfter(http.Header{"Retry-After": {c.retryAfter}}); rl.RetryAfter != exp || rl.Msg == "" {
+			t.Errorf("[resp: %d %s] Expected RetryAfter %v, got: %+v", c.status, c.body, exp, rl)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		v   string
+		exp time.Duration
+	}{
+		{"", 0},
+		{"2", 2 * time.Second},
+		{"-1", 0},
+		{"x", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, c := range cases {
+		if got := retryAfter(http.Header{"Retry-After": {c.v}}); got != c.exp {
+			t.Errorf("[%q] Expected %v, got: %v", c.v, c.exp, got)
+		}
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := retryAfter(http.Header{"Retry-After": {future}}); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("[%q] Expected about 1h, got: %v", future, got)
+	}
+
+	// Retries wait as told:
+	var attempts []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"Op":"list","Error":"` + productws.MsgRateLimitErr + `"}`))
+			return
+		}
+		w.Write([]byte(`{"Op":"list","Success":true,"Data":[1]}`))
+	}))
+	defer srv.Close()
+
+	cl := New(srv.URL)
+	cl.RetryWait = time.Millisecond
+	if _, err := cl.List(context.Background(), nil); err != nil {
+		t.Fatalf("Expected success after retry, got: %v", err)
+	}
+	if len(attempts) != 2 || attempts[1].Sub(attempts[0]) < time.Second {
+		t.Errorf("Expected retry after at least 1s, got: %v", attempts)
+	}
+}
@@ -0,0 +1,342 @@
+/*
+
+Package main is a command-line client tool for managing products of a productws service.
+
+Usage:
+    prodctl [flags] <command> [arguments]
+
+Commands:
+    list                          list product IDs
+    get <id>                      get details of a product
+    create -f <file>              create a product from a JSON file ("-" for stdin)
+    update -f <file>              update a product from a JSON file ("-" for stdin)
+    set-price <id> <curr> <price> set a price point of a product, e.g. set-price 3 GBP 19.99
+    export                        export all products
+    login                         obtain an authentication token (to be used with -token)
+    logout                        revoke the authentication token
+
+Flags:
+    -server  base URL of the service (default: $PRODCTL_SERVER or http://localhost:8081)
+    -o       output format: table, json or yaml (default: table)
+    -user    credentials for HTTP Basic auth as user:password (default: $PRODCTL_USER)
+    -token   authentication token obtained by login (default: $PRODCTL_TOKEN)
+    -apikey  API key to authenticate with (default: $PRODCTL_APIKEY)
+
+Exit codes:
+    0  success
+    1  the service reported an error (JSONResp.Success is false)
+    2  invalid usage
+    3  the service could not be reached
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/icza/productws"
+	"github.com/icza/productws/client"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes
+const (
+	exitAPIErr   = 1
+	exitUsage    = 2
+	exitConnFail = 3
+)
+
+// Command line flags
+var (
+	server = flag.String("server", defaultServer(), "base URL of the service (env: PRODCTL_SERVER)")
+	output = flag.String("o", "table", "output format: table, json or yaml")
+	user   = flag.String("user", os.Getenv("PRODCTL_USER"), "credentials for HTTP Basic auth as user:password (env: PRODCTL_USER)")
+	token  = flag.String("token", os.Getenv("PRODCTL_TOKEN"), "authentication token obtained by login (env: PRODCTL_TOKEN)")
+	apiKey = flag.String("apikey", os.Getenv("PRODCTL_APIKEY"), "API key to authenticate with (env: PRODCTL_APIKEY)")
+)
+
+// defaultServer returns the default base URL of the service.
+func defaultServer() string {
+	if s := os.Getenv("PRODCTL_SERVER"); s != "" {
+		return s
+	}
+	return "http://localhost:8081"
+}
+
+// usageError is an error of invalid usage.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: prodctl [flags] <command> [arguments]")
+		fmt.Fprintln(os.Stderr, "Commands: list, get <id>, create -f <file>, update -f <file>, set-price <id> <curr> <price>, export")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch *output {
+	case "table", "json", "yaml":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid output format: %q\n", *output)
+		os.Exit(exitUsage)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	c := client.New(*server)
+	if *user != "" {
+		name, password, _ := strings.Cut(*user, ":")
+		c.PrepareRequest = func(r *http.Request) { r.SetBasicAuth(name, password) }
+	}
+	c.Token, c.APIKey = *token, *apiKey
+	err := run(c, flag.Arg(0), flag.Args()[1:])
+	if err == nil {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	switch err.(type) {
+	case usageError:
+		os.Exit(exitUsage)
+	case *client.APIError, *client.RateLimitError:
+		os.Exit(exitAPIErr)
+	}
+	if err == productws.ErrInvalidId || err == client.ErrStoreUnavailable ||
+		err == client.ErrUnauthorized || err == client.ErrForbidden {
+		os.Exit(exitAPIErr)
+	}
+	os.Exit(exitConnFail)
+}
+
+// run runs a command.
+func run(c *client.Client, cmd string, args []string) error {
+	ctx := context.Background()
+
+	switch cmd {
+	case "list":
+		ids, err := c.List(ctx, nil)
+		if err != nil {
+			return err
+		}
+		return printOut(ids, func(w io.Writer) {
+			fmt.Fprintln(w, "ID")
+			for _, id := range ids {
+				fmt.Fprintln(w, id)
+			}
+		})
+
+	case "get":
+		if len(args) != 1 {
+			return usageError("get requires exactly 1 argument: <id>")
+		}
+		id, err := parseID(args[0])
+		if err != nil {
+			return err
+		}
+		p, err := c.Details(ctx, id)
+		if err != nil {
+			return err
+		}
+		return printOut(p, func(w io.Writer) { printProduct(w, p) })
+
+	case "create", "update":
+		p, err := readProduct(cmd, args)
+		if err != nil {
+			return err
+		}
+		if cmd == "create" {
+			p.ID, err = c.Create(ctx, p)
+		} else {
+			err = c.Update(ctx, p)
+		}
+		if err != nil {
+			return err
+		}
+		data := struct{ ID productws.ID }{p.ID}
+		return printOut(data, func(w io.Writer) { fmt.Fprintf(w, "ID\n%d\n", p.ID) })
+
+	case "set-price":
+		if len(args) != 3 {
+			return usageError("set-price requires exactly 3 arguments: <id> <curr> <price>")
+		}
+		id, err := parseID(args[0])
+		if err != nil {
+			return err
+		}
+		price, err := productws.ParsePrice(args[2])
+		if err != nil {
+			return usageError(err.Error())
+		}
+		curr := strings.ToUpper(args[1])
+		if err := c.SetPrices(ctx, id, map[string]productws.Price{curr: price}); err != nil {
+			return err
+		}
+		data := struct{ ID productws.ID }{id}
+		return printOut(data, func(w io.Writer) { fmt.Fprintf(w, "ID\n%d\n", id) })
+
+	case "export":
+		ids, err := c.List(ctx, nil)
+		if err != nil {
+			return err
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		ps := make([]*productws.Product, 0, len(ids))
+		for _, id := range ids {
+			p, err := c.Details(ctx, id)
+			if err != nil {
+				if err == productws.ErrInvalidId {
+					continue // Removed in the mean time
+				}
+				return err
+			}
+			ps = append(ps, p)
+		}
+		return printOut(ps, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tNAME\tTAGS\tPRICES\tUPDATED")
+			for _, p := range ps {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", p.ID, p.Name, strings.Join(p.Tags, ","),
+					formatPrices(p.Prices), formatTime(p.UpdatedAt))
+			}
+		})
+
+	case "login":
+		tk, expires, err := c.Login(ctx)
+		if err != nil {
+			return err
+		}
+		data := struct {
+			Token   string
+			Expires time.Time
+		}{tk, expires}
+		return printOut(data, func(w io.Writer) { fmt.Fprintf(w, "TOKEN\tEXPIRES\n%s\t%s\n", tk, formatTime(expires)) })
+
+	case "logout":
+		if c.Token == "" {
+			return usageError("logout requires the -token flag")
+		}
+		return c.Logout(ctx)
+	}
+
+	return usageError(fmt.Sprintf("unknown command: %q", cmd))
+}
+
+// parseID parses a product ID.
+func parseID(s string) (productws.ID, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, usageError(fmt.Sprintf("invalid product ID: %q", s))
+	}
+	return productws.ID(id), nil
+}
+
+// readProduct reads the JSON product specified by the -f flag of the create and update commands.
+func readProduct(cmd string, args []string) (*productws.Product, error) {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	file := fs.String("f", "", `JSON file of the product ("-" for stdin)`)
+	if err := fs.Parse(args); err != nil {
+		return nil, usageError(err.Error())
+	}
+	if *file == "" {
+		return nil, usageError(cmd + " requires the -f flag")
+	}
+
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return nil, usageError(err.Error())
+	}
+
+	p := new(productws.Product)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, usageError("invalid product JSON: " + err.Error())
+	}
+	return p, nil
+}
+
+// printOut prints v in the selected output format.
+// printTable is used to print the table format.
+func printOut(v interface{}, printTable func(w io.Writer)) error {
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+
+	case "yaml":
+		// Go through JSON so field names are the same as in the JSON format
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(generic); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	printTable(w)
+	return w.Flush()
+}
+
+// printProduct prints the details of a product in table format.
+func printProduct(w io.Writer, p *productws.Product) {
+	fmt.Fprintf(w, "ID\t%d\n", p.ID)
+	fmt.Fprintf(w, "Name\t%s\n", p.Name)
+	fmt.Fprintf(w, "Desc\t%s\n", p.Desc)
+	fmt.Fprintf(w, "Tags\t%s\n", strings.Join(p.Tags, ", "))
+	fmt.Fprintf(w, "Prices\t%s\n", formatPrices(p.Prices))
+	fmt.Fprintf(w, "CreatedAt\t%s\n", formatTime(p.CreatedAt))
+	fmt.Fprintf(w, "UpdatedAt\t%s\n", formatTime(p.UpdatedAt))
+	fmt.Fprintf(w, "UpdatedBy\t%s\n", p.UpdatedBy)
+}
+
+// formatPrices formats price points sorted by currency, e.g. "GBP 19.99, USD 27.82".
+func formatPrices(prices map[string]productws.Price) string {
+	currs := make([]string, 0, len(prices))
+	for curr := range prices {
+		currs = append(currs, curr)
+	}
+	sort.Strings(currs)
+
+	parts := make([]string, len(currs))
+	for i, curr := range currs {
+		parts[i] = curr + " " + prices[curr].String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatTime formats a time for table output, zero time is formatted as "-".
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -5,6 +5,8 @@ Package main is the main package of the product web service demo application.
 It starts the web service with an in-memory store implementation.
 
 Test products are inserted by default (can be disabled with -testdata=false).
+Alternatively a snapshot (-snapshot) or seed files (-seed) can be loaded, or synthetic
+products can be generated (-gen).
 
 Also imports html-tester, so the tester page will be self-contained and made available under
     /tester.html
@@ -13,32 +15,286 @@ Also imports html-tester, so the tester page will be self-contained and made ava
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"github.com/icza/productws"
+	"github.com/icza/productws/apikeystore"
+	"github.com/icza/productws/auditsink"
+	"github.com/icza/productws/cachestore"
 	_ "github.com/icza/productws/html-tester"
+	"github.com/icza/productws/htpasswd"
 	"github.com/icza/productws/inmemstore"
+	"github.com/icza/productws/rbac"
+	"github.com/icza/productws/remotestore"
+	"github.com/icza/productws/spanexport"
+	"github.com/icza/productws/storemw"
+	"github.com/icza/productws/tlsutil"
+	"github.com/icza/productws/tokenstore"
+	"github.com/icza/productws/webhookstore"
+	"io"
 	"log"
-	"net/http"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 )
 
 // Command line flags
 var (
 	addr     = flag.String("addr", ":8081", "address to start server on (host:port)")
 	testData = flag.Bool("testdata", true, "tells if test data should be inserted on startup")
+	snapshot = flag.String("snapshot", "", "snapshot file to load on startup (instead of test data)")
+	seed     = flag.String("seed", "", "seed file (JSON, NDJSON or CSV) or directory of seed files to load on startup (instead of test data)")
+	gen      = flag.Int("gen", 0, "number of synthetic products to generate on startup (instead of test data)")
+	genSeed  = flag.Int64("genseed", 1, "random seed of generating synthetic products")
+	auditLog = flag.String("auditlog", "", "audit log file to append to (audit log is kept in memory if not specified)")
+	auditDir = flag.String("auditdir", "", "directory of a durable store to keep the audit log in (instead of -auditlog)")
+	dataDir  = flag.String("datadir", "", "directory of the write-ahead log and snapshots of the in-memory store (store is volatile if not specified)")
+	fsync    = flag.String("fsync", "always", "write-ahead log sync policy: always, batch or interval")
+	primary  = flag.String("primary", "", "base URL of a primary node to store products in (e.g. http://primary:8081), in-memory store is used if not specified")
+	cacheTTL = flag.Duration("cachettl", 0, "TTL of products cached from the primary node (caching is disabled if 0)")
+	storeLog = flag.Bool("storelog", false, "tells if all store calls should be logged (failed calls are always logged)")
+	faultErr = flag.Float64("faulterr", 0, "probability of injected store errors (0..1), for testing")
+	faultLat = flag.Duration("faultlat", 0, "max random latency injected into store calls, for testing")
+	tlsCert  = flag.String("tlscert", "", "TLS certificate file (PEM) to serve HTTPS with, reloaded on change")
+	tlsKey   = flag.String("tlskey", "", "TLS key file (PEM) of the certificate")
+	clientCA = flag.String("clientca", "", "CA bundle file (PEM) to verify client certificates with (enables mutual TLS)")
+	devCert  = flag.Bool("devcert", false, "generate a self-signed development certificate to -tlscert and -tlskey if they don't exist")
+	userFile = flag.String("htpasswd", "", "htpasswd file (bcrypt hashes) to authenticate callers with HTTP Basic auth (authentication is disabled if not specified)")
+	roleFile = flag.String("roles", "", "JSON policy file of roles and their users to authorize API calls with (authorization is disabled if not specified)")
+	keyFile  = flag.String("apikeys", "", "file to persist API keys to, API keys are enabled with -htpasswd (kept in memory if not specified)")
+	tokenTTL = flag.Duration("tokenttl", 0, "TTL of authentication tokens issued by login, requires -htpasswd (token authentication is disabled if 0)")
+	tokenMax = flag.Duration("tokenmax", 0, "max lifetime of authentication tokens, tokens are renewed on use if specified")
+	tokenIP  = flag.Bool("tokenip", false, "tells if authentication tokens should be bound to the IP address they were issued to")
+	readRate = flag.Float64("readrate", 0, "max rate of read (GET) calls per second per client (unlimited if 0)")
+	writeRt  = flag.Float64("writerate", 0, "max rate of other calls per second per client (unlimited if 0)")
+	rateByID = flag.Bool("ratebyid", false, "tells if clients are rate limited by their authenticated identity instead of IP address")
+	ipRate   = flag.Float64("iprate", 0, "max rate of all calls per second per IP address before authentication if -ratebyid is set (the read and write rates if 0)")
+	maxCalls = flag.Int("maxinflight", 0, "max number of API calls served concurrently (unlimited if 0)")
+	wsOrigin = flag.String("wsorigins", "", "comma separated origins of web pages allowed to open WebSocket connections besides the server's own (* allows all)")
+	drain    = flag.Duration("drain", 30*time.Second, "max time to wait for in-flight requests on shutdown")
+	logFmt   = flag.String("logformat", "text", "log format: text or json")
+	traceLog = flag.String("tracefile", "", "file to export trace spans to in OTLP/JSON format (tracing is disabled if not specified)")
+	webhooks = flag.String("webhooks", "", "file to persist webhook subscriptions to (kept in memory if not specified)")
+	whLocal  = flag.Bool("webhooklocal", false, "tells if webhook URLs may point to internal (loopback, private, link-local) addresses")
 )
 
 func main() {
 	flag.Parse()
 
-	store := inmemstore.NewInmemStore()
+	var logHandler slog.Handler
+	switch *logFmt {
+	case "text":
+		logHandler = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		logHandler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		log.Fatalf("Invalid log format: %q", *logFmt)
+	}
+	logger := slog.New(logHandler)
+	slog.SetDefault(logger) // Also routes the standard logger
+	productws.SetLogger(logger)
+
+	// Closed on shutdown, in order:
+	var closers []io.Closer
+
+	if *traceLog != "" {
+		exp, err := spanexport.NewFileExporter(*traceLog, "proddemo")
+		if err != nil {
+			log.Fatalf("Failed to open trace file: %v", err)
+		}
+		productws.SetSpanExporter(exp)
+		defer exp.Close() // After everything else
+	}
+
+	var store productws.Store
+	switch {
+	case *primary != "":
+		store = remotestore.NewRemoteStore(*primary, nil)
+		*testData = false // Test data is in the primary node
+	case *dataDir != "":
+		policies := map[string]inmemstore.SyncPolicy{
+			"always": inmemstore.SyncAlways, "batch": inmemstore.SyncBatch, "interval": inmemstore.SyncInterval}
+		policy, ok := policies[*fsync]
+		if !ok {
+			log.Fatalf("Invalid fsync policy: %q", *fsync)
+		}
+		var err error
+		if store, err = inmemstore.NewDurableInmemStore(*dataDir, &inmemstore.DurableOptions{Sync: policy}); err != nil {
+			log.Fatalf("Failed to open durable store: %v", err)
+		}
+		if ids, err := store.AllIDs(); err == nil && len(ids) > 0 {
+			*testData = false // Existing data recovered
+		}
+	default:
+		store = inmemstore.NewInmemStore()
+	}
+
+	mws := []storemw.Middleware{storemw.Logging(!*storeLog)}
+	if *primary != "" {
+		mws = append(mws, storemw.CircuitBreaker(nil), storemw.Retry(nil))
+	}
+	if *faultErr > 0 || *faultLat > 0 {
+		mws = append(mws, storemw.FaultInjection(storemw.FaultOptions{ErrorRate: *faultErr, MaxLatency: *faultLat}))
+	}
+	store = storemw.Chain(store, mws...)
+	if *primary != "" && *cacheTTL > 0 {
+		store = cachestore.NewCacheStore(store, &cachestore.Options{TTL: *cacheTTL})
+	}
+	store = storemw.Chain(store, storemw.Prometheus())
 	productws.SetStore(store)
 
-	if *testData {
+	if *userFile != "" {
+		auth, err := htpasswd.NewFile(*userFile, "productws")
+		if err != nil {
+			log.Fatalf("Failed to load htpasswd file: %v", err)
+		}
+		productws.SetAuthenticator(auth)
+		if *tokenTTL > 0 {
+			productws.EnableTokens(tokenstore.NewMemStore(), auth, &productws.TokenOptions{
+				TTL: *tokenTTL, Sliding: *tokenMax > 0, MaxLifetime: *tokenMax, BindIP: *tokenIP})
+		}
+		if *keyFile == "" {
+			productws.EnableAPIKeys(apikeystore.NewMemStore())
+		} else {
+			ks, err := apikeystore.NewFileStore(*keyFile)
+			if err != nil {
+				log.Fatalf("Failed to load API keys: %v", err)
+			}
+			productws.EnableAPIKeys(ks)
+		}
+	}
+	if *roleFile != "" {
+		authz, err := rbac.NewFile(*roleFile)
+		if err != nil {
+			log.Fatalf("Failed to load roles file: %v", err)
+		}
+		productws.SetAuthorizer(authz)
+	}
+	if *readRate > 0 || *writeRt > 0 || *maxCalls > 0 {
+		productws.SetRateLimits(&productws.RateLimitOptions{
+			Read:        productws.Limit{Rate: *readRate, Burst: int(2 * *readRate)},
+			Write:       productws.Limit{Rate: *writeRt, Burst: int(2 * *writeRt)},
+			ByIdentity:  *rateByID,
+			IP:          productws.Limit{Rate: *ipRate, Burst: int(2 * *ipRate)},
+			MaxInFlight: *maxCalls,
+		})
+	}
+	if *wsOrigin != "" {
+		productws.SetWebSocketOrigins(strings.Split(*wsOrigin, ",")...)
+	}
+	if c, ok := store.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+
+	switch {
+	case *auditDir != "":
+		auditStore, err := inmemstore.NewDurableInmemStore(*auditDir, nil)
+		if err != nil {
+			log.Fatalf("Failed to open audit store: %v", err)
+		}
+		sink := auditsink.NewStoreSink(auditStore)
+		productws.SetAuditSink(sink)
+		closers = append(closers, sink.(io.Closer))
+	case *auditLog == "":
+		productws.SetAuditSink(auditsink.NewMemSink())
+	default:
+		sink, err := auditsink.NewFileSink(*auditLog)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		productws.SetAuditSink(sink)
+		if c, ok := sink.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+	}
+
+	whOpts := &productws.WebhookOptions{AllowInternal: *whLocal}
+	if *webhooks == "" {
+		productws.EnableWebhooks(webhookstore.NewMemStore(), whOpts)
+	} else {
+		ws, err := webhookstore.NewFileStore(*webhooks)
+		if err != nil {
+			log.Fatalf("Failed to load webhooks: %v", err)
+		}
+		productws.EnableWebhooks(ws, whOpts)
+	}
+
+	if *snapshot != "" {
+		loadSnapshot(store, *snapshot)
+	}
+	if *seed != "" {
+		if err := loadSeed(store, *seed); err != nil {
+			log.Fatalf("Failed to load seed data: %v", err)
+		}
+	}
+	if *gen > 0 {
+		if err := generateProducts(store, *gen, *genSeed); err != nil {
+			log.Fatalf("Failed to generate products: %v", err)
+		}
+	}
+	if *testData && *snapshot == "" && *seed == "" && *gen == 0 {
 		insertTestData(store)
 	}
 
-	log.Printf("Starting server on %q...", *addr)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	serve(*addr, tlsConfig(), *drain, closers)
+}
+
+// tlsConfig returns the TLS config specified by the flags, nil if TLS is not enabled.
+func tlsConfig() *tls.Config {
+	if *devCert {
+		if *tlsCert == "" {
+			*tlsCert = "devcert.pem"
+		}
+		if *tlsKey == "" {
+			*tlsKey = "devkey.pem"
+		}
+		if _, err := os.Stat(*tlsCert); os.IsNotExist(err) {
+			hosts := []string{"localhost", "127.0.0.1", "::1"}
+			if err := tlsutil.GenerateSelfSigned(*tlsCert, *tlsKey, hosts, 365*24*time.Hour); err != nil {
+				log.Fatalf("Failed to generate development certificate: %v", err)
+			}
+			log.Printf("Generated self-signed development certificate: %s", *tlsCert)
+		}
+	}
+
+	if *tlsCert == "" && *tlsKey == "" {
+		if *clientCA != "" {
+			log.Fatalf("-clientca requires -tlscert and -tlskey")
+		}
+		return nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		log.Fatalf("Both -tlscert and -tlskey must be specified")
+	}
+
+	cr, err := tlsutil.NewCertReloader(*tlsCert, *tlsKey, 0)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	var clientCAs *x509.CertPool
+	if *clientCA != "" {
+		if clientCAs, err = tlsutil.LoadCertPool(*clientCA); err != nil {
+			log.Fatalf("Failed to load client CA bundle: %v", err)
+		}
+	}
+	return tlsutil.ServerConfig(cr, clientCAs)
+}
+
+// loadSnapshot loads a snapshot file into the store.
+func loadSnapshot(store productws.Store, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatalf("Failed to open snapshot: %v", err)
+	}
+	defer f.Close()
+
+	count, err := productws.Restore(f, store)
+	if err != nil {
+		log.Fatalf("Failed to load snapshot (%d products loaded): %v", count, err)
+	}
+	log.Printf("Snapshot loaded (%d products)", count)
 }
 
 // insertTestData inserts test products into the store.
@@ -55,7 +311,9 @@ func insertTestData(store productws.Store) {
 			}},
 	}
 
+	now := time.Now()
 	for _, p := range ps {
+		p.CreatedAt, p.UpdatedAt, p.UpdatedBy = now, now, "proddemo"
 		if err := store.Save(p); err != nil {
 			log.Printf("Failed to insert test product ID=%d: %v", p.ID, err)
 		} else {
@@ -0,0 +1,213 @@
+/*
+
+Loading seed data from files, and generating synthetic products.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/icza/productws"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Identity recorded as UpdatedBy of seeded products
+const seedCaller = "seed"
+
+// loadSeed loads seed data from a file or from all supported files of a directory
+// (in name order) into the store.
+// Supported formats (by extension): .json (array of products or a single product),
+// .ndjson / .jsonl (one product per line, snapshots are also accepted), .csv.
+func loadSeed(store productws.Store, name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return loadSeedFile(store, name)
+	}
+
+	fis, err := ioutil.ReadDir(name) // Sorted by name
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || seedFormat(fi.Name()) == "" {
+			continue
+		}
+		if err := loadSeedFile(store, filepath.Join(name, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedFormat returns the format of a seed file based on its extension,
+// or an empty string if it is not supported.
+func seedFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return "json"
+	case ".ndjson", ".jsonl":
+		return "ndjson"
+	case ".csv":
+		return "csv"
+	}
+	return ""
+}
+
+// loadSeedFile loads a seed file into the store.
+func loadSeedFile(store productws.Store, name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var ps []*productws.Product
+	switch seedFormat(name) {
+	case "json":
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 && data[0] == '[' {
+			err = json.Unmarshal(data, &ps)
+		} else {
+			p := new(productws.Product)
+			err = json.Unmarshal(data, p)
+			ps = append(ps, p)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+	case "ndjson":
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			if line == 1 && bytes.Contains(scanner.Bytes(), []byte(productws.SnapshotFormat)) {
+				continue // Snapshot header
+			}
+			p := new(productws.Product)
+			if err := json.Unmarshal(scanner.Bytes(), p); err != nil {
+				return fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+			ps = append(ps, p)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+	case "csv":
+		res, err := productws.ImportCSV(store, bytes.NewReader(data),
+			&productws.CSVOptions{IgnoreIDs: true, Caller: seedCaller})
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		for _, re := range res.Errors {
+			log.Printf("%s:%d: %s", name, re.Row, re.Error)
+		}
+		if len(res.Errors) > 0 {
+			return fmt.Errorf("%s: invalid rows", name)
+		}
+		log.Printf("Seed file %s loaded (%d products)", name, len(res.Created))
+		return nil
+
+	default:
+		return fmt.Errorf("%s: unsupported seed file format", name)
+	}
+
+	if err := saveSeeds(store, ps); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	log.Printf("Seed file %s loaded (%d products)", name, len(ps))
+	return nil
+}
+
+// saveSeeds validates and saves seed products.
+// Products with ID are saved with their ID if the store implements productws.Putter,
+// else they are saved as new products.
+func saveSeeds(store productws.Store, ps []*productws.Product) error {
+	putter, _ := store.(productws.Putter)
+	now := time.Now()
+
+	for i, p := range ps {
+		if msg := p.Validate(); msg != "" {
+			return fmt.Errorf("product #%d: %s", i+1, msg)
+		}
+		p.CreatedAt, p.UpdatedAt, p.UpdatedBy = now, now, seedCaller
+
+		var err error
+		if p.ID != 0 && putter != nil {
+			err = putter.Put(p)
+		} else {
+			p.ID = 0
+			err = store.Save(p)
+		}
+		if err != nil {
+			return fmt.Errorf("product #%d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Word lists used to generate synthetic products
+var (
+	genAdjectives = []string{"Compact", "Deluxe", "Eco", "Ergonomic", "Heavy-duty", "Mini", "Portable", "Pro", "Smart", "Wireless"}
+	genNouns      = []string{"Blender", "Camera", "Chair", "Headphones", "Keyboard", "Lamp", "Monitor", "Mouse", "Speaker", "Toaster"}
+	genTags       = []string{"Audio", "Computer", "Garden", "Home", "Kitchen", "New", "Office", "Outdoor", "Sale", "Toys"}
+)
+
+// Currencies of generated prices, and their approximate value of 1 USD
+var genCurrencies = map[string]float64{"EUR": 0.92, "GBP": 0.79, "HUF": 355, "JPY": 150, "CHF": 0.88}
+
+// generateProducts generates n synthetic products with random names, tags and
+// multi-currency prices, and saves them to the store.
+// The same seed generates the same products.
+func generateProducts(store productws.Store, n int, seed int64) error {
+	r := rand.New(rand.NewSource(seed))
+
+	currs := make([]string, 0, len(genCurrencies))
+	for curr := range genCurrencies {
+		currs = append(currs, curr)
+	}
+	sort.Strings(currs) // Deterministic order
+
+	now := time.Now()
+	for i := 1; i <= n; i++ {
+		p := &productws.Product{
+			Name: fmt.Sprintf("%s %s %d", genAdjectives[r.Intn(len(genAdjectives))], genNouns[r.Intn(len(genNouns))], i),
+			Desc: fmt.Sprintf("Synthetic product #%d", i),
+		}
+		for _, j := range r.Perm(len(genTags))[:r.Intn(4)] {
+			p.Tags = append(p.Tags, genTags[j])
+		}
+
+		usdCents := 100 + r.Int63n(100000) // 1.00 - 1000.99 USD
+		p.Prices = map[string]productws.Price{productws.DefaultCurrency: {Value: usdCents, Multiplier: 100}}
+		for _, curr := range currs {
+			if r.Intn(2) == 0 {
+				p.Prices[curr] = productws.Price{Value: int64(float64(usdCents) * genCurrencies[curr]), Multiplier: 100}
+			}
+		}
+
+		p.CreatedAt, p.UpdatedAt, p.UpdatedBy = now, now, seedCaller
+		if err := store.Save(p); err != nil {
+			return fmt.Errorf("product #%d: %v", i, err)
+		}
+	}
+
+	log.Printf("%d synthetic products generated", n)
+	return nil
+}
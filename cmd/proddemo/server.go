@@ -0,0 +1,93 @@
+/*
+
+HTTP server with timeouts and graceful shutdown.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/icza/productws"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Timeouts and limits of the HTTP server
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = time.Minute // Large enough for CSV imports and snapshot restores
+	writeTimeout      = time.Minute // Large enough for CSV exports and snapshot dumps
+	idleTimeout       = 2 * time.Minute
+	maxHeaderBytes    = 64 << 10
+)
+
+// serve starts the HTTP server on addr, and serves until SIGINT or SIGTERM is received.
+// If tlsConf is not nil, HTTPS is served.
+// On shutdown the server stops accepting connections and waits for in-flight requests
+// to complete (at most for drainTimeout), then stops webhook deliveries and closes the closers
+// (e.g. the store, to flush its data).
+func serve(addr string, tlsConf *tls.Config, drainTimeout time.Duration, closers []io.Closer) {
+	// Base context of requests, cancelled on shutdown so long-lived streams (change feed) end
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	srv := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		TLSConfig:         tlsConf,
+	}
+	srv.RegisterOnShutdown(cancelBase)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	errCh := make(chan error, 1)
+	go func() {
+		if tlsConf != nil {
+			log.Printf("Starting HTTPS server on %q...", addr)
+			errCh <- srv.ListenAndServeTLS("", "") // Certificate is provided by tlsConf
+			return
+		}
+		log.Printf("Starting server on %q...", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		log.Fatalf("Server failed: %v", err)
+	case sig := <-sigCh:
+		log.Printf("Received %v, shutting down (draining requests for at most %v)...", sig, drainTimeout)
+	}
+	signal.Stop(sigCh) // A second signal kills the process
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain requests: %v", err)
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Server error: %v", err)
+	}
+
+	productws.StopWebhooks()
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			log.Printf("Failed to close %T: %v", c, err)
+		}
+	}
+	log.Printf("Server stopped")
+}
@@ -0,0 +1,452 @@
+/*
+
+CSV import and export of the catalog.
+
+*/
+
+package productws
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTagSeparator is the default separator of tags in CSV.
+const DefaultTagSeparator = "|"
+
+// Names of the fixed CSV columns. All other columns are price points,
+// named by their currency (e.g. "USD").
+const (
+	csvColID   = "ID"
+	csvColName = "Name"
+	csvColDesc = "Desc"
+	csvColTags = "Tags"
+)
+
+// CSVOptions holds options of CSV import and export.
+type CSVOptions struct {
+	// Separator of tags within the Tags column, default: DefaultTagSeparator
+	TagSeparator string
+
+	// Tells to only validate the rows without saving anything (import only)
+	DryRun bool
+
+	// Tells to update products whose ID is specified, and create the product if no product
+	// exists with the ID (import only; created products get a new ID).
+	// If false, the ID column must be empty and all rows are created.
+	UpdateByID bool
+
+	// Tells to ignore the ID column and create all rows (import only)
+	IgnoreIDs bool
+
+	// Identity of the caller, recorded as UpdatedBy (import only)
+	Caller string
+}
+
+// tagSep returns the tag separator to use.
+func (o *CSVOptions) tagSep() string {
+	if o == nil || o.TagSeparator == "" {
+		return DefaultTagSeparator
+	}
+	return o.TagSeparator
+}
+
+// RowError is an error of a CSV row.
+type RowError struct {
+	Row   int    // Row number, 1-based, the header being row 1
+	Error string // Error message
+}
+
+// ImportResult is the result of a CSV import.
+type ImportResult struct {
+	DryRun  bool       // Tells if it was a dry-run (nothing saved)
+	Created []ID       // IDs of the created products
+	Updated []ID       // IDs of the updated products
+	Errors  []RowError `json:",omitempty"` // Row-level errors
+
+	// Numbers of the saved rows, in order. If saving failed partway (see ImportCSV()),
+	// these rows were saved, while the rest were not.
+	SavedRows []int
+}
+
+// ExportCSV writes all products of the store to w in CSV format, in ID order.
+//
+// The first row is the header: ID, Name, Desc, Tags, followed by one column for each
+// currency present in any of the products (DefaultCurrency first, the rest sorted).
+// Tags are joined by the tag separator. Prices are written as decimal strings (e.g. "19.99")
+// if their Multiplier is a power of 10, else exactly as "Value/Multiplier" (e.g. "1/3").
+// Text cells starting with a character spreadsheets treat as a formula (= + - @, tab, CR) are
+// prefixed with a single quote (as are such cells already starting with single quotes), so opening
+// the export in a spreadsheet doesn't evaluate them. ImportCSV removes the prefix.
+// opts is optional.
+func ExportCSV(st Store, w io.Writer, opts *CSVOptions) error {
+	ids, err := st.AllIDs()
+	if err != nil {
+		return err
+	}
+	sortIDs(ids)
+
+	ps := make([]*Product, 0, len(ids))
+	currSet := map[string]bool{}
+	for _, id := range ids {
+		p, err := st.Load(id)
+		if err != nil {
+			if err == ErrInvalidId {
+				continue // Product removed in the mean time
+			}
+			return err
+		}
+		ps = append(ps, p)
+		for curr := range p.Prices {
+			currSet[curr] = true
+		}
+	}
+
+	currs := make([]string, 0, len(currSet))
+	for curr := range currSet {
+		if curr != DefaultCurrency {
+			currs = append(currs, curr)
+		}
+	}
+	sort.Strings(currs)
+	currs = append([]string{DefaultCurrency}, currs...)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{csvColID, csvColName, csvColDesc, csvColTags}, currs...)); err != nil {
+		return err
+	}
+
+	tagSep := opts.tagSep()
+	for _, p := range ps {
+		rec := []string{strconv.FormatInt(int64(p.ID), 10), escapeCSVCell(p.Name), escapeCSVCell(p.Desc),
+			escapeCSVCell(strings.Join(p.Tags, tagSep))}
+		for _, curr := range currs {
+			if price, ok := p.Prices[curr]; ok {
+				rec = append(rec, formatCSVPrice(price))
+			} else {
+				rec = append(rec, "")
+			}
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ImportCSV imports products from CSV (in the format written by ExportCSV) into the store.
+//
+// Column names of the header must be unique. Currency columns are used as written
+// (e.g. "usd" is not the same currency as "USD"). Prices may be decimal strings or
+// "Value/Multiplier" fractions. The single quote prefix of text cells escaped by ExportCSV
+// is removed.
+//
+// Every row is validated first (including Product.Validate()); if any row is invalid,
+// nothing is saved and the row-level errors are reported in the result. If opts.UpdateByID
+// is true, rows with an ID update the existing product (or create a new product if it doesn't
+// exist), else the ID column must be empty. An ID must not be specified in multiple rows.
+// Nothing is saved in dry-run mode.
+// opts is optional.
+//
+// The returned error is only non-nil if the CSV or its header can't be read. Saving stops at the
+// first store error, which is reported as a row-level error; rows saved before that are listed
+// in the SavedRows of the result.
+func ImportCSV(st Store, r io.Reader, opts *CSVOptions) (*ImportResult, error) {
+	return importCSV(st, r, opts, logger, func(p *Product, created bool) error { return st.Save(p) })
+}
+
+// importCSV implements ImportCSV, saving products with the specified save function,
+// logging errors to lg.
+func importCSV(st Store, r io.Reader, opts *CSVOptions, lg *slog.Logger, save func(p *Product, created bool) error) (*ImportResult, error) {
+	if opts == nil {
+		opts = &CSVOptions{}
+	}
+	res := &ImportResult{DryRun: opts.DryRun, Created: []ID{}, Updated: []ID{}, SavedRows: []int{}}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // Checked by us to report row errors
+	recs, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, errors.New("missing CSV header")
+	}
+
+	// Process header
+	header := recs[0]
+	cols := map[string]int{}
+	currCols := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		m, key := currCols, name
+		switch strings.ToLower(name) {
+		case "id", "name", "desc", "tags":
+			m, key = cols, strings.ToLower(name)
+		case "":
+			return nil, fmt.Errorf("empty name of column %d", i+1)
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("duplicate %s column", name)
+		}
+		m[key] = i
+	}
+	if _, ok := cols["name"]; !ok {
+		return nil, errors.New("missing " + csvColName + " column")
+	}
+
+	// Parse and validate all rows
+	type row struct {
+		num int
+		p   *Product
+		old *Product // Existing product (in case of update)
+	}
+	rows := make([]row, 0, len(recs)-1)
+	idRows := map[ID]int{} // Row numbers of IDs
+	tagSep := opts.tagSep()
+	for i, rec := range recs[1:] {
+		num := i + 2
+		rowErr := func(msg string) {
+			res.Errors = append(res.Errors, RowError{Row: num, Error: msg})
+		}
+		if len(rec) != len(header) {
+			rowErr(fmt.Sprintf("Expected %d fields, got %d!", len(header), len(rec)))
+			continue
+		}
+
+		field := func(col string) string {
+			if i, ok := cols[col]; ok {
+				return unescapeCSVCell(strings.TrimSpace(rec[i]))
+			}
+			return ""
+		}
+
+		p := &Product{Name: field("name"), Desc: field("desc"), Prices: map[string]Price{}}
+		if tags := field("tags"); tags != "" {
+			for _, tag := range strings.Split(tags, tagSep) {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					p.Tags = append(p.Tags, tag)
+				}
+			}
+		}
+
+		valid := true
+		for curr, i := range currCols {
+			v := strings.TrimSpace(rec[i])
+			if v == "" {
+				continue
+			}
+			price, err := parseCSVPrice(v)
+			if err != nil {
+				rowErr(fmt.Sprintf("Invalid %s price: %q", curr, v))
+				valid = false
+				continue
+			}
+			p.Prices[curr] = price
+		}
+		if !valid {
+			continue
+		}
+
+		var old *Product
+		if v := field("id"); v != "" && !opts.IgnoreIDs {
+			if !opts.UpdateByID {
+				rowErr("ID must not be specified!")
+				continue
+			}
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id <= 0 {
+				rowErr(fmt.Sprintf("Invalid ID: %q", v))
+				continue
+			}
+			if prev, ok := idRows[ID(id)]; ok {
+				rowErr(fmt.Sprintf("Duplicate ID %d, also in row %d!", id, prev))
+				continue
+			}
+			idRows[ID(id)] = num
+			if old, err = st.Load(ID(id)); err != nil {
+				if err != ErrInvalidId {
+					lg.Error("Error loading product", "id", id, "err", err)
+					rowErr(MsgGeneralStoreErr)
+					continue
+				}
+				old = nil // No such product, create it
+			} else {
+				p.ID = ID(id)
+			}
+		}
+
+		if msg := p.Validate(); msg != "" {
+			rowErr(msg)
+			continue
+		}
+
+		rows = append(rows, row{num: num, p: p, old: old})
+	}
+
+	if len(res.Errors) > 0 || opts.DryRun {
+		return res, nil
+	}
+
+	// All rows are valid, save them
+	for _, rw := range rows {
+		p, now := rw.p, time.Now()
+		if rw.old != nil {
+			p.CreatedAt = rw.old.CreatedAt
+		} else {
+			p.CreatedAt = now
+		}
+		p.UpdatedAt, p.UpdatedBy = now, opts.Caller
+
+		if err := save(p, rw.old == nil); err != nil {
+			lg.Error("Error saving product, import aborted", "row", rw.num, "id", p.ID, "savedRows", len(res.SavedRows), "err", err)
+			msg := MsgGeneralStoreErr
+			if err == ErrInvalidId {
+				msg = MsgInvalidIDErr
+			}
+			res.Errors = append(res.Errors, RowError{Row: rw.num, Error: msg})
+			break
+		}
+		res.SavedRows = append(res.SavedRows, rw.num)
+		if rw.old == nil {
+			res.Created = append(res.Created, p.ID)
+		} else {
+			res.Updated = append(res.Updated, p.ID)
+		}
+	}
+
+	return res, nil
+}
+
+// formatCSVPrice formats a price for CSV export: decimal string if its Multiplier is a power of 10,
+// else "Value/Multiplier", so the price is represented exactly.
+func formatCSVPrice(p Price) string {
+	m := p.Multiplier
+	for m > 1 && m%10 == 0 {
+		m /= 10
+	}
+	if m == 1 {
+		return p.String()
+	}
+	return strconv.FormatInt(p.Value, 10) + "/" + strconv.FormatInt(p.Multiplier, 10)
+}
+
+// parseCSVPrice parses a price written by formatCSVPrice.
+func parseCSVPrice(s string) (Price, error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return ParsePrice(s)
+	}
+
+	if strings.ContainsAny(s, "+-") {
+		return Price{}, errors.New("invalid price: " + strconv.Quote(s))
+	}
+	value, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return Price{}, errors.New("invalid price: " + strconv.Quote(s))
+	}
+	mult, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil || mult < 1 {
+		return Price{}, errors.New("invalid price: " + strconv.Quote(s))
+	}
+	return Price{Value: value, Multiplier: mult}, nil
+}
+
+// formulaCell tells if a spreadsheet would treat a cell as a formula (ignoring leading single quotes).
+func formulaCell(s string) bool {
+	s = strings.TrimLeft(s, "'")
+	return s != "" && strings.IndexByte("=+-@\t\r", s[0]) >= 0
+}
+
+// escapeCSVCell prefixes a text cell with a single quote if it would be treated as a formula
+// (CSV injection).
+func escapeCSVCell(s string) string {
+	if formulaCell(s) {
+		return "'" + s
+	}
+	return s
+}
+
+// unescapeCSVCell removes the prefix added by escapeCSVCell.
+func unescapeCSVCell(s string) string {
+	if formulaCell(s) && strings.HasPrefix(s, "'") {
+		return s[1:]
+	}
+	return s
+}
+
+// exportCSVLogic implements exporting the catalog in CSV format.
+// The tagSep URL query parameter may specify the tag separator.
+// The CSV is sent as the response, not a JSONResp (unless there is an error).
+func exportCSVLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	// Export into memory first, so errors can still be reported in a JSONResp
+	buf := &strings.Builder{}
+	if err := ExportCSV(storeOf(r), buf, &CSVOptions{TagSeparator: r.URL.Query().Get("tagSep")}); err != nil {
+		logOf(r).Error("Error exporting CSV", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="catalog.csv"`)
+	if _, err := io.WriteString(w, buf.String()); err != nil {
+		logOf(r).Warn("Failed to send CSV response", "err", err)
+	}
+	return nil
+}
+
+// importLogic implements importing products in CSV format.
+// Expects the request body to be the CSV. URL query parameters:
+//     dryRun      if "true", rows are only validated, nothing is saved
+//     updateByID  if "true", rows with ID update existing products (products not found are created)
+//     tagSep      tag separator
+func importLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	q := r.URL.Query()
+	ci := callInfoOf(r)
+	opts := &CSVOptions{
+		TagSeparator: q.Get("tagSep"),
+		DryRun:       q.Get("dryRun") == "true",
+		UpdateByID:   q.Get("updateByID") == "true",
+		Caller:       ci.caller,
+	}
+
+	st := storeOf(r)
+	res, err := importCSV(st, r.Body, opts, ci.log, func(p *Product, created bool) error {
+		var before *Product
+		evType := EventCreated
+		if !created {
+			evType = EventUpdated
+			// Load the current version for auditing (it was loaded during validation too,
+			// but may have changed since)
+			var err error
+			if before, err = st.Load(p.ID); err != nil {
+				return err
+			}
+		}
+		if err := saveProduct(st, before, p, evType); err != nil {
+			return err
+		}
+		ci.changes = append(ci.changes, productChange{before: before, after: p.Clone()})
+		return nil
+	})
+	if err != nil {
+		return &JSONResp{Error: "Invalid CSV: " + err.Error()}
+	}
+
+	if len(res.Errors) > 0 {
+		if len(res.SavedRows) > 0 {
+			return &JSONResp{Error: fmt.Sprintf("Import failed after saving %d rows, see saved rows and row errors!", len(res.SavedRows)), Data: res}
+		}
+		return &JSONResp{Error: "Import failed, see row errors!", Data: res}
+	}
+	return &JSONResp{Success: true, Data: res}
+}
@@ -0,0 +1,177 @@
+package productws_test
+
+import (
+	"errors"
+	"github.com/icza/productws"
+	"github.com/icza/productws/inmemstore"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// failingStore is a Store whose saves fail after a number of successful saves.
+type failingStore struct {
+	productws.Store
+	saves int // Number of saves to allow
+}
+
+func (s *failingStore) Save(p *productws.Product) error {
+	if s.saves == 0 {
+		return errors.New("store unavailable")
+	}
+	s.saves--
+	return s.Store.Save(p)
+}
+
+func TestImportCSVHeader(t *testing.T) {
+	cases := []struct {
+		csv    string
+		expErr string
+	}{
+		{"Name,Desc,USD\nn,d,1\n", ""},
+		{"Name,Desc,USD,name\nn,d,1,n\n", "duplicate name column"},
+		{"Name,Desc,USD,USD\nn,d,1,2\n", "duplicate USD column"},
+		{"Name,Desc,USD,\nn,d,1,2\n", "empty name of column 4"},
+		{"Desc,USD\nd,1\n", "missing Name column"},
+	}
+
+	for _, c := range cases {
+		_, err := productws.ImportCSV(inmemstore.NewInmemStore(), strings.NewReader(c.csv), nil)
+		if c.expErr == "" && err != nil || c.expErr != "" && (err == nil || err.Error() != c.expErr) {
+			t.Errorf("[csv: %q] Expected error: %q, got: %v", c.csv, c.expErr, err)
+		}
+	}
+}
+
+func TestImportCSVCurrencyAsWritten(t *testing.T) {
+	st := inmemstore.NewInmemStore()
+	res, err := productws.ImportCSV(st, strings.NewReader("Name,Desc,USD,gbp\nn,d,1.5,2\n"), nil)
+	if err != nil || len(res.Errors) > 0 {
+		t.Fatalf("Import failed: %v %+v", err, res)
+	}
+
+	p, err := st.Load(res.Created[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]productws.Price{"USD": {Value: 15, Multiplier: 10}, "gbp": {Value: 2, Multiplier: 1}}
+	if !reflect.DeepEqual(p.Prices, exp) {
+		t.Errorf("Expected prices %v, got: %v", exp, p.Prices)
+	}
+}
+
+func TestImportCSVUpdateByID(t *testing.T) {
+	st := inmemstore.NewInmemStore()
+	existing := &productws.Product{Name: "old", Desc: "d", Prices: map[string]productws.Price{"USD": {Value: 1, Multiplier: 1}}}
+	if err := st.Save(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	csv := "ID,Name,Desc,USD\n1,updated,d,2\n42,new,d,3\n,new2,d,4\n"
+	res, err := productws.ImportCSV(st, strings.NewReader(csv), &productws.CSVOptions{UpdateByID: true})
+	if err != nil || len(res.Errors) > 0 {
+		t.Fatalf("Import failed: %v %+v", err, res)
+	}
+	if !reflect.DeepEqual(res.Updated, []productws.ID{1}) || len(res.Created) != 2 {
+		t.Errorf("Expected 1 updated and 2 created, got: %+v", res)
+	}
+	if !reflect.DeepEqual(res.SavedRows, []int{2, 3, 4}) {
+		t.Errorf("Expected saved rows [2 3 4], got: %v", res.SavedRows)
+	}
+	for _, id := range res.Created {
+		if id == 1 {
+			t.Errorf("Created product got the ID of an existing product")
+		}
+	}
+	if p, _ := st.Load(1); p.Name != "updated" {
+		t.Errorf("Expected product 1 to be updated, got: %+v", p)
+	}
+}
+
+func TestImportCSVStoreError(t *testing.T) {
+	st := &failingStore{Store: inmemstore.NewInmemStore(), saves: 2}
+
+	csv := "Name,Desc,USD\na,d,1\nb,d,2\nc,d,3\nd,d,4\n"
+	res, err := productws.ImportCSV(st, strings.NewReader(csv), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.SavedRows, []int{2, 3}) || len(res.Created) != 2 {
+		t.Errorf("Expected rows 2 and 3 to be saved, got: %+v", res)
+	}
+	if len(res.Errors) != 1 || res.Errors[0].Row != 4 || res.Errors[0].Error != productws.MsgGeneralStoreErr {
+		t.Errorf("Expected a store error in row 4, got: %+v", res.Errors)
+	}
+}
+
+func TestImportCSVDuplicateID(t *testing.T) {
+	st := inmemstore.NewInmemStore()
+	existing := &productws.Product{Name: "old", Desc: "d", Prices: map[string]productws.Price{"USD": {Value: 1, Multiplier: 1}}}
+	if err := st.Save(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	csv := "ID,Name,Desc,USD\n1,a,d,2\n42,b,d,3\n1,c,d,4\n42,d,d,5\n"
+	res, err := productws.ImportCSV(st, strings.NewReader(csv), &productws.CSVOptions{UpdateByID: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []productws.RowError{{Row: 4, Error: "Duplicate ID 1, also in row 2!"}, {Row: 5, Error: "Duplicate ID 42, also in row 3!"}}
+	if !reflect.DeepEqual(res.Errors, exp) || len(res.SavedRows) != 0 {
+		t.Errorf("Expected errors %+v and nothing saved, got: %+v", exp, res)
+	}
+	if p, _ := st.Load(1); p.Name != "old" {
+		t.Errorf("Expected product 1 not to be updated, got: %+v", p)
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	st := inmemstore.NewInmemStore()
+	ps := []*productws.Product{
+		{Name: "=HYPERLINK(\"http://evil\")", Desc: "+1", Tags: []string{"-sale", "x"},
+			Prices: map[string]productws.Price{"USD": {Value: 1, Multiplier: 3}, "EUR": {Value: 199, Multiplier: 100}}},
+		{Name: "'=already quoted", Desc: "@cmd", Tags: []string{"'", "'tag"},
+			Prices: map[string]productws.Price{"USD": {Value: 3, Multiplier: 4}}},
+		{Name: "plain", Desc: "a-b", Prices: map[string]productws.Price{"USD": {Value: 5, Multiplier: 1}}},
+	}
+	for _, p := range ps {
+		if err := st.Save(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &strings.Builder{}
+	if err := productws.ExportCSV(st, buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	exp := "ID,Name,Desc,Tags,USD,EUR\n" +
+		"1,\"'=HYPERLINK(\"\"http://evil\"\")\",'+1,'-sale|x,1/3,1.99\n" +
+		"2,''=already quoted,'@cmd,'|'tag,3/4,\n" +
+		"3,plain,a-b,,5,\n"
+	if got := buf.String(); got != exp {
+		t.Errorf("Expected CSV:\n%s\ngot:\n%s", exp, got)
+	}
+
+	st2 := inmemstore.NewInmemStore()
+	res, err := productws.ImportCSV(st2, strings.NewReader(buf.String()), &productws.CSVOptions{IgnoreIDs: true})
+	if err != nil || len(res.Errors) > 0 {
+		t.Fatalf("Import failed: %v %+v", err, res)
+	}
+	for i, id := range res.Created {
+		p, err := st2.Load(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := ps[i]; p.Name != exp.Name || p.Desc != exp.Desc ||
+			!reflect.DeepEqual(p.Tags, exp.Tags) || !reflect.DeepEqual(p.Prices, exp.Prices) {
+			t.Errorf("Expected %+v, got: %+v", exp, p)
+		}
+	}
+
+	for _, v := range []string{"1/0", "-1/3", "1/-3", "1/+3", "a/3", "1/3/4"} {
+		res, err := productws.ImportCSV(st2, strings.NewReader("Name,Desc,USD\nn,d,"+v+"\n"), nil)
+		if err != nil || len(res.Errors) != 1 {
+			t.Errorf("[%s] Expected invalid price, got: %v, %+v", v, err, res)
+		}
+	}
+}
@@ -25,6 +25,10 @@ So the real price is the quotient: Value / Multiplier.
 Generally Multiplier should be a power of 10, a small value that gives integer Value
 after multiplication.
 
+Products carry audit metadata: CreatedAt, UpdatedAt and UpdatedBy. These are managed
+by the API calls (values sent by clients are ignored), and are persisted by the Store
+just like any other field.
+
 
 API calls
 
@@ -38,6 +42,8 @@ Update requires a valid ID (to be updated).
 
 The list API call lists all existing product IDs. It must be a GET request,
 and it does not require anything in the request path or body.
+Optionally the list can be filtered with the modifiedSince, createdSince (RFC 3339 times)
+and updatedBy URL query parameters, e.g. /list?modifiedSince=2017-01-02T15:04:05Z
 
 The details API call returns all the details of a product. It must be a GET request,
 and it expects the path to contain the ID of the product whose details to return.
@@ -50,5 +56,161 @@ already has prices in USD and GBP currencies, and the call specifies prices
 in GBP and HUF currencies, then the GBP price will be updated, HUF added
 and USD left intact. If currency removal is required, update call can (must) be used.
 
+The audit API call returns the audit log entries. It must be a GET request,
+and it accepts the id, op, caller, since, until (RFC 3339 times) and limit
+URL query parameters as filters.
+
+
+CSV import and export
+
+The export.csv API call (GET) exports the catalog in CSV format: one row per product,
+with ID, Name, Desc and Tags columns (tags joined by a separator, "|" by default),
+followed by one column per currency holding decimal prices (e.g. "19.99").
+
+The import API call (POST) imports products from a CSV in the same format. Every row
+is validated first, and if any row is invalid, nothing is saved and row-level errors
+are reported. The dryRun=true URL query parameter only validates the rows, the
+updateByID=true parameter updates the products whose ID is specified (else all rows
+are created). The tagSep parameter overrides the tag separator of both calls.
+
+The same functionality is available for any Store with ExportCSV() and ImportCSV().
+
+
+Snapshots
+
+Dump() writes a snapshot of all products of a Store: a SnapshotHeader line (with the
+schema version) followed by one JSON product per line. Restore() loads a snapshot into
+a Store preserving product IDs, which requires the Store to implement the optional Putter
+interface. All products of the snapshot are validated before the first one is saved.
+The admin/dump (GET) and admin/restore (POST) API calls expose these; restore publishes
+created and updated events of the restored products.
+
+
+WebSocket API
+
+The ws path serves a WebSocket API mirroring the create, list, details, update and setprices
+API calls over a single connection. Request messages are JSON objects naming the operation
+(Op), with a client supplied request ID (ReqID), and optionally the product ID (ID, for details),
+URL query (Query, for list filters) and the request body (Data). Requests are dispatched to
+the same call logic as the REST API calls, and responses are JSONResp messages extended with
+the ReqID of the request.
+
+Change notifications can be requested with the subscribe operation, and are sent as JSONResp
+messages with the "event" Op and an Event as Data. If a connection can't keep up with the events,
+it is resubscribed from its last event; if events were lost meanwhile, the client is told to resync.
+Messages are limited to 1 MiB, like the request bodies of API calls (except import and restore).
+
+Request messages are recorded in the metrics and the access log just like REST API calls.
+Only same-origin web pages may open WebSocket connections, other origins may be allowed
+with SetWebSocketOrigins().
+
+
+Authentication
+
+If an Authenticator is set with SetAuthenticator(), API calls (and the change feed and WebSocket
+connections) must be authenticated, else they are rejected with 401 Unauthorized and a
+WWW-Authenticate challenge. The authenticated principal identifies the caller.
+Package htpasswd contains an Authenticator validating HTTP Basic credentials.
+
+Token authentication can be enabled with EnableTokens(): the login API call exchanges credentials
+for a bearer token with limited lifetime, which the logout call revokes. Only hashes of tokens are
+stored in the TokenStore.
+
+If an Authorizer is set with SetAuthorizer(), calls not allowed for the caller are rejected with
+403 Forbidden before the call logic runs. Permissions may be restricted to products having certain tags.
+Receiving change events (the events path and WebSocket subscriptions) requires permission for the
+events operation; tag-restricted permissions only receive events of products having any of the tags.
+Package rbac contains a role-based Authorizer configured from a policy file.
+
+API keys of machine clients can be enabled with EnableAPIKeys(), and are managed with API calls.
+Only hashes of keys are stored in the APIKeyStore. Calls authenticated with an API key are authorized
+by the scopes of the key, and are subject to the rate limit of the key.
+
+
+Auditing
+
+Successful mutating calls (create, update, setprices, import and restore) are recorded to the AuditSink
+set by SetAuditSink(). The caller is identified by the authenticated principal, or by the common name of
+its client certificate if it presented a verified one (mutual TLS), else by its remote host.
+An AuditEntry contains the caller identity, timestamp, operation,
+product ID, the product before and after the call, and the list of changed fields.
+The AuditSink is append-only; package auditsink contains in-memory, file and Store-backed implementations.
+
+
+Change feed
+
+Whenever the API calls save a product through the Store, an Event is published on the
+in-process EventBus (see Events()). Events have increasing sequence numbers, and the bus
+keeps the last events in a bounded replay buffer.
+
+The events path serves the change feed as Server-Sent Events. The event ID is the sequence
+number, so clients may resume with the Last-Event-ID header after reconnecting.
+
+
+Webhooks
+
+If enabled with EnableWebhooks(), events are also delivered to webhook subscribers.
+Subscriptions are managed with the addwebhook (POST), webhooks (GET) and delwebhook (POST)
+API calls, and are persisted in a WebhookStore (package webhookstore contains implementations).
+A subscription may be restricted to certain event types. Webhook URLs must be http or https URLs,
+and deliveries to internal (loopback, private, link-local) addresses are denied unless allowed
+by WebhookOptions.AllowInternal, so callers can't make the server reach internal services.
+
+Events are POSTed as JSON payloads, signed with HMAC-SHA256 using the secret of the subscription
+(see SignWebhookPayload() and VerifyWebhookSignature()). Failed deliveries are retried with
+exponential backoff; if all attempts fail, the delivery is moved to the dead-letter list.
+Retries of deleted subscriptions are abandoned. If the dispatcher falls behind the events and
+the event bus no longer buffers the missed ones, the lost events are logged and recorded in
+the dead-letter list too (with an empty EventType).
+The deliveries API call (GET) returns the status of deliveries, it can be filtered with
+the webhook and status URL query parameters (e.g. status=dead returns the dead-letter list).
+
+
+Logging
+
+Logging is structured, done with the log/slog logger set by SetLogger(). Every API call
+has a request ID: the X-Request-ID request header is honored if present, else a new ID is
+generated. The request ID is sent back in the X-Request-ID response header, and all log
+records of the call carry it (along with the operation). An access log record is written
+for each served call, with the method, path, status, duration, response size and product ID.
+
+
+Tracing
+
+If a SpanExporter is set with SetSpanExporter(), a span is recorded for each API call,
+with child spans for each Store operation of the call. An incoming W3C traceparent header
+is honored, so the call span continues the trace of the caller (including its trace flags). The span of a call can be
+obtained from the request context with SpanFromContext(), and InjectTraceparent() propagates
+it to outgoing requests (the client package does this using the context of its calls).
+Package spanexport contains an in-memory exporter and an OTLP/JSON file exporter.
+
+
+Health checks
+
+The healthz path responds success as long as the process is up. The readyz path responds
+success if the Store is usable: if it implements the optional Pinger interface, it is pinged
+with a timeout, and 503 Service Unavailable is sent if the ping fails. The version path returns
+the build info (module version, VCS revision), uptime and the name of the Store implementation.
+These endpoints are not API calls: they are not subject to metrics, access logs and authentication.
+
+
+Metrics
+
+The metrics path serves metrics in Prometheus text exposition format: API request counters
+by operation, HTTP status and success, request latency histograms, in-flight request gauges,
+store operation latency histograms and error counters (if the store is wrapped with storemw.Prometheus()),
+counters of requests rejected by rate or concurrency limiting, and catalog gauges (number of products, and
+number of products per currency; these are recalculated at most every 15 seconds, reading the innermost store).
+
+
+Rate limiting
+
+If enabled with SetRateLimits(), calls of each client (identified by IP address or authenticated
+identity) are limited with token buckets, separately for read and other calls (and optionally for
+individual operations), and the number of calls served concurrently may be limited. Calls exceeding
+the limits are rejected with 429 Too Many Requests and a Retry-After header. Clients limited by
+identity are also limited by IP address before authentication, so failed authentication attempts
+are throttled too.
+
 */
 package productws
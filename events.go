@@ -0,0 +1,320 @@
+/*
+
+In-process event bus of product changes, and the Server-Sent Events change feed.
+
+*/
+
+package productws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventCreated       = "created"        // Product created
+	EventUpdated       = "updated"        // Product updated
+	EventPricesChanged = "prices-changed" // Price points of a product changed
+	EventDeleted       = "deleted"        // Product deleted
+)
+
+// Event describes a change of a product.
+type Event struct {
+	Seq  uint64    // Sequence number of the event, starting at 1
+	Type string    // Type of the event, one of the Event* constants
+	ID   ID        // ID of the changed product
+	Time time.Time // Time of the event
+
+	// State of the product after the change (nil for deleted events)
+	Product *Product `json:",omitempty"`
+
+	// Tags of the product before the change (nil if created), to scope events of subscribers
+	prevTags []string
+}
+
+// DefaultReplaySize is the default number of events kept for replay.
+const DefaultReplaySize = 1000
+
+// EventBus is an in-process event bus which delivers product change events to subscribers.
+// Keeps the last events in a bounded replay buffer, so subscribers may resume from a
+// sequence number.
+// Safe for concurrent use.
+type EventBus struct {
+	// Mutex to protect concurrent access to the bus
+	mux sync.Mutex
+
+	// Sequence number of the last published event
+	seq uint64
+
+	// Replay ring buffer, and the index of the next event to write
+	buf  []*Event
+	next int
+
+	// Subscriber channels
+	subs map[chan *Event]struct{}
+}
+
+// NewEventBus returns a new EventBus which keeps the last replaySize events for replay.
+func NewEventBus(replaySize int) *EventBus {
+	if replaySize < 1 {
+		replaySize = 1
+	}
+	return &EventBus{buf: make([]*Event, 0, replaySize), subs: map[chan *Event]struct{}{}}
+}
+
+// Publish publishes an event of the specified type about a product.
+// The product is cloned, so it may be modified after Publish returns.
+// For deleted events p is the deleted product.
+func (b *EventBus) Publish(typ string, p *Product) *Event {
+	return b.publish(typ, nil, p)
+}
+
+// publish publishes an event of the specified type about a product,
+// before is the product before the change (nil if unknown or created).
+func (b *EventBus) publish(typ string, before, p *Product) *Event {
+	e := &Event{Type: typ, ID: p.ID, Time: time.Now()}
+	if typ != EventDeleted {
+		e.Product = p.Clone()
+	} else {
+		before = p
+	}
+	if before != nil {
+		e.prevTags = append([]string(nil), before.Tags...)
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+
+	if len(b.buf) < cap(b.buf) {
+		b.buf = append(b.buf, e)
+	} else {
+		b.buf[b.next] = e
+	}
+	b.next = (b.next + 1) % cap(b.buf)
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// Subscriber is too slow: drop it, it may resume from its last sequence number.
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+
+	return e
+}
+
+// Seq returns the sequence number of the last published event (0 if none).
+func (b *EventBus) Seq() uint64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.seq
+}
+
+// Subscribe subscribes to the events published after the event with sequence number since.
+//
+// Buffered events newer than since are returned in replay, and later events are delivered
+// on the returned channel. missed reports if there were events after since which are no longer
+// in the replay buffer, or if since is ahead of the bus (e.g. the subscriber resumes with a
+// sequence number of a previous run, so it can't know which events it missed).
+// The channel is closed if the subscriber can't keep up with the events or when cancel
+// is called. cancel must be called when the subscriber is done.
+func (b *EventBus) Subscribe(since uint64) (ch <-chan *Event, replay []*Event, missed bool, cancel func()) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	missed = since > b.seq
+
+	// Collect buffered events in order (oldest first):
+	if len(b.buf) > 0 {
+		oldest := b.buf[b.next%len(b.buf)]
+		missed = missed || since+1 < oldest.Seq
+		for i := range b.buf {
+			if e := b.buf[(b.next+i)%len(b.buf)]; e.Seq > since {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	c := make(chan *Event, cap(b.buf))
+	b.subs[c] = struct{}{}
+
+	cancel = func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if _, ok := b.subs[c]; ok {
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+
+	return c, replay, missed, cancel
+}
+
+// Event bus to publish product changes on
+var eventBus = NewEventBus(DefaultReplaySize)
+
+// SetEventBus sets the EventBus used to publish product changes.
+// A bus with DefaultReplaySize is used by default.
+// Must be done prior to starting the web service.
+func SetEventBus(b *EventBus) {
+	eventBus = b
+}
+
+// Events returns the EventBus on which product changes are published.
+func Events() *EventBus {
+	return eventBus
+}
+
+// Interval of heartbeat comments sent on idle event streams
+const heartbeatInterval = 30 * time.Second
+
+// authorizeEvents authenticates the caller of r, and authorizes it to receive change events
+// (the events operation, also required by the subscribe operation of the WebSocket API).
+// Returns the callInfo of the subscriber, recording the tags its permission is restricted to.
+// If the caller is not authenticated, a 401 Unauthorized response is sent and nil is returned.
+// If the caller is not allowed, the 403 Forbidden status is set, and nil is returned along with
+// the JSON response to send.
+func authorizeEvents(w http.ResponseWriter, r *http.Request) (*callInfo, *JSONResp) {
+	ci := &callInfo{caller: callerOf(r), reqID: requestIDOf(r)}
+	ci.log = logger.With("requestID", ci.reqID, "op", opEvents)
+
+	// The API key authenticator records the key in the callInfo of the request
+	principal, ok := authenticate(w, withCallInfo(r, ci))
+	if !ok {
+		return nil, nil
+	}
+	if principal != "" {
+		ci.caller = principal
+	}
+
+	allowed, tags := permission(ci, opEvents)
+	if !allowed {
+		ci.log.Warn("Permission denied", "caller", ci.caller)
+		jsonResp := forbidden(w)
+		jsonResp.Op = opEvents
+		return nil, jsonResp
+	}
+	ci.tags = tags
+	return ci, nil
+}
+
+// eventsHandler serves the Server-Sent Events change feed.
+//
+// Each event is sent with its sequence number as the event ID, its type as the event name,
+// and the JSON Event as data. Clients may resume with the standard Last-Event-ID header
+// (or the since URL query parameter). If events to resume from are no longer available,
+// a "missed" event is sent first, telling the client that a full resync is needed.
+// The types URL query parameter may list (comma separated) the event types to send.
+// Callers need permission for the events operation; if it is restricted to tags, only events
+// of products having any of the tags are sent, see scopeEvent().
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use "+http.MethodGet, http.StatusMethodNotAllowed)
+		return
+	}
+
+	ci, jsonResp := authorizeEvents(w, r)
+	if ci == nil {
+		if jsonResp != nil {
+			json.NewEncoder(w).Encode(jsonResp)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("since")
+	}
+	var since uint64
+	if lastID != "" {
+		var err error
+		if since, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var types map[string]bool
+	if v := r.URL.Query().Get("types"); v != "" {
+		types = map[string]bool{}
+		for _, t := range strings.Split(v, ",") {
+			types[t] = true
+		}
+	}
+
+	// The stream is long-lived, it must not be cut by the write timeout of the server
+	// (error is ignored: if not supported, there is no deadline to clear)
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	events, replay, missed, cancel := eventBus.Subscribe(since)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	if lastID != "" && missed {
+		fmt.Fprint(w, "event: missed\ndata: {}\n\n")
+	}
+
+	send := func(e *Event) bool {
+		if e = ci.scopeEvent(e); e == nil || types != nil && !types[e.Type] {
+			return true
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			logger.Error("Failed to encode event", "seq", e.Seq, "err", err)
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+		return err == nil
+	}
+
+	for _, e := range replay {
+		if !send(e) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return // Dropped (too slow) or bus closed, client may resume
+			}
+			if !send(e) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
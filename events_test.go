@@ -0,0 +1,213 @@
+package productws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubscribeMissed(t *testing.T) {
+	b := NewEventBus(3)
+	for i := 0; i < 5; i++ {
+		b.Publish(EventCreated, &Product{ID: ID(i + 1)})
+	}
+
+	cases := []struct {
+		since     uint64
+		expMissed bool
+		expReplay int
+	}{
+		{0, true, 3},  // Events 1 and 2 are no longer buffered
+		{1, true, 3},  // Event 2 is no longer buffered
+		{2, false, 3}, // Replay from 3
+		{4, false, 1},
+		{5, false, 0},
+		{6, true, 0}, // Ahead of the bus
+		{100, true, 0},
+	}
+
+	for _, c := range cases {
+		_, replay, missed, cancel := b.Subscribe(c.since)
+		cancel()
+		if missed != c.expMissed || len(replay) != c.expReplay {
+			t.Errorf("[since: %d] Expected missed: %v, replay: %d, got: %v, %d",
+				c.since, c.expMissed, c.expReplay, missed, len(replay))
+		}
+	}
+
+	// Nothing is missed on a new bus, unless since is ahead of it
+	b = NewEventBus(3)
+	for since, exp := range map[uint64]bool{0: false, 1: true} {
+		_, _, missed, cancel := b.Subscribe(since)
+		cancel()
+		if missed != exp {
+			t.Errorf("[new bus, since: %d] Expected missed: %v, got: %v", since, exp, missed)
+		}
+	}
+}
+
+// userAuth is an Authenticator taking the principal from the X-User header.
+type userAuth struct{}
+
+func (userAuth) Authenticate(r *http.Request) (string, error) {
+	if user := r.Header.Get("X-User"); user != "" {
+		return user, nil
+	}
+	return "", ErrNoCredentials
+}
+
+func (userAuth) Challenge() string { return "User" }
+
+// mapAuthorizer is an Authorizer granting operations to users, optionally restricted to tags.
+type mapAuthorizer map[string]struct {
+	ops  []string
+	tags []string
+}
+
+func (a mapAuthorizer) Authorize(caller, op string) (bool, []string) {
+	for _, o := range a[caller].ops {
+		if o == op || o == "*" {
+			return true, a[caller].tags
+		}
+	}
+	return false, nil
+}
+
+func TestScopeEvent(t *testing.T) {
+	b := NewEventBus(10)
+	books := &Product{ID: 1, Tags: []string{"books"}}
+	toys := &Product{ID: 1, Tags: []string{"toys"}}
+
+	cases := []struct {
+		name       string
+		e          *Event
+		tags       []string
+		expSent    bool
+		expProduct bool
+	}{
+		{"unrestricted", b.publish(EventUpdated, books, toys), nil, true, true},
+		{"created in scope", b.publish(EventCreated, nil, books), []string{"books"}, true, true},
+		{"created out of scope", b.publish(EventCreated, nil, toys), []string{"books"}, false, false},
+		{"updated in scope", b.publish(EventUpdated, books, books), []string{"books"}, true, true},
+		{"moved into scope", b.publish(EventUpdated, toys, books), []string{"books"}, true, true},
+		{"moved out of scope", b.publish(EventUpdated, books, toys), []string{"books"}, true, false},
+		{"updated out of scope", b.publish(EventUpdated, toys, toys), []string{"books"}, false, false},
+		{"deleted in scope", b.Publish(EventDeleted, books), []string{"books"}, true, false},
+		{"deleted out of scope", b.Publish(EventDeleted, toys), []string{"books"}, false, false},
+	}
+
+	for _, c := range cases {
+		ci := &callInfo{tags: c.tags}
+		e := ci.scopeEvent(c.e)
+		if sent := e != nil; sent != c.expSent {
+			t.Errorf("[%s] Expected sent: %v, got: %v", c.name, c.expSent, sent)
+			continue
+		}
+		if e != nil && (e.Product != nil) != c.expProduct {
+			t.Errorf("[%s] Expected product: %v, got: %v", c.name, c.expProduct, e.Product)
+		}
+	}
+}
+
+func TestEventsHandlerAuthz(t *testing.T) {
+	defer func(a Authenticator, z Authorizer, b *EventBus) {
+		authenticator, authorizer, eventBus = a, z, b
+	}(authenticator, authorizer, eventBus)
+
+	authenticator = userAuth{}
+	authorizer = mapAuthorizer{
+		"admin":  {ops: []string{opEvents}},
+		"books":  {ops: []string{opEvents}, tags: []string{"books"}},
+		"reader": {ops: []string{opList, opDetails}},
+	}
+	eventBus = NewEventBus(10)
+	eventBus.Publish(EventCreated, &Product{ID: 1, Tags: []string{"books"}})
+	eventBus.Publish(EventCreated, &Product{ID: 2, Tags: []string{"toys"}})
+
+	cases := []struct {
+		user      string
+		expStatus int
+		expIDs    []string
+	}{
+		{"", http.StatusUnauthorized, nil},
+		{"reader", http.StatusForbidden, nil},
+		{"admin", http.StatusOK, []string{"1", "2"}},
+		{"books", http.StatusOK, []string{"1"}},
+	}
+
+	for _, c := range cases {
+		// Canceled context: the handler returns after sending the replayed events
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := httptest.NewRequest("GET", "/events?since=0", nil).WithContext(ctx)
+		if c.user != "" {
+			r.Header.Set("X-User", c.user)
+		}
+		w := httptest.NewRecorder()
+		eventsHandler(w, r)
+
+		if w.Code != c.expStatus {
+			t.Errorf("[%s] Expected status: %d, got: %d", c.user, c.expStatus, w.Code)
+			continue
+		}
+		var ids []string
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(line, "id: ") {
+				ids = append(ids, strings.TrimPrefix(line, "id: "))
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(c.expIDs, ",") {
+			t.Errorf("[%s] Expected event IDs: %v, got: %v", c.user, c.expIDs, ids)
+		}
+	}
+}
+
+func TestEventsAPIKeyScope(t *testing.T) {
+	defer func(a *apiKeyAuth, b *EventBus) { apiKeys, eventBus = a, b }(apiKeys, eventBus)
+
+	ks := newTestKeyStore()
+	EnableAPIKeys(ks)
+	eventBus = NewEventBus(10)
+	eventBus.Publish(EventCreated, &Product{ID: 1, Tags: []string{"books"}})
+	eventBus.Publish(EventCreated, &Product{ID: 2, Tags: []string{"toys"}})
+	eventBus.Publish(EventCreated, &Product{ID: 3, Tags: []string{"books", "toys"}})
+
+	cases := []struct {
+		name      string
+		key       string
+		expStatus int
+		expIDs    string
+	}{
+		{"all", ks.addTestKey([]string{"*"}, nil), http.StatusOK, "1,2,3"},
+		{"events", ks.addTestKey([]string{opEvents}, nil), http.StatusOK, "1,2,3"},
+		{"books", ks.addTestKey([]string{opEvents}, []string{"books"}), http.StatusOK, "1,3"},
+		{"toys", ks.addTestKey([]string{"*"}, []string{"toys"}), http.StatusOK, "2,3"},
+		{"no events scope", ks.addTestKey([]string{opList}, nil), http.StatusForbidden, ""},
+		{"invalid key", "pk_nosuchkey_secret", http.StatusUnauthorized, ""},
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := httptest.NewRequest("GET", "/events?since=0", nil).WithContext(ctx)
+		r.Header.Set(APIKeyHeader, c.key)
+		w := httptest.NewRecorder()
+		eventsHandler(w, r)
+
+		if w.Code != c.expStatus {
+			t.Errorf("[%s] Expected status: %d, got: %d", c.name, c.expStatus, w.Code)
+			continue
+		}
+		var ids []string
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(line, "id: ") {
+				ids = append(ids, strings.TrimPrefix(line, "id: "))
+			}
+		}
+		if got := strings.Join(ids, ","); got != c.expIDs {
+			t.Errorf("[%s] Expected event IDs: %s, got: %s", c.name, c.expIDs, got)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package productws
+
+// Accessors of package state for external tests (package productws_test),
+// so they can restore what they change.
+
+// CurrentStore returns the Store set by SetStore().
+func CurrentStore() Store {
+	return store
+}
+
+// CurrentAuditSink returns the AuditSink set by SetAuditSink().
+func CurrentAuditSink() AuditSink {
+	return auditSink
+}
+
+// CurrentAuthenticator returns the Authenticator set by SetAuthenticator().
+func CurrentAuthenticator() Authenticator {
+	return authenticator
+}
+
+// CurrentAuthorizer returns the Authorizer set by SetAuthorizer().
+func CurrentAuthorizer() Authorizer {
+	return authorizer
+}
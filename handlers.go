@@ -8,10 +8,12 @@ package productws
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Constants for the operations (names of API calls)
@@ -21,12 +23,34 @@ const (
 	opDetails   = "details"   // Getting details of a product.
 	opUpdate    = "update"    // Update a product
 	opSetPrices = "setprices" // Set price points for different currencies for a product
+	opAudit     = "audit"     // Query the audit log
+	opEvents    = "events"    // Stream change events (SSE feed and WebSocket subscriptions)
+
+	opAddWebhook = "addwebhook" // Subscribe a webhook
+	opWebhooks   = "webhooks"   // List webhook subscriptions
+	opDelWebhook = "delwebhook" // Delete a webhook subscription
+	opDeliveries = "deliveries" // Inspect webhook deliveries
+
+	opExportCSV = "export.csv" // Export the catalog in CSV format
+	opImport    = "import"     // Import products in CSV format
+
+	opDump    = "dump"    // Dump a snapshot of the catalog (admin call)
+	opRestore = "restore" // Restore a snapshot (admin call)
+
+	opLogin  = "login"  // Exchange credentials for a token
+	opLogout = "logout" // Revoke the token of the call
+
+	opAddAPIKey    = "addapikey"    // Create an API key
+	opAPIKeys      = "apikeys"      // List API keys
+	opRevokeAPIKey = "revokeapikey" // Revoke an API key
+	opRotateAPIKey = "rotateapikey" // Rotate an API key
 )
 
 // Store implementation to use
 var store Store
 
 // SetStore sets the Store used by the API calls.
+// Store operation metrics are recorded if the store is wrapped with storemw.Prometheus().
 // Must be done prior to starting the web service.
 func SetStore(st Store) {
 	store = st
@@ -36,15 +60,31 @@ func SetStore(st Store) {
 const (
 	MsgGeneralStoreErr = "Product store unavailable" // General error message concerning Store errors.
 	MsgInvalidIDErr    = "Invalid ID!"               // Error saying no product for the ID
+	MsgForbiddenErr    = "Permission denied!"        // Error saying the caller is not allowed to perform the call
 )
 
+// Max size of request bodies of API calls (except calls accepting large bodies, e.g. import),
+// and of WebSocket messages
+const maxBodySize = 1 << 20
+
+// saveProduct saves a product to the store,
+// and publishes an event of the specified type if save succeeds.
+// before is the product before the change (nil if created).
+func saveProduct(st Store, before, p *Product, evType string) error {
+	if err := st.Save(p); err != nil {
+		return err
+	}
+	eventBus.publish(evType, before, p)
+	return nil
+}
+
 // createUpdateLogic implements creating a new product and updating a product.
 // Expects the request body to be the JSON product to be created or updated.
 // Creation requires ID not be present, update requires a valid ID (to be updated).
 func createUpdateLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
 	p := new(Product)
 	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
-		log.Printf("Error decoding %s request: %v", ch.op, err)
+		logOf(r).Warn("Error decoding request", "err", err)
 		http.Error(w, "Can't decode input JSON", http.StatusBadRequest)
 		return nil
 	}
@@ -61,27 +101,106 @@ func createUpdateLogic(w http.ResponseWriter, r *http.Request, ch *callHandler)
 		return &JSONResp{Error: msg}
 	}
 
-	if err := store.Save(p); err != nil {
-		log.Printf("Error saving product: %v", err)
+	// Audit metadata is managed by the server, client values are not trusted:
+	ci := callInfoOf(r)
+	ci.productID = p.ID
+	if !ci.permits(p) {
+		return forbidden(w)
+	}
+	st := storeOf(r)
+	now := time.Now()
+	var before *Product
+	if ch.op == opUpdate {
+		// Creation time must be preserved, get it from the existing product
+		p2, err := st.Load(p.ID)
+		if err != nil {
+			ci.log.Error("Error loading product", "id", p.ID, "err", err)
+			if err == ErrInvalidId {
+				return &JSONResp{Error: MsgInvalidIDErr}
+			}
+			return &JSONResp{Error: MsgGeneralStoreErr}
+		}
+		if !ci.permits(p2) {
+			return forbidden(w)
+		}
+		p.CreatedAt, before = p2.CreatedAt, p2
+	} else {
+		p.CreatedAt = now
+	}
+	p.UpdatedAt, p.UpdatedBy = now, ci.caller
+
+	evType := EventCreated
+	if ch.op == opUpdate {
+		evType = EventUpdated
+	}
+	if err := saveProduct(st, before, p, evType); err != nil {
+		ci.log.Error("Error saving product", "err", err)
 		if err == ErrInvalidId {
 			return &JSONResp{Error: MsgInvalidIDErr}
 		}
 		return &JSONResp{Error: MsgGeneralStoreErr}
 	}
+	ci.productID = p.ID
+	ci.changes = append(ci.changes, productChange{before: before, after: p.Clone()})
 
 	return &JSONResp{Success: true, Data: struct{ ID ID }{p.ID}}
 }
 
 // listLogic implements getting a list of all products.
 // Does not require anything in the request path or body.
-func listLogic(http.ResponseWriter, *http.Request, *callHandler) *JSONResp {
-	ids, err := store.AllIDs()
+//
+// Optional filters may be specified as URL query parameters:
+//     modifiedSince  only list products modified at or after this time (RFC 3339)
+//     createdSince   only list products created at or after this time (RFC 3339)
+//     updatedBy      only list products last modified by this caller
+func listLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	q := r.URL.Query()
+	var modifiedSince, createdSince time.Time
+	for _, f := range []struct {
+		name string
+		t    *time.Time
+	}{{"modifiedSince", &modifiedSince}, {"createdSince", &createdSince}} {
+		if v := q.Get(f.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return &JSONResp{Error: "Invalid " + f.name + " parameter, must be an RFC 3339 time!"}
+			}
+			*f.t = t
+		}
+	}
+	updatedBy := q.Get("updatedBy")
+
+	ci := callInfoOf(r)
+	st := storeOf(r)
+	ids, err := st.AllIDs()
 	if err != nil {
-		log.Printf("Error getting all product IDs: %v", err)
+		ci.log.Error("Error getting all product IDs", "err", err)
 		return &JSONResp{Error: MsgGeneralStoreErr}
 	}
 
-	return &JSONResp{Success: true, Data: ids}
+	if modifiedSince.IsZero() && createdSince.IsZero() && updatedBy == "" && len(ci.tags) == 0 {
+		return &JSONResp{Success: true, Data: ids}
+	}
+
+	// Filters are specified (or the permission is restricted to tags), products have to be loaded:
+	filtered := []ID{}
+	for _, id := range ids {
+		p, err := st.Load(id)
+		if err != nil {
+			if err == ErrInvalidId {
+				continue // Product removed in the mean time
+			}
+			ci.log.Error("Error loading product", "id", id, "err", err)
+			return &JSONResp{Error: MsgGeneralStoreErr}
+		}
+		if p.UpdatedAt.Before(modifiedSince) || p.CreatedAt.Before(createdSince) ||
+			updatedBy != "" && p.UpdatedBy != updatedBy || !ci.permits(p) {
+			continue
+		}
+		filtered = append(filtered, id)
+	}
+
+	return &JSONResp{Success: true, Data: filtered}
 }
 
 // detailsLogic implements getting details about a product.
@@ -98,20 +217,26 @@ func detailsLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSON
 		}
 	}
 	if id == 0 {
-		log.Printf("Invalid path: %v", r.URL.Path)
+		logOf(r).Warn("Invalid path", "path", r.URL.Path)
 		http.Error(w, "Path must be like /details/id", http.StatusBadRequest)
 		return nil
 	}
 
+	ci := callInfoOf(r)
+	ci.productID = id
+
 	var p *Product
 	var err error
-	if p, err = store.Load(id); err != nil {
-		log.Printf("Error loading product with id %d: %v", id, err)
+	if p, err = storeOf(r).Load(id); err != nil {
+		ci.log.Error("Error loading product", "id", id, "err", err)
 		if err == ErrInvalidId {
 			return &JSONResp{Error: MsgInvalidIDErr}
 		}
 		return &JSONResp{Error: MsgGeneralStoreErr}
 	}
+	if !ci.permits(p) {
+		return forbidden(w)
+	}
 
 	return &JSONResp{Success: true, Data: p}
 }
@@ -122,7 +247,7 @@ func detailsLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSON
 func setPricesLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
 	p := new(Product)
 	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
-		log.Printf("Error decoding %s request: %v", ch.op, err)
+		logOf(r).Warn("Error decoding request", "err", err)
 		http.Error(w, "Can't decode input JSON", http.StatusBadRequest)
 		return nil
 	}
@@ -140,34 +265,97 @@ func setPricesLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JS
 		}
 	}
 
+	ci := callInfoOf(r)
+	ci.productID = p.ID
+
 	// First get existing product
+	st := storeOf(r)
 	var p2 *Product
 	var err error
-	if p2, err = store.Load(p.ID); err != nil {
-		log.Printf("Error loading product with id %d: %v", p.ID, err)
+	if p2, err = st.Load(p.ID); err != nil {
+		ci.log.Error("Error loading product", "id", p.ID, "err", err)
 		if err == ErrInvalidId {
 			return &JSONResp{Error: MsgInvalidIDErr}
 		}
 		return &JSONResp{Error: MsgGeneralStoreErr}
 	}
+	if !ci.permits(p2) {
+		return forbidden(w)
+	}
+
+	before := p2.Clone()
 
 	// Merge changes into the product:
 	for k, v := range p.Prices {
 		p2.Prices[k] = v
 	}
+	p2.UpdatedAt, p2.UpdatedBy = time.Now(), ci.caller
 
 	// And finally save updated product
-	if err := store.Save(p2); err != nil {
-		log.Printf("Error saving product: %v", err)
+	if err := saveProduct(st, before, p2, EventPricesChanged); err != nil {
+		ci.log.Error("Error saving product", "err", err)
 		if err == ErrInvalidId {
 			return &JSONResp{Error: MsgInvalidIDErr}
 		}
 		return &JSONResp{Error: MsgGeneralStoreErr}
 	}
+	ci.changes = append(ci.changes, productChange{before: before, after: p2})
 
 	return &JSONResp{Success: true, Data: struct{ ID ID }{p2.ID}}
 }
 
+// callerOf returns the identity of the caller of an API call, as known before authentication
+// (the authenticated principal overrides it). If the caller presented a verified client certificate (mutual TLS), it is identified by
+// the common name of the certificate, else by its remote host.
+func callerOf(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// callInfo holds information about a single API call (request).
+type callInfo struct {
+	caller string       // Identity of the caller
+	reqID  string       // Request ID
+	log    *slog.Logger // Logger of the call, adding the request ID and the operation to log records
+	span   *Span        // Span of the call, nil if tracing is disabled
+	tags   []string     // Tags the permission of the call is restricted to, nil if not restricted
+	apiKey *APIKey      // API key the call is authenticated with, nil if none
+
+	// ID of the product the call concerns (0 if none or unknown), for access logs
+	productID ID
+
+	// Products changed by a successful mutating call, used for auditing
+	changes []productChange
+}
+
+// productChange describes the change of a product made by an API call.
+type productChange struct {
+	before *Product  // Product before the change, nil if created
+	after  *Product  // Product after the change
+	at     time.Time // Time of the change if it is not after.UpdatedAt (e.g. restored products)
+}
+
+// callInfoKey is the context key under which the *callInfo of a request is stored.
+type callInfoKey struct{}
+
+// callInfoOf returns the callInfo of an API call request.
+// If the request does not have one, a new callInfo is returned.
+func callInfoOf(r *http.Request) *callInfo {
+	if ci, ok := r.Context().Value(callInfoKey{}).(*callInfo); ok {
+		return ci
+	}
+	return &callInfo{caller: callerOf(r), log: logger}
+}
+
 // callLogic is a function type of call logic implementations.
 type callLogic func(http.ResponseWriter, *http.Request, *callHandler) *JSONResp
 
@@ -177,12 +365,17 @@ type callHandler struct {
 	op        string    // Operation (name of the API call)
 	expMethod string    // Expected HTTP method for the api call
 	logic     callLogic // Call handling logic
+
+	noAuth    bool // Tells if the call is not subject to authentication (e.g. it authenticates itself)
+	noAuthz   bool // Tells if the call is not subject to authorization (allowed to all authenticated callers)
+	largeBody bool // Tells if the call accepts request bodies larger than maxBodySize (e.g. CSV imports)
 }
 
 // ServeHTTP implements http.Handler.
 // Contains common logic for all api calls, and invokes the logic handler.
 // Common logic includes checking expected HTTP method, calling the logic,
-// marshaling JSON response. Also future authentication can be added here.
+// auditing successful mutating calls, marshaling JSON response, recording metrics and access logs.
+// Authentication and authorization is done by call().
 func (ch *callHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Allow JavaScript to access API calls:
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -191,32 +384,165 @@ func (ch *callHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !ch.largeBody {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
+
 	// Disable caching:
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate") // For HTTP 1.1
 	w.Header().Set("Pragma", "no-cache")                                   // For HTTP 1.0
 	w.Header().Set("Expires", "0")                                         // For proxies
 
-	// If authentication is required, it can be checked here.
+	// Request ID for log correlation, span for tracing:
+	ci := newCallInfo(r, ch.op)
+	r = withCallInfo(r, ci)
+	w.Header().Set(RequestIDHeader, ci.reqID)
+	w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader+", Retry-After, "+
+		rateLimitLimitHeader+", "+rateLimitRemainingHeader+", "+rateLimitResetHeader)
+
+	ch.serve(w, r, true)
+}
+
+// serve performs the API call of r (which must carry its callInfo, see withCallInfo()),
+// recording its metrics, access log and span. Used by ServeHTTP and the WebSocket API.
+// If send is true, the JSON response is sent to w.
+// Returns the JSON response, or nil if a response has already been sent.
+func (ch *callHandler) serve(w http.ResponseWriter, r *http.Request, send bool) *JSONResp {
+	ci := callInfoOf(r)
+
+	// Record metrics and access log:
+	start := time.Now()
+	requestsInFlight.add(1, ch.op)
+	rw := &recordingResponseWriter{ResponseWriter: w}
+	w = rw
+
+	jsonResp := ch.call(w, r)
+	if jsonResp != nil && send {
+		// Send JSON response
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(jsonResp); err != nil {
+			ci.log.Warn("Failed to send JSON response", "err", err)
+		}
+	}
+
+	requestsInFlight.add(-1, ch.op)
+	observeRequest(ch.op, rw.statusCode(), jsonResp, time.Since(start))
+	accessLog(r, ci, rw, jsonResp, start)
+	endCallSpan(ci, rw.statusCode(), jsonResp)
+
+	return jsonResp
+}
+
+// call performs the API call: checks the expected HTTP method, authenticates and authorizes the caller,
+// enforces rate and concurrency limits, calls the logic and audits the product changes made by the logic.
+// Returns the JSON response to send, or nil if a response has already been sent.
+func (ch *callHandler) call(w http.ResponseWriter, r *http.Request) *JSONResp {
 	if r.Method != ch.expMethod {
 		http.Error(w, "Method not allowed, use "+ch.expMethod, http.StatusMethodNotAllowed)
-		return
+		return nil
 	}
 
-	if jsonResp := ch.logic(w, r, ch); jsonResp != nil {
-		// Send JSON response
+	ci := callInfoOf(r)
+
+	// rejected returns the JSON response of a call rejected before running its logic.
+	rejected := func(jsonResp *JSONResp) *JSONResp {
 		jsonResp.Op = ch.op
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(jsonResp); err != nil {
-			log.Printf("Failed to send JSON response: %v", err)
+		return jsonResp
+	}
+
+	// Concurrency and per-IP rate limits are enforced before authentication, which may be costly
+	// (e.g. bcrypt), so failed authentication attempts are throttled too:
+	release, jsonResp := acquireSlot(w, ch, ci)
+	if jsonResp != nil {
+		return rejected(jsonResp)
+	}
+	defer release()
+	if jsonResp := limitRate(w, r, ch, ci, false); jsonResp != nil {
+		return rejected(jsonResp)
+	}
+
+	if !ch.noAuth {
+		principal, ok := authenticate(w, r)
+		if !ok {
+			return nil
+		}
+		if principal != "" {
+			ci.caller = principal
 		}
 	}
+
+	// Authorization, then rate limits of the authenticated caller:
+	jsonResp = authorize(w, ch, ci)
+	if jsonResp == nil {
+		jsonResp = limitAPIKey(w, ch, ci)
+	}
+	if jsonResp == nil {
+		jsonResp = limitRate(w, r, ch, ci, true)
+	}
+	if jsonResp != nil {
+		return rejected(jsonResp)
+	}
+
+	jsonResp = ch.logic(w, r, ch)
+	audit(ch, ci) // Only successful saves are recorded as changes
+	if jsonResp == nil {
+		return nil
+	}
+
+	jsonResp.Op = ch.op
+	return jsonResp
+}
+
+// Handlers of the product API calls, mapped from operation.
+// These are also dispatched by the WebSocket API.
+var productCalls = map[string]*callHandler{}
+
+// Operations of the registered API calls
+var callOps = map[string]bool{}
+
+// handle registers the handler of an API call for the given pattern.
+func handle(pattern string, ch *callHandler) {
+	callOps[ch.op] = true
+	http.Handle(pattern, ch)
 }
 
 // init registers the HTTP handlers.
 func init() {
-	http.Handle("/"+opCreate, &callHandler{op: opCreate, expMethod: http.MethodPost, logic: createUpdateLogic})
-	http.Handle("/"+opList, &callHandler{op: opList, expMethod: http.MethodGet, logic: listLogic})
-	http.Handle("/"+opDetails+"/", &callHandler{op: opDetails, expMethod: http.MethodGet, logic: detailsLogic})
-	http.Handle("/"+opUpdate, &callHandler{op: opUpdate, expMethod: http.MethodPut, logic: createUpdateLogic})
-	http.Handle("/"+opSetPrices, &callHandler{op: opSetPrices, expMethod: http.MethodPut, logic: setPricesLogic})
+	for _, ch := range []*callHandler{
+		{op: opCreate, expMethod: http.MethodPost, logic: createUpdateLogic},
+		{op: opList, expMethod: http.MethodGet, logic: listLogic},
+		{op: opDetails, expMethod: http.MethodGet, logic: detailsLogic},
+		{op: opUpdate, expMethod: http.MethodPut, logic: createUpdateLogic},
+		{op: opSetPrices, expMethod: http.MethodPut, logic: setPricesLogic},
+	} {
+		productCalls[ch.op] = ch
+	}
+
+	handle("/"+opCreate, productCalls[opCreate])
+	handle("/"+opList, productCalls[opList])
+	handle("/"+opDetails+"/", productCalls[opDetails])
+	handle("/"+opUpdate, productCalls[opUpdate])
+	handle("/"+opSetPrices, productCalls[opSetPrices])
+	handle("/"+opAudit, &callHandler{op: opAudit, expMethod: http.MethodGet, logic: auditLogic})
+	http.HandleFunc("/"+opEvents, eventsHandler)
+	callOps[opEvents] = true // Authorized by eventsHandler
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/version", versionHandler)
+	handle("/"+opAddWebhook, &callHandler{op: opAddWebhook, expMethod: http.MethodPost, logic: addWebhookLogic})
+	handle("/"+opWebhooks, &callHandler{op: opWebhooks, expMethod: http.MethodGet, logic: listWebhooksLogic})
+	handle("/"+opDelWebhook, &callHandler{op: opDelWebhook, expMethod: http.MethodPost, logic: delWebhookLogic})
+	handle("/"+opDeliveries, &callHandler{op: opDeliveries, expMethod: http.MethodGet, logic: deliveriesLogic})
+	http.HandleFunc("/ws", wsHandler)
+	handle("/"+opExportCSV, &callHandler{op: opExportCSV, expMethod: http.MethodGet, logic: exportCSVLogic})
+	handle("/"+opImport, &callHandler{op: opImport, expMethod: http.MethodPost, logic: importLogic, largeBody: true})
+	handle("/admin/"+opDump, &callHandler{op: opDump, expMethod: http.MethodGet, logic: dumpLogic})
+	handle("/admin/"+opRestore, &callHandler{op: opRestore, expMethod: http.MethodPost, logic: restoreLogic, largeBody: true})
+	handle("/"+opLogin, &callHandler{op: opLogin, expMethod: http.MethodPost, logic: loginLogic, noAuth: true})
+	handle("/"+opLogout, &callHandler{op: opLogout, expMethod: http.MethodPost, logic: logoutLogic, noAuthz: true})
+	handle("/"+opAddAPIKey, &callHandler{op: opAddAPIKey, expMethod: http.MethodPost, logic: addAPIKeyLogic})
+	handle("/"+opAPIKeys, &callHandler{op: opAPIKeys, expMethod: http.MethodGet, logic: listAPIKeysLogic})
+	handle("/"+opRevokeAPIKey, &callHandler{op: opRevokeAPIKey, expMethod: http.MethodPost, logic: revokeAPIKeyLogic})
+	handle("/"+opRotateAPIKey, &callHandler{op: opRotateAPIKey, expMethod: http.MethodPost, logic: rotateAPIKeyLogic})
 }
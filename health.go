@@ -0,0 +1,129 @@
+/*
+
+Health, readiness and build info endpoints.
+
+*/
+
+package productws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Pinger is an optional interface of Store implementations which can check
+// if the store is usable (e.g. a remote store is reachable).
+type Pinger interface {
+	// Ping checks if the store is usable, returns a non-nil error if not.
+	Ping(ctx context.Context) error
+}
+
+// unwrapper is implemented by Store decorators, returning the wrapped Store.
+type unwrapper interface {
+	Unwrap() Store
+}
+
+// Max time the readiness check may take
+const readyTimeout = 2 * time.Second
+
+// Start time of the service (approximately)
+var startTime = time.Now()
+
+// VersionInfo is the build info of the service, returned by the version endpoint.
+type VersionInfo struct {
+	Version   string // Version of the main module (empty if unknown)
+	Revision  string `json:",omitempty"` // VCS revision the binary was built from
+	RevTime   string `json:",omitempty"` // Time of the VCS revision
+	Modified  bool   // Tells if the working tree had local modifications
+	GoVersion string // Go version the binary was built with
+
+	Started time.Time // Start time of the service
+	Uptime  string    // Time elapsed since start, e.g. "1h2m3s"
+	Store   string    // Name of the Store implementation, e.g. "*inmemstore.inmemStore"
+}
+
+// storeName returns the name of the type of the innermost Store implementation,
+// seeing through decorators.
+func storeName(st Store) string {
+	return fmt.Sprintf("%T", innermostStore(st))
+}
+
+// innermostStore returns the innermost Store implementation, seeing through decorators.
+func innermostStore(st Store) Store {
+	for {
+		u, ok := st.(unwrapper)
+		if !ok {
+			return st
+		}
+		st = u.Unwrap()
+	}
+}
+
+// writeJSON sends a JSON response with the specified status code.
+func writeJSON(w http.ResponseWriter, status int, jsonResp *JSONResp) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(jsonResp); err != nil {
+		logger.Warn("Failed to send JSON response", "op", jsonResp.Op, "err", err)
+	}
+}
+
+// healthzHandler serves the liveness check: responds success as long as the process is up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &JSONResp{Op: "healthz", Success: true})
+}
+
+// readyzHandler serves the readiness check: responds success if the Store is usable.
+// If the Store implements Pinger, it is pinged (with a timeout), else the store is
+// considered usable if it is set. Responds with 503 Service Unavailable if not ready.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		writeJSON(w, http.StatusServiceUnavailable, &JSONResp{Op: "readyz", Error: "Store is not set!"})
+		return
+	}
+
+	if pinger, ok := store.(Pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := pinger.Ping(ctx); err != nil {
+			logger.Warn("Store ping failed", "err", err)
+			writeJSON(w, http.StatusServiceUnavailable, &JSONResp{Op: "readyz", Error: MsgGeneralStoreErr})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &JSONResp{Op: "readyz", Success: true})
+}
+
+// versionHandler serves the build info of the service.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	vi := &VersionInfo{
+		GoVersion: runtime.Version(),
+		Started:   startTime,
+		Uptime:    time.Since(startTime).Round(time.Second).String(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		vi.Version = bi.Main.Version
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				vi.Revision = s.Value
+			case "vcs.time":
+				vi.RevTime = s.Value
+			case "vcs.modified":
+				vi.Modified = s.Value == "true"
+			}
+		}
+	}
+	if store != nil {
+		vi.Store = storeName(store)
+	}
+
+	writeJSON(w, http.StatusOK, &JSONResp{Op: "version", Success: true, Data: vi})
+}
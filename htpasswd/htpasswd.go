@@ -0,0 +1,171 @@
+/*
+
+Package htpasswd contains a productws.Authenticator implementation which validates HTTP Basic
+credentials against an htpasswd file with bcrypt password hashes, safe for concurrent use.
+
+The file contains one user per line in the form
+
+    user:hash
+
+where hash is a bcrypt hash (e.g. created with "htpasswd -nbB user password").
+Empty lines and lines starting with # are ignored. Other hash formats are not supported,
+such users are skipped (and logged).
+
+*/
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"github.com/icza/productws"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is the default min interval of checking the file for changes.
+const DefaultReloadInterval = 5 * time.Second
+
+// dummyHash is compared against when the user is unknown, so the response time
+// does not tell if the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// File is an Authenticator which validates Basic credentials against an htpasswd file.
+// The file is reloaded when it changes.
+type File struct {
+	name     string        // Name of the htpasswd file
+	realm    string        // Realm sent in the challenge
+	interval time.Duration // Min interval of checking the file for changes
+
+	// Mutex to protect concurrent access to the fields below
+	mux sync.Mutex
+
+	hashes    map[string][]byte // Password hashes mapped from user
+	modTime   time.Time         // Modification time of the file when loaded
+	lastCheck time.Time         // Time of the last check for changes
+
+	// Verified credentials (SHA-256 of user and password), so bcrypt only has to run
+	// once for each; cleared when the file is reloaded
+	verified map[[sha256.Size]byte]bool
+}
+
+// NewFile loads the named htpasswd file, and returns an Authenticator which validates
+// Basic credentials against it. realm is sent in the challenge of 401 responses.
+// The file is checked for changes at most every DefaultReloadInterval; if it changes, it is
+// reloaded (if reloading fails, the error is logged and the previous users stay in effect).
+func NewFile(name, realm string) (*File, error) {
+	f := &File{name: name, realm: realm, interval: DefaultReloadInterval}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(fi.ModTime()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load loads the file.
+// Must be called with the mutex held (or before the File is shared).
+func (f *File) load(modTime time.Time) error {
+	file, err := os.Open(f.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hashes := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			productws.Logger().Warn("Invalid htpasswd line, skipping", "file", f.name, "line", lineNum)
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			productws.Logger().Warn("User does not have a bcrypt hash, skipping", "file", f.name, "user", user)
+			continue
+		}
+		hashes[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.hashes, f.modTime, f.lastCheck = hashes, modTime, time.Now()
+	f.verified = map[[sha256.Size]byte]bool{}
+	return nil
+}
+
+// reloadIfChanged reloads the file if it changed since it was loaded.
+// Must be called with the mutex held.
+func (f *File) reloadIfChanged() {
+	if time.Since(f.lastCheck) < f.interval {
+		return
+	}
+	f.lastCheck = time.Now()
+
+	fi, err := os.Stat(f.name)
+	if err != nil {
+		productws.Logger().Error("Failed to check htpasswd file", "file", f.name, "err", err)
+		return
+	}
+	if fi.ModTime().Equal(f.modTime) {
+		return
+	}
+	if err := f.load(fi.ModTime()); err != nil {
+		productws.Logger().Error("Failed to reload htpasswd file, keeping the previous users", "file", f.name, "err", err)
+		return
+	}
+	productws.Logger().Info("Htpasswd file reloaded", "file", f.name, "users", len(f.hashes))
+}
+
+// Authenticate implements productws.Authenticator.Authenticate().
+// The principal is the user name.
+func (f *File) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", productws.ErrNoCredentials
+	}
+
+	f.mux.Lock()
+	f.reloadIfChanged()
+	hash, known := f.hashes[user]
+	key := sha256.Sum256([]byte(user + ":" + password))
+	verified := known && f.verified[key]
+	loaded := f.modTime
+	f.mux.Unlock()
+
+	if verified {
+		return user, nil
+	}
+
+	// bcrypt is slow by design, don't hold the lock while comparing
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", productws.ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", productws.ErrInvalidCredentials
+	}
+
+	f.mux.Lock()
+	if f.modTime.Equal(loaded) { // Not reloaded in the mean time
+		f.verified[key] = true
+	}
+	f.mux.Unlock()
+
+	return user, nil
+}
+
+// Challenge implements productws.Authenticator.Challenge().
+func (f *File) Challenge() string {
+	return `Basic realm="` + f.realm + `", charset="UTF-8"`
+}
@@ -0,0 +1,103 @@
+package htpasswd
+
+import (
+	"github.com/icza/productws"
+	"golang.org/x/crypto/bcrypt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hash returns the bcrypt hash of password (with the min cost to keep tests fast).
+func hash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+// writeFile writes the htpasswd file with the specified content.
+func writeFile(t *testing.T, name, content string) {
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "users.htpasswd")
+	writeFile(t, name, "# Users\n\nbob:"+hash(t, "secret")+"\nalice:"+hash(t, "pa:ss")+
+		"\nmd5user:$apr1$abcdefgh$0123456789abcdefghijkl\ninvalid line\n")
+
+	f, err := NewFile(name, "test")
+	if err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+
+	cases := []struct {
+		name           string
+		user, password string
+		noAuth         bool
+		expErr         error
+	}{
+		{"valid", "bob", "secret", false, nil},
+		{"valid again (verified)", "bob", "secret", false, nil},
+		{"valid with colon", "alice", "pa:ss", false, nil},
+		{"wrong password", "bob", "Secret", false, productws.ErrInvalidCredentials},
+		{"empty password", "bob", "", false, productws.ErrInvalidCredentials},
+		{"other user's password", "alice", "secret", false, productws.ErrInvalidCredentials},
+		{"unknown user", "eve", "secret", false, productws.ErrInvalidCredentials},
+		{"non-bcrypt user", "md5user", "secret", false, productws.ErrInvalidCredentials},
+		{"no credentials", "", "", true, productws.ErrNoCredentials},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/list", nil)
+		if !c.noAuth {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		principal, err := f.Authenticate(r)
+		if err != c.expErr {
+			t.Errorf("[%s] Expected error: %v, got: %v", c.name, c.expErr, err)
+		}
+		if err == nil && principal != c.user {
+			t.Errorf("[%s] Expected principal: %q, got: %q", c.name, c.user, principal)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "users.htpasswd")
+	writeFile(t, name, "bob:"+hash(t, "secret")+"\n")
+
+	f, err := NewFile(name, "test")
+	if err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+	f.interval = 0
+
+	auth := func(password string) error {
+		r := httptest.NewRequest("GET", "/list", nil)
+		r.SetBasicAuth("bob", password)
+		_, err := f.Authenticate(r)
+		return err
+	}
+
+	if err := auth("secret"); err != nil {
+		t.Fatalf("Expected success, got: %v", err)
+	}
+
+	// Change the password, the verified old password must not be accepted anymore:
+	writeFile(t, name, "bob:"+hash(t, "new secret")+"\n")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(name, later, later)
+
+	if err := auth("secret"); err != productws.ErrInvalidCredentials {
+		t.Errorf("Expected old password to be rejected, got: %v", err)
+	}
+	if err := auth("new secret"); err != nil {
+		t.Errorf("Expected new password to be accepted, got: %v", err)
+	}
+}
@@ -0,0 +1,580 @@
+/*
+
+Optional durability of the in-memory store: write-ahead log and snapshots.
+
+*/
+
+package inmemstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/icza/productws"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy tells when the write-ahead log is synced (fsync) to stable storage.
+type SyncPolicy int
+
+// Sync policies
+const (
+	SyncAlways   SyncPolicy = iota // Sync after each record; nothing is lost on crash
+	SyncBatch                      // Sync after every DurableOptions.BatchSize records
+	SyncInterval                   // Sync periodically, every DurableOptions.SyncInterval
+)
+
+// DurableOptions holds options of the durable in-memory store.
+type DurableOptions struct {
+	Sync         SyncPolicy    // Sync policy of the write-ahead log, default: SyncAlways
+	BatchSize    int           // Records per sync in case of SyncBatch, default: 100
+	SyncInterval time.Duration // Sync period in case of SyncInterval, default: 1s
+
+	// Period of taking snapshots (after which the log is truncated), default: 5m.
+	// Negative value disables periodic snapshots.
+	SnapshotInterval time.Duration
+}
+
+// ErrClosed is returned by a closed durable store.
+var ErrClosed = errors.New("store is closed")
+
+// ErrFailed is returned by a durable store whose write-ahead log failed (writing or syncing it
+// returned an error). The outcome of the failed save is unknown: its record may or may not be in
+// the log (and so it may or may not be present after a restart), so no further saves are accepted.
+var ErrFailed = errors.New("write-ahead log failed")
+
+// Names of the files in the data directory
+const (
+	snapshotFile = "snapshot.dat"
+	walFile      = "wal.log"
+	oldWalFile   = "wal.old.log" // Log being compacted into a snapshot
+)
+
+// castagnoli is the CRC32 table used for record checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotHeader is the first record of a snapshot file.
+type snapshotHeader struct {
+	IDCounter productws.ID // ID counter of the store
+	Count     int          // Number of product records following
+}
+
+// wal is the durability layer of an in-memory store.
+type wal struct {
+	dir  string
+	opts DurableOptions
+
+	// Current log file, and its buffered writer
+	f  *os.File
+	bw *bufio.Writer
+
+	// Number of records written since the last sync
+	unsynced int
+
+	// Tells if the log is closed
+	closed bool
+
+	// Error that made the log unusable, nil if none
+	failed error
+
+	// Serializes snapshots
+	snapMux sync.Mutex
+
+	// Channel to signal background goroutines to stop (closed once), and their wait group
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewDurableInmemStore returns a new in-memory Store implementation whose contents
+// survive restarts: every Save is appended to a write-ahead log in dir before it is
+// applied, the contents are periodically snapshotted and the log truncated.
+// On startup the snapshot and the log are replayed to rebuild the store.
+//
+// Records are checksummed. An incomplete or corrupt record at the end of the log
+// (e.g. a torn write due to a crash) and a zero-filled tail (e.g. after power loss) are discarded;
+// corruption anywhere else is reported as an error.
+//
+// opts is optional, defaults are used for zero values.
+// The returned store also implements io.Closer, it must be closed to flush the log.
+// Safe for concurrent use.
+func NewDurableInmemStore(dir string, opts *DurableOptions) (productws.Store, error) {
+	w := &wal{dir: dir, stop: make(chan struct{})}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.BatchSize <= 0 {
+		w.opts.BatchSize = 100
+	}
+	if w.opts.SyncInterval <= 0 {
+		w.opts.SyncInterval = time.Second
+	}
+	if w.opts.SnapshotInterval == 0 {
+		w.opts.SnapshotInterval = 5 * time.Minute
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := NewInmemStore().(*inmemStore)
+	if err := w.replay(s); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.f, w.bw = f, bufio.NewWriter(f)
+	s.wal = w
+
+	if w.opts.Sync == SyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop(s)
+	}
+	if w.opts.SnapshotInterval > 0 {
+		w.wg.Add(1)
+		go w.snapshotLoop(s)
+	}
+
+	return s, nil
+}
+
+// append appends a product record to the log, and syncs according to the sync policy.
+// Must be called with the write lock of the store held.
+func (w *wal) append(p *productws.Product) error {
+	if w.closed {
+		return ErrClosed
+	}
+	if w.failed != nil {
+		return ErrFailed
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(w.bw, data); err != nil {
+		return w.fail(err)
+	}
+
+	w.unsynced++
+	switch w.opts.Sync {
+	case SyncAlways:
+		return w.sync()
+	case SyncBatch:
+		if w.unsynced >= w.opts.BatchSize {
+			return w.sync()
+		}
+	}
+	return nil
+}
+
+// sync flushes and syncs the log if there are unsynced records.
+// Must be called with the write lock of the store held.
+func (w *wal) sync() error {
+	if w.unsynced == 0 {
+		return nil
+	}
+	if err := w.bw.Flush(); err != nil {
+		return w.fail(err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return w.fail(err)
+	}
+	w.unsynced = 0
+	return nil
+}
+
+// fail marks the log failed due to err: records may have been (partially) written,
+// so the log and the store may disagree. Returns err.
+// Must be called with the write lock of the store held.
+func (w *wal) fail(err error) error {
+	if w.failed == nil {
+		w.failed = err
+		productws.Logger().Error("Write-ahead log failed, no further saves are accepted", "err", err)
+	}
+	return err
+}
+
+// syncLoop syncs the log periodically.
+func (w *wal) syncLoop(s *inmemStore) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mux.Lock()
+			if !w.closed {
+				if err := w.sync(); err != nil {
+					productws.Logger().Error("Failed to sync write-ahead log", "err", err)
+				}
+			}
+			s.mux.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// snapshotLoop takes snapshots periodically.
+func (w *wal) snapshotLoop(s *inmemStore) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.opts.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.snapshot(s); err != nil {
+				productws.Logger().Error("Failed to take snapshot", "err", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// snapshot takes a snapshot of the store and truncates the log.
+//
+// The current log is rotated (renamed to oldWalFile) while the contents of the store are
+// captured, so saves are only blocked for a short time. After the snapshot is written
+// (atomically, by renaming a temporary file), the old log is removed. If a crash occurs
+// in between, the old log is replayed too, which is harmless as replaying is idempotent.
+func (w *wal) snapshot(s *inmemStore) error {
+	w.snapMux.Lock()
+	defer w.snapMux.Unlock()
+
+	// Capture contents and rotate log
+	s.mux.Lock()
+	if w.closed {
+		s.mux.Unlock()
+		return ErrClosed
+	}
+	if w.failed != nil {
+		s.mux.Unlock()
+		return ErrFailed
+	}
+	if err := w.sync(); err != nil {
+		s.mux.Unlock()
+		return err
+	}
+	// Stored products are never modified (Save replaces them), so copying the pointers is enough
+	ps := make([]*productws.Product, 0, len(s.m))
+	for _, p := range s.m {
+		ps = append(ps, p)
+	}
+	h := snapshotHeader{IDCounter: s.idCounter, Count: len(ps)}
+	err := w.rotate()
+	s.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write snapshot
+	tmpName := filepath.Join(w.dir, snapshotFile+".tmp")
+	if err := writeSnapshot(tmpName, &h, ps); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(w.dir, snapshotFile)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(w.dir, oldWalFile))
+}
+
+// rotate renames the current log to oldWalFile and opens a new, empty log.
+// Must be called with the write lock of the store held, after sync.
+func (w *wal) rotate() error {
+	// If a previous snapshot failed, the old log is still needed: append the current log to it
+	oldName, name := filepath.Join(w.dir, oldWalFile), filepath.Join(w.dir, walFile)
+	if _, err := os.Stat(oldName); err == nil {
+		if err := appendFile(oldName, name); err != nil {
+			return err
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	} else if err := os.Rename(name, oldName); err != nil {
+		return err
+	}
+	w.f.Close()
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		w.closed = true // Can't continue without a log
+		return err
+	}
+	w.f, w.bw = f, bufio.NewWriter(f)
+	return nil
+}
+
+// close stops background goroutines, syncs and closes the log.
+// Must not be called with the lock of the store held.
+func (w *wal) close(s *inmemStore) error {
+	w.stopOnce.Do(func() { close(w.stop) })
+	w.wg.Wait()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	err := w.sync()
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// replay rebuilds the store from the snapshot and the logs.
+func (w *wal) replay(s *inmemStore) error {
+	// Snapshot
+	if f, err := os.Open(filepath.Join(w.dir, snapshotFile)); err == nil {
+		err = readSnapshot(f, s)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("corrupt snapshot: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Logs
+	for _, name := range []string{oldWalFile, walFile} {
+		if err := replayLog(filepath.Join(w.dir, name), s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply applies a replayed product to the store.
+func apply(s *inmemStore, p *productws.Product) {
+	s.m[p.ID] = p
+	if p.ID > s.idCounter {
+		s.idCounter = p.ID
+	}
+}
+
+// replayLog replays a log file into the store.
+// An incomplete or corrupt record at the end of the log, and a zero-filled tail are discarded
+// (the log is truncated). Corrupt records followed by other data are reported as an error.
+func replayLog(name string, s *inmemStore) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(f)
+	var offset int64 // Offset of the end of the last good record
+	for {
+		data, n, err := readRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// A record is torn if it is incomplete, or if it is the last one and is corrupt,
+			// or if the rest of the log is zero bytes (e.g. preallocated blocks after power loss):
+			torn := err == io.ErrUnexpectedEOF || offset+n == fi.Size()
+			if !torn {
+				zero, err2 := zeroFrom(f, offset, fi.Size())
+				if err2 != nil {
+					return err2
+				}
+				torn = zero
+			}
+			if !torn {
+				return fmt.Errorf("corrupt write-ahead log %s at offset %d: %v", name, offset, err)
+			}
+			productws.Logger().Warn("Discarding incomplete record at the end of write-ahead log", "file", name, "offset", offset, "err", err)
+			return f.Truncate(offset)
+		}
+
+		p := new(productws.Product)
+		if err := json.Unmarshal(data, p); err != nil {
+			return fmt.Errorf("corrupt write-ahead log %s at offset %d: %v", name, offset, err)
+		}
+		apply(s, p)
+		offset += n
+	}
+}
+
+// zeroFrom tells if the file only contains zero bytes from offset up to size.
+func zeroFrom(f *os.File, offset, size int64) (bool, error) {
+	br := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if b != 0 {
+			return false, nil
+		}
+	}
+}
+
+// writeSnapshot writes a snapshot file and syncs it.
+func writeSnapshot(name string, h *snapshotHeader, ps []*productws.Product) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(bw, data); err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if data, err = json.Marshal(p); err != nil {
+			return err
+		}
+		if err := writeRecord(bw, data); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readSnapshot reads a snapshot into the store.
+func readSnapshot(r io.Reader, s *inmemStore) error {
+	br := bufio.NewReader(r)
+
+	data, _, err := readRecord(br)
+	if err != nil {
+		return err
+	}
+	h := new(snapshotHeader)
+	if err := json.Unmarshal(data, h); err != nil {
+		return err
+	}
+
+	for i := 0; i < h.Count; i++ {
+		data, _, err := readRecord(br)
+		if err != nil {
+			return err
+		}
+		p := new(productws.Product)
+		if err := json.Unmarshal(data, p); err != nil {
+			return err
+		}
+		apply(s, p)
+	}
+	if h.IDCounter > s.idCounter {
+		s.idCounter = h.IDCounter
+	}
+	return nil
+}
+
+// Record framing: 4 bytes payload length, 4 bytes CRC32 (Castagnoli) of the length,
+// 4 bytes CRC32 of the payload, followed by the payload (big endian).
+// The length has its own checksum, so a corrupt length is detected before the payload is read.
+const recordHeaderSize = 12
+
+// Max size of a record payload, larger lengths indicate corruption
+const maxRecordSize = 64 * 1024 * 1024
+
+// writeRecord writes a record.
+func writeRecord(w io.Writer, data []byte) error {
+	var h [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(h[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(h[4:8], crc32.Checksum(h[:4], castagnoli))
+	binary.BigEndian.PutUint32(h[8:], crc32.Checksum(data, castagnoli))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readRecord reads a record, returns its payload and the number of bytes of the record.
+// io.EOF is returned if there are no more records, io.ErrUnexpectedEOF if the record
+// is incomplete. In case of other errors n is the number of bytes of the record as far as it is known.
+func readRecord(r io.Reader) (data []byte, n int64, err error) {
+	var h [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, 0, err // io.EOF or io.ErrUnexpectedEOF
+	}
+
+	if crc32.Checksum(h[:4], castagnoli) != binary.BigEndian.Uint32(h[4:8]) {
+		return nil, recordHeaderSize, errors.New("header checksum mismatch")
+	}
+	size := binary.BigEndian.Uint32(h[:4])
+	if size == 0 || size > maxRecordSize {
+		return nil, recordHeaderSize, fmt.Errorf("invalid record size: %d", size)
+	}
+	data = make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	n = recordHeaderSize + int64(size)
+
+	if crc32.Checksum(data, castagnoli) != binary.BigEndian.Uint32(h[8:]) {
+		return nil, n, errors.New("checksum mismatch")
+	}
+	return data, n, nil
+}
+
+// appendFile appends the contents of file src to file dst, and syncs dst.
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,154 @@
+package inmemstore
+
+import (
+	"github.com/icza/productws"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestLog creates a durable store in a new temp dir with count products, closes it,
+// and returns the dir and the offsets of the records in the log (and the size of the log).
+func newTestLog(t *testing.T, count int) (dir string, offsets []int64) {
+	t.Helper()
+	dir = t.TempDir()
+	st, err := NewDurableInmemStore(dir, &DurableOptions{SnapshotInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		fi, err := os.Stat(filepath.Join(dir, walFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, fi.Size())
+		if err := st.Save(&productws.Product{Name: "p", Desc: "d"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, append(offsets, fi.Size())
+}
+
+// modifyLog modifies the log file in dir with f.
+func modifyLog(t *testing.T, dir string, f func(f *os.File)) {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f(file)
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayRecovery(t *testing.T) {
+	cases := []struct {
+		name    string
+		modify  func(f *os.File, offsets []int64)
+		expErr  bool
+		expLoad int // Expected number of products if no error
+	}{
+		{"intact", func(f *os.File, offsets []int64) {}, false, 5},
+		{"truncated last record", func(f *os.File, offsets []int64) {
+			f.Truncate(offsets[5] - 3)
+		}, false, 4},
+		{"truncated header", func(f *os.File, offsets []int64) {
+			f.Truncate(offsets[4] + 5)
+		}, false, 4},
+		{"corrupt last payload", func(f *os.File, offsets []int64) {
+			f.WriteAt([]byte{'X'}, offsets[5]-2)
+		}, false, 4},
+		{"zero-filled tail", func(f *os.File, offsets []int64) {
+			f.WriteAt(make([]byte, 4096), offsets[5])
+		}, false, 5},
+		{"zero-filled last record", func(f *os.File, offsets []int64) {
+			f.WriteAt(make([]byte, offsets[5]-offsets[4]+100), offsets[4])
+		}, false, 4},
+		{"corrupt payload mid-log", func(f *os.File, offsets []int64) {
+			f.WriteAt([]byte{'X'}, offsets[2]-2)
+		}, true, 0},
+		{"corrupt length mid-log", func(f *os.File, offsets []int64) {
+			f.WriteAt([]byte{0x10}, offsets[1]+1) // Runs past the end of the log
+		}, true, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, offsets := newTestLog(t, 5)
+			modifyLog(t, dir, func(f *os.File) { c.modify(f, offsets) })
+
+			st, err := NewDurableInmemStore(dir, &DurableOptions{SnapshotInterval: -1})
+			if c.expErr {
+				if err == nil {
+					st.(io.Closer).Close()
+					t.Fatal("Expected error, got none")
+				}
+				fi, err := os.Stat(filepath.Join(dir, walFile))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() != offsets[5] {
+					t.Errorf("Corrupt log was modified, size: %d, expected: %d", fi.Size(), offsets[5])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer st.(io.Closer).Close()
+
+			ids, _ := st.AllIDs()
+			if len(ids) != c.expLoad {
+				t.Errorf("Expected %d products, got: %d", c.expLoad, len(ids))
+			}
+
+			// The log must be usable after recovery:
+			p := &productws.Product{Name: "new", Desc: "d"}
+			if err := st.Save(p); err != nil {
+				t.Fatalf("Save after recovery failed: %v", err)
+			}
+			if p.ID != productws.ID(c.expLoad+1) {
+				t.Errorf("Expected ID %d, got: %d", c.expLoad+1, p.ID)
+			}
+		})
+	}
+}
+
+func TestFailedLog(t *testing.T) {
+	st, err := NewDurableInmemStore(t.TempDir(), &DurableOptions{SnapshotInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := st.(*inmemStore)
+	defer s.Close()
+
+	if err := s.Save(&productws.Product{Name: "p1", Desc: "d"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.wal.f.Close() // Make writing the log fail
+	p2 := &productws.Product{Name: "p2", Desc: "d"}
+	if err := s.Save(p2); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if p2.ID != 0 {
+		t.Errorf("Expected ID to be reset, got: %d", p2.ID)
+	}
+
+	// The record of p2 may be in the log: its ID must not be reused
+	if err := s.Save(&productws.Product{Name: "p3", Desc: "d"}); err != ErrFailed {
+		t.Errorf("Expected ErrFailed, got: %v", err)
+	}
+	if err := s.Ping(nil); err != ErrFailed {
+		t.Errorf("Expected ErrFailed from Ping, got: %v", err)
+	}
+}
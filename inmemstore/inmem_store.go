@@ -2,10 +2,14 @@
 
 Package inmemstore contains an in-memory Store implementation, safe for concurrent use.
 
+Optionally the store can be made durable with a write-ahead log and snapshots,
+see NewDurableInmemStore().
+
 */
 package inmemstore
 
 import (
+	"context"
 	"github.com/icza/productws"
 	"sync"
 )
@@ -20,6 +24,9 @@ type inmemStore struct {
 
 	// Id counter to generate new ids
 	idCounter productws.ID
+
+	// Optional write-ahead log making the store durable
+	wal *wal
 }
 
 // NewInmemStore returns a new in-memory Store implementation.
@@ -53,7 +60,8 @@ func (s *inmemStore) Save(p *productws.Product) error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	if p.ID == 0 {
+	isNew := p.ID == 0
+	if isNew {
 		// Generate id for new product
 		s.idCounter++
 		p.ID = s.idCounter
@@ -64,7 +72,18 @@ func (s *inmemStore) Save(p *productws.Product) error {
 		}
 	}
 
-	s.m[p.ID] = p.Clone() // Clone to be safe!
+	p2 := p.Clone() // Clone to be safe!
+	if s.wal != nil {
+		if err := s.wal.append(p2); err != nil {
+			if isNew {
+				s.idCounter--
+				p.ID = 0
+			}
+			return err
+		}
+	}
+
+	s.m[p.ID] = p2
 	return nil
 }
 
@@ -81,3 +100,57 @@ func (s *inmemStore) Load(id productws.ID) (*productws.Product, error) {
 
 	return p.Clone(), nil // Clone to be safe!
 }
+
+// Put implements productws.Putter.
+// The ID counter is advanced past p.ID, so generated IDs will not collide.
+func (s *inmemStore) Put(p *productws.Product) error {
+	if p.ID == 0 {
+		return productws.ErrInvalidId
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	p2 := p.Clone() // Clone to be safe!
+	if s.wal != nil {
+		if err := s.wal.append(p2); err != nil {
+			return err
+		}
+	}
+
+	if p.ID > s.idCounter {
+		s.idCounter = p.ID
+	}
+	s.m[p.ID] = p2
+	return nil
+}
+
+// Ping implements productws.Pinger.
+// Returns ErrClosed if the store is durable (see NewDurableInmemStore()) and it is closed,
+// ErrFailed if its write-ahead log failed.
+func (s *inmemStore) Ping(ctx context.Context) error {
+	if s.wal == nil {
+		return nil
+	}
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if s.wal.closed {
+		return ErrClosed
+	}
+	if s.wal.failed != nil {
+		return ErrFailed
+	}
+	return nil
+}
+
+// Close implements io.Closer.
+// Closes the write-ahead log of a durable store (see NewDurableInmemStore()),
+// no-op for non-durable stores.
+func (s *inmemStore) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.close(s)
+}
@@ -0,0 +1,23 @@
+package inmemstore
+
+import (
+	"github.com/icza/productws"
+	"github.com/icza/productws/storetest"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) productws.Store {
+		return NewInmemStore()
+	})
+}
+
+func TestDurableStore(t *testing.T) {
+	storetest.TestStore(t, func(t *testing.T) productws.Store {
+		st, err := NewDurableInmemStore(t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	})
+}
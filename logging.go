@@ -0,0 +1,128 @@
+/*
+
+Structured logging and request IDs.
+
+*/
+
+package productws
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader is the HTTP header carrying the request ID.
+// An incoming request ID is honored (if valid), else a new one is generated.
+// The request ID is sent back in the response, and is included in all log records of the request.
+const RequestIDHeader = "X-Request-ID"
+
+// Max length of incoming request IDs
+const maxRequestIDLen = 128
+
+// Logger to use
+var logger = slog.Default()
+
+// SetLogger sets the logger used by the API calls and the service.
+// slog.Default() is used by default.
+// Must be done prior to starting the web service.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Logger returns the logger set by SetLogger().
+// Implementation subpackages (e.g. storemw, htpasswd) log with it.
+func Logger() *slog.Logger {
+	return logger
+}
+
+// requestIDOf returns the request ID of a request: the value of the RequestIDHeader
+// if it is valid (at most 128 printable ASCII characters), else a newly generated ID.
+func requestIDOf(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen {
+		return newRandomID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newRandomID()
+		}
+	}
+	return id
+}
+
+// newCallInfo returns a new callInfo for a request of the specified operation,
+// with a logger which adds the request ID and the operation to log records.
+// If tracing is enabled, the span of the call is started, and its trace ID is also
+// added to log records.
+func newCallInfo(r *http.Request, op string) *callInfo {
+	ci := &callInfo{caller: callerOf(r), reqID: requestIDOf(r)}
+	ci.log = logger.With("requestID", ci.reqID, "op", op)
+
+	if ci.span = startSpan(nil, r, "productws."+op, SpanKindServer); ci.span != nil {
+		ci.span.SetAttr("http.method", r.Method)
+		ci.span.SetAttr("http.target", r.URL.Path)
+		ci.span.SetAttr("productws.op", op)
+		ci.span.SetAttr("productws.request_id", ci.reqID)
+		ci.log = ci.log.With("traceID", ci.span.TraceID.String())
+	}
+	return ci
+}
+
+// withCallInfo returns a shallow copy of r whose context carries ci and the span of ci.
+func withCallInfo(r *http.Request, ci *callInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), callInfoKey{}, ci)
+	if ci.span != nil {
+		ctx = context.WithValue(ctx, spanKey{}, ci.span)
+	}
+	return r.WithContext(ctx)
+}
+
+// endCallSpan ends the span of a call (if tracing is enabled).
+// status is the HTTP status code of the response (0 if unknown), jsonResp is the sent JSON response.
+func endCallSpan(ci *callInfo, status int, jsonResp *JSONResp) {
+	if ci.span == nil {
+		return
+	}
+	if status != 0 {
+		ci.span.SetAttr("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			ci.span.SetError(http.StatusText(status))
+		}
+	}
+	if jsonResp != nil {
+		ci.span.SetAttr("productws.success", jsonResp.Success)
+		if jsonResp.Error == MsgGeneralStoreErr {
+			ci.span.SetError(jsonResp.Error)
+		}
+	}
+	if ci.productID != 0 {
+		ci.span.SetAttr("productws.product_id", int64(ci.productID))
+	}
+	ci.span.finish()
+}
+
+// logOf returns the logger of an API call request.
+func logOf(r *http.Request) *slog.Logger {
+	return callInfoOf(r).log
+}
+
+// accessLog logs a served API call.
+func accessLog(r *http.Request, ci *callInfo, rw *recordingResponseWriter, jsonResp *JSONResp, start time.Time) {
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", rw.statusCode()),
+		slog.Duration("duration", time.Since(start)),
+		slog.Int("bytes", rw.bytes),
+		slog.String("caller", ci.caller),
+	}
+	if jsonResp != nil {
+		attrs = append(attrs, slog.Bool("success", jsonResp.Success))
+	}
+	if ci.productID != 0 {
+		attrs = append(attrs, slog.Int64("productID", int64(ci.productID)))
+	}
+	ci.log.LogAttrs(r.Context(), slog.LevelInfo, "API call", attrs...)
+}
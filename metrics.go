@@ -0,0 +1,335 @@
+/*
+
+Metrics of the service, exposed in Prometheus text exposition format.
+
+*/
+
+package productws
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets of latencies, in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelString returns the Prometheus label string of label names and values,
+// e.g. `op="create",status="200"`.
+func labelString(names, values []string) string {
+	buf := &strings.Builder{}
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		buf.WriteString(labelEscaper.Replace(values[i]))
+		buf.WriteByte('"')
+	}
+	return buf.String()
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeSample writes a sample line of a metric.
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// valueVec is a counter or gauge metric with labels.
+// Safe for concurrent use.
+type valueVec struct {
+	name, help, typ string
+	labels          []string
+
+	// Mutex to protect concurrent access to vals
+	mux sync.Mutex
+
+	// Values mapped from label string
+	vals map[string]float64
+}
+
+// newCounterVec returns a new counter metric.
+func newCounterVec(name, help string, labels ...string) *valueVec {
+	return &valueVec{name: name, help: help, typ: "counter", labels: labels, vals: map[string]float64{}}
+}
+
+// newGaugeVec returns a new gauge metric.
+func newGaugeVec(name, help string, labels ...string) *valueVec {
+	return &valueVec{name: name, help: help, typ: "gauge", labels: labels, vals: map[string]float64{}}
+}
+
+// add adds delta to the value of the specified label values.
+func (v *valueVec) add(delta float64, labelValues ...string) {
+	ls := labelString(v.labels, labelValues)
+
+	v.mux.Lock()
+	v.vals[ls] += delta
+	v.mux.Unlock()
+}
+
+// writeTo writes the metric in text exposition format.
+func (v *valueVec) writeTo(w io.Writer) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	writeHeader(w, v.name, v.help, v.typ)
+	keys := make([]string, 0, len(v.vals))
+	for ls := range v.vals {
+		keys = append(keys, ls)
+	}
+	sort.Strings(keys)
+	for _, ls := range keys {
+		writeSample(w, v.name, ls, v.vals[ls])
+	}
+}
+
+// histogram is a series of a histogram metric.
+type histogram struct {
+	counts []uint64 // Counts of the buckets (not cumulative)
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram metric with labels.
+// Safe for concurrent use.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // Upper bounds of buckets, sorted
+
+	// Mutex to protect concurrent access to series
+	mux sync.Mutex
+
+	// Series mapped from label string
+	series map[string]*histogram
+}
+
+// newHistogramVec returns a new histogram metric with the default buckets.
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: defaultBuckets, series: map[string]*histogram{}}
+}
+
+// observe records a value of the specified label values.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	ls := labelString(h.labels, labelValues)
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	s := h.series[ls]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[ls] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// writeTo writes the metric in text exposition format.
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for ls := range h.series {
+		keys = append(keys, ls)
+	}
+	sort.Strings(keys)
+	for _, ls := range keys {
+		s := h.series[ls]
+		prefix := ls
+		if prefix != "" {
+			prefix += ","
+		}
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += s.counts[i]
+			writeSample(w, h.name+"_bucket", prefix+`le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`, float64(cum))
+		}
+		writeSample(w, h.name+"_bucket", prefix+`le="+Inf"`, float64(s.count))
+		writeSample(w, h.name+"_sum", ls, s.sum)
+		writeSample(w, h.name+"_count", ls, float64(s.count))
+	}
+}
+
+// Metrics of API calls and the store
+var (
+	requestsTotal = newCounterVec("productws_requests_total",
+		"Number of API requests by operation, HTTP status and success.", "op", "status", "success")
+	requestDuration = newHistogramVec("productws_request_duration_seconds",
+		"Duration of API requests by operation.", "op")
+	requestsInFlight = newGaugeVec("productws_requests_in_flight",
+		"Number of API requests being served by operation.", "op")
+	requestsRejected = newCounterVec("productws_requests_rejected_total",
+		"Number of API requests rejected by rate or concurrency limiting, by operation and reason (rate, apikey or inflight).", "op", "reason")
+
+	storeDuration = newHistogramVec("productws_store_operation_duration_seconds",
+		"Duration of store operations by method.", "method")
+	storeErrors = newCounterVec("productws_store_errors_total",
+		"Number of failed store operations by method (invalid IDs are not counted).", "method")
+)
+
+// recordingResponseWriter is an http.ResponseWriter which records the status code
+// and the number of bytes written, for metrics and access logs.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+// Flush implements http.Flusher if the wrapped writer does.
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// statusCode returns the status code of the response (200 if nothing was written).
+func (w *recordingResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// observeRequest records the metrics of an API request served in d,
+// jsonResp being the sent JSON response (nil if the logic responded otherwise).
+func observeRequest(op string, status int, jsonResp *JSONResp, d time.Duration) {
+	success := status < http.StatusBadRequest
+	if jsonResp != nil {
+		success = jsonResp.Success
+	}
+	requestsTotal.add(1, op, strconv.Itoa(status), strconv.FormatBool(success))
+	requestDuration.observe(d.Seconds(), op)
+}
+
+// ObserveStoreCall records a Store method call in the store operation metrics.
+// The storemw.Prometheus() middleware calls this for each Store method call.
+func ObserveStoreCall(method string, d time.Duration, err error) {
+	storeDuration.observe(d.Seconds(), method)
+	if err != nil && err != ErrInvalidId && err != ErrPutUnsupported {
+		storeErrors.add(1, method)
+	}
+}
+
+// Min interval of recalculating the catalog gauges (which requires loading all products)
+const catalogStatsInterval = 15 * time.Second
+
+// catalogStats holds the cached catalog gauges.
+var catalogStats struct {
+	mux    sync.Mutex
+	at     time.Time      // Time of calculation
+	count  int            // Number of products
+	byCurr map[string]int // Number of products having a price in a currency
+}
+
+// writeCatalogMetrics writes the catalog gauges, recalculating them if needed.
+// Products are read from the innermost store, so scrapes are not recorded in the store metrics
+// (and are not subject to the store middlewares).
+func writeCatalogMetrics(w io.Writer) {
+	if store == nil {
+		return // Store not set yet
+	}
+	st := innermostStore(store)
+
+	cs := &catalogStats
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+
+	if cs.byCurr == nil || time.Since(cs.at) >= catalogStatsInterval {
+		ids, err := st.AllIDs()
+		if err != nil {
+			logger.Error("Error getting product IDs for metrics", "err", err)
+			return
+		}
+		count, byCurr := 0, map[string]int{}
+		for _, id := range ids {
+			p, err := st.Load(id)
+			if err != nil {
+				if err == ErrInvalidId {
+					continue
+				}
+				logger.Error("Error loading product for metrics", "id", id, "err", err)
+				return
+			}
+			count++
+			for curr := range p.Prices {
+				byCurr[curr]++
+			}
+		}
+		cs.at, cs.count, cs.byCurr = time.Now(), count, byCurr
+	}
+
+	writeHeader(w, "productws_products", "Number of products in the catalog.", "gauge")
+	writeSample(w, "productws_products", "", float64(cs.count))
+
+	writeHeader(w, "productws_products_by_currency", "Number of products having a price in a currency.", "gauge")
+	currs := make([]string, 0, len(cs.byCurr))
+	for curr := range cs.byCurr {
+		currs = append(currs, curr)
+	}
+	sort.Strings(currs)
+	for _, curr := range currs {
+		writeSample(w, "productws_products_by_currency", labelString([]string{"currency"}, []string{curr}), float64(cs.byCurr[curr]))
+	}
+}
+
+// metricsHandler serves the metrics in Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use "+http.MethodGet, http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	requestsTotal.writeTo(buf)
+	requestDuration.writeTo(buf)
+	requestsInFlight.writeTo(buf)
+	requestsRejected.writeTo(buf)
+	storeDuration.writeTo(buf)
+	storeErrors.writeTo(buf)
+	writeCatalogMetrics(buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Warn("Failed to send metrics", "err", err)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+
+Rate limiting and concurrency limiting of API calls.
+
+*/
+
+package productws
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MsgRateLimitErr is the error message of calls rejected due to rate limiting.
+const MsgRateLimitErr = "Rate limit exceeded!"
+
+// MsgTooBusyErr is the error message of calls rejected due to the max in-flight limit.
+const MsgTooBusyErr = "Too many requests in flight, try again later!"
+
+// Headers telling the state of rate limits, see https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+const (
+	rateLimitLimitHeader     = "RateLimit-Limit"     // Max burst of calls
+	rateLimitRemainingHeader = "RateLimit-Remaining" // Calls remaining of the burst
+	rateLimitResetHeader     = "RateLimit-Reset"     // Seconds until the full burst is available again
+)
+
+// Limit is a token bucket rate limit.
+type Limit struct {
+	Rate  float64 // Max sustained rate of calls per second, unlimited if 0
+	Burst int     // Max burst of calls, defaults to Rate rounded up
+}
+
+// RateLimitOptions holds options of rate and concurrency limiting.
+type RateLimitOptions struct {
+	Read  Limit // Limit of read (GET) calls of a client
+	Write Limit // Limit of other calls of a client
+
+	// Limits of specific operations (names of API calls), overriding Read and Write
+	Ops map[string]Limit
+
+	// Tells if clients are identified by the identity of the caller (the authenticated principal,
+	// see SetAuthenticator()) instead of their IP address
+	ByIdentity bool
+
+	// Limit of all calls of an IP address before authentication if ByIdentity is true, so unauthenticated
+	// calls and failed authentication attempts are throttled too. If Rate is 0, the Read, Write and Ops
+	// limits are enforced per IP address too; set it higher if many callers share an IP address (e.g. NAT).
+	IP Limit
+
+	// Max number of API calls served concurrently (by all clients), unlimited if 0
+	MaxInFlight int
+
+	// Max number of rate limited clients tracked, default: 10000.
+	// If exceeded, clients having their full burst available are forgotten first.
+	MaxClients int
+}
+
+// rateLimiter limits the rate of API calls of clients, and the number of concurrent calls.
+type rateLimiter struct {
+	opts RateLimitOptions
+
+	inFlight int64 // Number of calls in flight (accessed atomically)
+
+	// Mutex to protect the buckets
+	mux sync.Mutex
+
+	// Rate limiters of clients, mapped from client and limit class
+	buckets map[string]*tokenBucket
+}
+
+// Rate limiter, rate and concurrency limiting is disabled if nil
+var rateLimits *rateLimiter
+
+// SetRateLimits enables rate and concurrency limiting of API calls.
+// Disabled by default (and if opts is nil).
+//
+// Calls of a client are limited with token buckets: read (GET) and other calls have separate limits,
+// and limits may be specified for individual operations (such calls are not counted in the read
+// or write limits). Calls exceeding a limit, and calls arriving when MaxInFlight calls are being
+// served, are rejected with 429 Too Many Requests and a Retry-After header.
+// Responses of rate limited calls carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+// The max in-flight limit and limits by IP address are enforced before authentication (so failed
+// authentication attempts are throttled too), limits by identity after it. Limits by identity are
+// complemented by limits by IP address (see RateLimitOptions.IP).
+// Rate limits of API keys are enforced separately, see EnableAPIKeys().
+// Must be done prior to starting the web service.
+func SetRateLimits(opts *RateLimitOptions) {
+	if opts == nil {
+		rateLimits = nil
+		return
+	}
+
+	rl := &rateLimiter{opts: *opts, buckets: map[string]*tokenBucket{}}
+	if rl.opts.MaxClients <= 0 {
+		rl.opts.MaxClients = 10000
+	}
+	rateLimits = rl
+}
+
+// limitOf returns the limit applying to the call, and the name of its class.
+func (rl *rateLimiter) limitOf(ch *callHandler) (l Limit, class string) {
+	if l, ok := rl.opts.Ops[ch.op]; ok {
+		return l, ch.op
+	}
+	if ch.expMethod == http.MethodGet {
+		return rl.opts.Read, "read"
+	}
+	return rl.opts.Write, "write"
+}
+
+// take takes a token for a call of the client, limited by l of the specified class.
+// Returns the JSON response to send if the limit is exceeded, nil otherwise.
+func (rl *rateLimiter) take(w http.ResponseWriter, l Limit, class, client string) *JSONResp {
+	if l.Rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	key := class + " " + client
+
+	rl.mux.Lock()
+	b := rl.buckets[key]
+	if b == nil {
+		if len(rl.buckets) >= rl.opts.MaxClients {
+			rl.sweep(now)
+		}
+		b = newTokenBucket(l.Rate, l.Burst, now)
+		rl.buckets[key] = b
+	}
+	ok, wait := b.take(now)
+	setRateLimitHeaders(w.Header(), b)
+	rl.mux.Unlock()
+
+	if ok {
+		return nil
+	}
+	return tooManyRequests(w, wait, MsgRateLimitErr)
+}
+
+// sweep removes the buckets of clients having their full burst available (such buckets are
+// equivalent to new ones). If that's not enough, arbitrary buckets are removed so 10% of
+// MaxClients is free.
+// Must be called with the mutex held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.full(now) {
+			delete(rl.buckets, key)
+		}
+	}
+	for key := range rl.buckets {
+		if len(rl.buckets) < rl.opts.MaxClients*9/10 {
+			break
+		}
+		delete(rl.buckets, key)
+	}
+}
+
+// acquire acquires a slot for a call if the number of calls in flight is limited.
+// Returns the JSON response to send if no slot is available, nil otherwise;
+// the slot must be released with release() if it was acquired.
+func (rl *rateLimiter) acquire(w http.ResponseWriter) *JSONResp {
+	if rl.opts.MaxInFlight <= 0 {
+		return nil
+	}
+	if atomic.AddInt64(&rl.inFlight, 1) > int64(rl.opts.MaxInFlight) {
+		atomic.AddInt64(&rl.inFlight, -1)
+		return tooManyRequests(w, time.Second, MsgTooBusyErr)
+	}
+	return nil
+}
+
+// release releases the slot of a call acquired by acquire().
+func (rl *rateLimiter) release() {
+	if rl.opts.MaxInFlight > 0 {
+		atomic.AddInt64(&rl.inFlight, -1)
+	}
+}
+
+// limitRate enforces the rate limit of the call if rate limiting is enabled.
+// Limits by IP address are enforced before authentication (authenticated is false),
+// limits by identity after it (authenticated is true, only if ByIdentity is set).
+// Returns the JSON response to send if the limit is exceeded, nil otherwise.
+func limitRate(w http.ResponseWriter, r *http.Request, ch *callHandler, ci *callInfo, authenticated bool) *JSONResp {
+	if rateLimits == nil || authenticated && !rateLimits.opts.ByIdentity {
+		return nil
+	}
+
+	l, class := rateLimits.limitOf(ch)
+	client := remoteIP(r)
+	switch {
+	case authenticated:
+		client = ci.caller
+	case rateLimits.opts.ByIdentity:
+		client = "ip:" + client // Buckets of IP addresses must not be shared with identities
+		if rateLimits.opts.IP.Rate > 0 {
+			l, class = rateLimits.opts.IP, "ip"
+		}
+	}
+	if jsonResp := rateLimits.take(w, l, class, client); jsonResp != nil {
+		ci.log.Warn("Rate limit exceeded", "client", client)
+		requestsRejected.add(1, ch.op, "rate")
+		return jsonResp
+	}
+	return nil
+}
+
+// acquireSlot acquires a slot for the call if the number of calls in flight is limited.
+// Returns a function releasing the slot, and the JSON response to send if no slot is available.
+func acquireSlot(w http.ResponseWriter, ch *callHandler, ci *callInfo) (release func(), jsonResp *JSONResp) {
+	if rateLimits == nil {
+		return func() {}, nil
+	}
+	if jsonResp := rateLimits.acquire(w); jsonResp != nil {
+		ci.log.Warn("Too many requests in flight")
+		requestsRejected.add(1, ch.op, "inflight")
+		return nil, jsonResp
+	}
+	return rateLimits.release, nil
+}
+
+// tokenBucket is a token bucket rate limiter.
+// Not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64   // Tokens added per second
+	burst  float64   // Capacity of the bucket
+	tokens float64   // Available tokens
+	last   time.Time // Time of the last update of tokens
+}
+
+// newTokenBucket returns a new, full token bucket.
+// If burst is not positive, rate rounded up (but at least 1) is used.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// refill adds the tokens accumulated since the last update.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// take takes a token from the bucket if one is available.
+// If not, returns the time until a token becomes available.
+func (b *tokenBucket) take(now time.Time) (ok bool, wait time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full tells if the bucket is full (the full burst is available).
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers telling the state of the bucket,
+// unless the headers already tell a more restrictive state (e.g. of the API key).
+func setRateLimitHeaders(h http.Header, b *tokenBucket) {
+	remaining := int(b.tokens)
+	if v := h.Get(rateLimitRemainingHeader); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n <= remaining {
+			return
+		}
+	}
+
+	reset := int(math.Ceil((b.burst - b.tokens) / b.rate))
+	h.Set(rateLimitLimitHeader, strconv.Itoa(int(b.burst)))
+	h.Set(rateLimitRemainingHeader, strconv.Itoa(remaining))
+	h.Set(rateLimitResetHeader, strconv.Itoa(reset))
+}
+
+// tooManyRequests sets the 429 Too Many Requests status with the Retry-After header,
+// and returns the JSON response with the specified error message.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) *JSONResp {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	return &JSONResp{Error: msg}
+}
@@ -0,0 +1,201 @@
+package productws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Errorf("[take %d] Expected token within burst", i)
+		}
+	}
+	ok, wait := b.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected no token and 500ms wait, got: %v, %v", ok, wait)
+	}
+
+	// Refill: 2 tokens per second
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := b.take(now); !ok {
+		t.Errorf("Expected token after refill")
+	}
+	if ok, _ := b.take(now); ok {
+		t.Errorf("Expected no more tokens")
+	}
+	if b.full(now.Add(time.Second)) {
+		t.Errorf("Expected bucket not to be full after 1s")
+	}
+	if !b.full(now.Add(2 * time.Second)) {
+		t.Errorf("Expected bucket to be full after 2s")
+	}
+	if b.tokens != 3 {
+		t.Errorf("Expected refill to be capped at burst, got: %v", b.tokens)
+	}
+
+	// Default burst: rate rounded up, at least 1
+	for _, c := range []struct {
+		rate float64
+		exp  float64
+	}{{0.5, 1}, {2.5, 3}, {10, 10}} {
+		if b := newTokenBucket(c.rate, 0, now); b.burst != c.exp {
+			t.Errorf("[rate %v] Expected burst %v, got: %v", c.rate, c.exp, b.burst)
+		}
+	}
+}
+
+// limitTestCall performs a call of ch from the IP address as the user (may be empty),
+// returns the response recorder.
+func limitTestCall(ch *callHandler, ip, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(ch.expMethod, "/"+ch.op, nil)
+	r.RemoteAddr = ip + ":1234"
+	if user != "" {
+		r.Header.Set("X-User", user)
+	}
+	r = withCallInfo(r, &callInfo{log: logger})
+	w := httptest.NewRecorder()
+	if jsonResp := ch.call(w, r); jsonResp != nil && !jsonResp.Success {
+		w.Body.WriteString(jsonResp.Error)
+	}
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	defer func(rl *rateLimiter, a Authenticator) { rateLimits, authenticator = rl, a }(rateLimits, authenticator)
+	authenticator = nil
+
+	ok := func(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+		return &JSONResp{Success: true}
+	}
+	list := &callHandler{op: opList, expMethod: http.MethodGet, logic: ok}
+	create := &callHandler{op: opCreate, expMethod: http.MethodPost, logic: ok}
+	restore := &callHandler{op: opRestore, expMethod: http.MethodPost, logic: ok}
+
+	SetRateLimits(&RateLimitOptions{
+		Read:  Limit{Rate: 0.001, Burst: 2},
+		Write: Limit{Rate: 0.001, Burst: 1},
+		Ops:   map[string]Limit{opRestore: {Rate: 0.001, Burst: 1}},
+	})
+
+	cases := []struct {
+		ch      *callHandler
+		ip      string
+		expCode int
+	}{
+		{list, "10.0.0.1", http.StatusOK},
+		{list, "10.0.0.1", http.StatusOK},
+		{list, "10.0.0.1", http.StatusTooManyRequests}, // Read burst exhausted
+		{list, "10.0.0.2", http.StatusOK},              // Other client
+		{create, "10.0.0.1", http.StatusOK},            // Separate write limit
+		{create, "10.0.0.1", http.StatusTooManyRequests},
+		{restore, "10.0.0.1", http.StatusOK}, // Op limit, not counted in write
+		{restore, "10.0.0.1", http.StatusTooManyRequests},
+	}
+	for i, c := range cases {
+		w := limitTestCall(c.ch, c.ip, "")
+		if w.Code != c.expCode {
+			t.Errorf("[%d] Expected status %d, got: %d", i, c.expCode, w.Code)
+		}
+		if w.Header().Get(rateLimitLimitHeader) == "" || w.Header().Get(rateLimitRemainingHeader) == "" {
+			t.Errorf("[%d] Missing RateLimit headers: %v", i, w.Header())
+		}
+		if c.expCode == http.StatusTooManyRequests {
+			if v := w.Header().Get("Retry-After"); v == "" || v == "0" {
+				t.Errorf("[%d] Expected Retry-After, got: %q", i, v)
+			}
+			if body := w.Body.String(); body != MsgRateLimitErr {
+				t.Errorf("[%d] Expected error %q, got: %q", i, MsgRateLimitErr, body)
+			}
+		}
+	}
+
+	w := limitTestCall(list, "10.0.0.3", "")
+	if exp := []string{"2", "1", "1000"}; w.Header().Get(rateLimitLimitHeader) != exp[0] ||
+		w.Header().Get(rateLimitRemainingHeader) != exp[1] || w.Header().Get(rateLimitResetHeader) != exp[2] {
+		t.Errorf("Expected RateLimit headers %v, got: %v", exp, w.Header())
+	}
+}
+
+func TestRateLimitByIdentity(t *testing.T) {
+	defer func(rl *rateLimiter, a Authenticator) { rateLimits, authenticator = rl, a }(rateLimits, authenticator)
+	authenticator = userAuth{}
+
+	list := &callHandler{op: opList, expMethod: http.MethodGet, noAuthz: true,
+		logic: func(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+			return &JSONResp{Success: true}
+		},
+	}
+
+	SetRateLimits(&RateLimitOptions{
+		Read:       Limit{Rate: 0.001, Burst: 1},
+		IP:         Limit{Rate: 0.001, Burst: 3},
+		ByIdentity: true,
+	})
+
+	cases := []struct {
+		ip, user string
+		expCode  int
+	}{
+		{"10.0.0.1", "bob", http.StatusOK},
+		{"10.0.0.1", "bob", http.StatusTooManyRequests},  // Limit of bob
+		{"10.0.0.1", "carol", http.StatusOK},             // Same IP, other identity
+		{"10.0.0.1", "", http.StatusTooManyRequests},     // IP limit exhausted before authentication
+		{"10.0.0.1", "dave", http.StatusTooManyRequests}, // Even for new identities
+		{"10.0.0.2", "bob", http.StatusTooManyRequests},  // Limit of bob from other IP
+		{"10.0.0.2", "", http.StatusUnauthorized},        // Failed authentication counted by IP
+		{"10.0.0.2", "", http.StatusUnauthorized},
+		{"10.0.0.2", "", http.StatusTooManyRequests},
+	}
+	for i, c := range cases {
+		if w := limitTestCall(list, c.ip, c.user); w.Code != c.expCode {
+			t.Errorf("[%d] Expected status %d, got: %d", i, c.expCode, w.Code)
+		}
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	defer func(rl *rateLimiter, a Authenticator) { rateLimits, authenticator = rl, a }(rateLimits, authenticator)
+	authenticator = nil
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	list := &callHandler{op: opList, expMethod: http.MethodGet,
+		logic: func(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+			started <- struct{}{}
+			<-unblock
+			return &JSONResp{Success: true}
+		},
+	}
+
+	SetRateLimits(&RateLimitOptions{MaxInFlight: 2})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limitTestCall(list, "10.0.0.1", "")
+		}()
+		<-started
+	}
+
+	w := limitTestCall(list, "10.0.0.2", "")
+	if w.Code != http.StatusTooManyRequests || w.Body.String() != MsgTooBusyErr || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with %q, got: %d, %q, %v", MsgTooBusyErr, w.Code, w.Body.String(), w.Header())
+	}
+
+	close(unblock)
+	wg.Wait()
+
+	// Slots are released
+	go func() { <-started }()
+	if w := limitTestCall(list, "10.0.0.2", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 after slots are released, got: %d", w.Code)
+	}
+}
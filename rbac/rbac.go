@@ -0,0 +1,179 @@
+/*
+
+Package rbac contains a role-based productws.Authorizer implementation configured from
+a JSON policy file, safe for concurrent use.
+
+Roles grant operations (names of API calls), optionally restricted to products having any of
+the listed tags; users (authenticated principals) are assigned roles. For example:
+
+    {
+        "Roles": {
+            "reader":  {"Ops": ["list", "details", "events"]},
+            "pricing": {"Ops": ["list", "details", "setprices"], "Tags": ["books"]},
+            "admin":   {"Ops": ["*"]}
+        },
+        "Users": {
+            "alice": ["admin"],
+            "bob":   ["reader", "pricing"],
+            "*":     ["reader"]
+        }
+    }
+
+The "*" operation grants all operations, the roles of the "*" user apply to users not listed.
+A user may perform an operation if any of its roles grants it; the permission is restricted
+to tags only if all such roles are restricted (to the union of their tags).
+
+*/
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/icza/productws"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is the default min interval of checking the file for changes.
+const DefaultReloadInterval = 5 * time.Second
+
+// Any matches all operations in Role.Ops, and all users in Policy.Users.
+const Any = "*"
+
+// Role is a named set of permissions.
+type Role struct {
+	Ops  []string // Operations granted by the role
+	Tags []string // Optional tags the granted operations are restricted to
+}
+
+// Policy describes roles and the roles of users.
+type Policy struct {
+	Roles map[string]*Role    // Roles mapped from role name
+	Users map[string][]string // Role names mapped from user
+}
+
+// validate checks if all roles referred by users are defined.
+func (p *Policy) validate() error {
+	for user, roles := range p.Users {
+		for _, name := range roles {
+			if p.Roles[name] == nil {
+				return fmt.Errorf("undefined role %q of user %q", name, user)
+			}
+		}
+	}
+	return nil
+}
+
+// Authorize implements productws.Authorizer.Authorize().
+func (p *Policy) Authorize(caller, op string) (allowed bool, tags []string) {
+	roles, ok := p.Users[caller]
+	if !ok {
+		roles = p.Users[Any]
+	}
+
+	for _, name := range roles {
+		role := p.Roles[name]
+		if role == nil || !role.grants(op) {
+			continue
+		}
+		if len(role.Tags) == 0 {
+			return true, nil // Not restricted
+		}
+		allowed = true
+		tags = append(tags, role.Tags...)
+	}
+	return
+}
+
+// grants tells if the role grants the operation.
+func (r *Role) grants(op string) bool {
+	for _, o := range r.Ops {
+		if o == op || o == Any {
+			return true
+		}
+	}
+	return false
+}
+
+// File is an Authorizer which authorizes calls according to a JSON policy file.
+// The file is reloaded when it changes.
+type File struct {
+	name     string        // Name of the policy file
+	interval time.Duration // Min interval of checking the file for changes
+
+	// Mutex to protect concurrent access to the fields below
+	mux sync.Mutex
+
+	policy    *Policy   // Policy loaded from the file
+	modTime   time.Time // Modification time of the file when loaded
+	lastCheck time.Time // Time of the last check for changes
+}
+
+// NewFile loads the named policy file, and returns an Authorizer which authorizes calls according to it.
+// The file is checked for changes at most every DefaultReloadInterval; if it changes, it is
+// reloaded (if reloading fails, the error is logged and the previous policy stays in effect).
+func NewFile(name string) (*File, error) {
+	f := &File{name: name, interval: DefaultReloadInterval}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(fi.ModTime()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load loads the file.
+// Must be called with the mutex held (or before the File is shared).
+func (f *File) load(modTime time.Time) error {
+	data, err := os.ReadFile(f.name)
+	if err != nil {
+		return err
+	}
+
+	p := new(Policy)
+	if err := json.Unmarshal(data, p); err != nil {
+		return fmt.Errorf("invalid policy file %s: %v", f.name, err)
+	}
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("invalid policy file %s: %v", f.name, err)
+	}
+
+	f.policy, f.modTime, f.lastCheck = p, modTime, time.Now()
+	return nil
+}
+
+// reloadIfChanged reloads the file if it changed since it was loaded.
+// Must be called with the mutex held.
+func (f *File) reloadIfChanged() {
+	if time.Since(f.lastCheck) < f.interval {
+		return
+	}
+	f.lastCheck = time.Now()
+
+	fi, err := os.Stat(f.name)
+	if err != nil {
+		productws.Logger().Error("Failed to check policy file", "file", f.name, "err", err)
+		return
+	}
+	if fi.ModTime().Equal(f.modTime) {
+		return
+	}
+	if err := f.load(fi.ModTime()); err != nil {
+		productws.Logger().Error("Failed to reload policy file, keeping the previous policy", "file", f.name, "err", err)
+		return
+	}
+	productws.Logger().Info("Policy file reloaded", "file", f.name, "roles", len(f.policy.Roles), "users", len(f.policy.Users))
+}
+
+// Authorize implements productws.Authorizer.Authorize().
+func (f *File) Authorize(caller, op string) (allowed bool, tags []string) {
+	f.mux.Lock()
+	f.reloadIfChanged()
+	p := f.policy
+	f.mux.Unlock()
+
+	return p.Authorize(caller, op)
+}
@@ -0,0 +1,124 @@
+package rbac
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testPolicy = `{
+	"Roles": {
+		"reader":  {"Ops": ["list", "details", "events"]},
+		"pricing": {"Ops": ["list", "details", "setprices"], "Tags": ["books"]},
+		"toys":    {"Ops": ["setprices"], "Tags": ["toys"]},
+		"admin":   {"Ops": ["*"]}
+	},
+	"Users": {
+		"alice": ["admin"],
+		"bob":   ["reader", "pricing"],
+		"carol": ["pricing", "toys"],
+		"dave":  [],
+		"*":     ["reader"]
+	}
+}`
+
+// writePolicy writes the policy file with the specified content.
+func writePolicy(t *testing.T, name, content string) {
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "roles.json")
+	writePolicy(t, name, testPolicy)
+	f, err := NewFile(name)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	cases := []struct {
+		caller, op string
+		expAllowed bool
+		expTags    []string
+	}{
+		{"alice", "create", true, nil},
+		{"alice", "restore", true, nil},
+		{"bob", "list", true, nil},                    // Unrestricted by reader, even though pricing is restricted
+		{"bob", "setprices", true, []string{"books"}}, // Only pricing grants it
+		{"bob", "create", false, nil},
+		{"bob", "addapikey", false, nil},
+		{"carol", "list", true, []string{"books"}},
+		{"carol", "setprices", true, []string{"books", "toys"}}, // Union of the restricted roles
+		{"carol", "events", false, nil},
+		{"dave", "list", false, nil}, // Listed without roles: the "*" roles don't apply
+		{"eve", "events", true, nil}, // Not listed: has the "*" roles
+		{"eve", "update", false, nil},
+		{"", "list", true, nil},
+	}
+
+	for _, c := range cases {
+		allowed, tags := f.Authorize(c.caller, c.op)
+		sort.Strings(tags)
+		if allowed != c.expAllowed || !reflect.DeepEqual(tags, c.expTags) {
+			t.Errorf("[%s, %s] Expected: %v, %v, got: %v, %v", c.caller, c.op, c.expAllowed, c.expTags, allowed, tags)
+		}
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{
+		`{"Roles": {}, "Users": {"bob": ["reader"]}}`, // Undefined role
+		`{"Roles": `,
+		`[]`,
+	} {
+		name := filepath.Join(dir, "roles.json")
+		writePolicy(t, name, content)
+		if _, err := NewFile(name); err == nil {
+			t.Errorf("Expected error for policy: %s", content)
+		}
+	}
+
+	if _, err := NewFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
+
+func TestReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "roles.json")
+	writePolicy(t, name, testPolicy)
+	f, err := NewFile(name)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	f.interval = 0
+
+	// touch writes the policy with a new modification time.
+	mod := time.Now()
+	touch := func(content string) {
+		writePolicy(t, name, content)
+		mod = mod.Add(time.Second)
+		os.Chtimes(name, mod, mod)
+	}
+
+	touch(`{"Roles": {"reader": {"Ops": ["list"]}}, "Users": {"bob": ["reader"]}}`)
+	if allowed, _ := f.Authorize("bob", "setprices"); allowed {
+		t.Errorf("Expected revoked permission to be denied after reload")
+	}
+	if allowed, _ := f.Authorize("bob", "list"); !allowed {
+		t.Errorf("Expected permission to be allowed after reload")
+	}
+
+	// Invalid policy: the previous one stays in effect
+	touch(`{"Roles": {}, "Users": {"bob": ["admin"]}}`)
+	if allowed, _ := f.Authorize("bob", "list"); !allowed {
+		t.Errorf("Expected previous policy to stay in effect")
+	}
+	if allowed, _ := f.Authorize("bob", "create"); allowed {
+		t.Errorf("Expected invalid policy not to be loaded")
+	}
+}
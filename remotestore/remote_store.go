@@ -0,0 +1,100 @@
+/*
+
+Package remotestore contains a Store implementation which stores products
+in another productws instance (by calling its API), safe for concurrent use.
+
+It can be used to build gateway or edge nodes which proxy to a primary node.
+
+Note that the audit metadata of products (CreatedAt, UpdatedAt, UpdatedBy) is managed
+by the primary node, so UpdatedBy will identify the node using the remote store.
+
+*/
+package remotestore
+
+import (
+	"context"
+	"github.com/icza/productws"
+	"github.com/icza/productws/client"
+	"net/http"
+	"time"
+)
+
+// Options holds options of the remote store.
+type Options struct {
+	Timeout     time.Duration // Timeout of each request, default: 10s
+	Retries     int           // Retries of failed idempotent requests, default: 2
+	MaxIdleConn int           // Max idle (pooled) connections to the remote node, default: 32
+
+	// Optional function to prepare requests before sending them, e.g. to add
+	// authentication headers.
+	PrepareRequest func(r *http.Request)
+}
+
+// remoteStore is a Store implementation which calls the API of a remote productws instance.
+type remoteStore struct {
+	// Client of the remote node
+	c *client.Client
+}
+
+// NewRemoteStore returns a new Store implementation which stores products in the
+// productws instance available at baseURL (e.g. "http://primary:8081").
+// opts is optional, defaults are used for zero values.
+// Safe for concurrent use.
+func NewRemoteStore(baseURL string, opts *Options) productws.Store {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.Retries <= 0 {
+		o.Retries = 2
+	}
+	if o.MaxIdleConn <= 0 {
+		o.MaxIdleConn = 32
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = o.MaxIdleConn
+	transport.MaxIdleConnsPerHost = o.MaxIdleConn
+
+	c := client.New(baseURL)
+	c.HTTPClient = &http.Client{Timeout: o.Timeout, Transport: transport}
+	c.Retries = o.Retries
+	c.PrepareRequest = o.PrepareRequest
+
+	return &remoteStore{c: c}
+}
+
+// AllIDs implements Store.AllIDs().
+func (s *remoteStore) AllIDs() ([]productws.ID, error) {
+	return s.c.List(context.Background(), nil)
+}
+
+// Save implements Store.Save().
+// If p.ID is 0, the product is created remotely and the new ID is set.
+// productws.ErrInvalidId is returned if p.ID is not 0 but no product exists with that ID.
+func (s *remoteStore) Save(p *productws.Product) error {
+	if p.ID == 0 {
+		id, err := s.c.Create(context.Background(), p)
+		if err != nil {
+			return err
+		}
+		p.ID = id
+		return nil
+	}
+
+	return s.c.Update(context.Background(), p)
+}
+
+// Load implements Store.Load().
+// productws.ErrInvalidId is returned if no product exists with the specified ID.
+func (s *remoteStore) Load(id productws.ID) (*productws.Product, error) {
+	return s.c.Details(context.Background(), id)
+}
+
+// Ping implements productws.Pinger, checks if the remote node is ready.
+func (s *remoteStore) Ping(ctx context.Context) error {
+	return s.c.Ready(ctx)
+}
@@ -0,0 +1,187 @@
+/*
+
+Catalog snapshots: dumping and restoring the contents of a Store.
+
+*/
+
+package productws
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Snapshot format identifier and schema version written in the snapshot header
+const (
+	SnapshotFormat  = "productws-snapshot"
+	SnapshotVersion = 1
+)
+
+// SnapshotHeader is the first line of a snapshot.
+// The header is followed by one JSON product per line.
+type SnapshotHeader struct {
+	Format  string    // Format identifier, always SnapshotFormat
+	Version int       // Schema version
+	Created time.Time // Time of creating the snapshot
+}
+
+// Putter is an optional interface of Store implementations which can save
+// products with their IDs preserved (e.g. to restore snapshots).
+type Putter interface {
+	// Put saves a product as-is, with its ID (which must not be 0).
+	// An existing product with the same ID is replaced.
+	// IDs generated later by Save must not collide with IDs of put products.
+	Put(p *Product) error
+}
+
+// ErrPutUnsupported is returned if a store does not implement Putter.
+var ErrPutUnsupported = errors.New("Store does not support saving products with their IDs")
+
+// Dump writes a snapshot of all products of the store to w.
+// The snapshot starts with a SnapshotHeader line, followed by one JSON product per line
+// in ID order (so it can be streamed and processed line by line).
+func Dump(st Store, w io.Writer) error {
+	ids, err := st.AllIDs()
+	if err != nil {
+		return err
+	}
+	sortIDs(ids)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw) // Encode writes a newline after each value
+	if err := enc.Encode(&SnapshotHeader{Format: SnapshotFormat, Version: SnapshotVersion, Created: time.Now()}); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		p, err := st.Load(id)
+		if err != nil {
+			if err == ErrInvalidId {
+				continue // Product removed in the mean time
+			}
+			return err
+		}
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Restore loads a snapshot written by Dump into the store, preserving product IDs.
+// The store must implement Putter, else ErrPutUnsupported is returned.
+// All products are read and validated before the first one is saved, so an invalid snapshot
+// leaves the store unchanged. Returns the number of restored products.
+func Restore(r io.Reader, st Store) (int, error) {
+	putter, ok := st.(Putter)
+	if !ok {
+		return 0, ErrPutUnsupported
+	}
+	return restore(r, putter.Put)
+}
+
+// restore implements Restore, saving the products with put.
+func restore(r io.Reader, put func(p *Product) error) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	h := new(SnapshotHeader)
+	if err := dec.Decode(h); err != nil {
+		return 0, fmt.Errorf("invalid snapshot header: %v", err)
+	}
+	if h.Format != SnapshotFormat {
+		return 0, fmt.Errorf("not a snapshot (format: %q)", h.Format)
+	}
+	if h.Version < 1 || h.Version > SnapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version: %d", h.Version)
+	}
+
+	var ps []*Product
+	ids := map[ID]bool{}
+	for {
+		p := new(Product)
+		if err := dec.Decode(p); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, fmt.Errorf("invalid product #%d: %v", len(ps)+1, err)
+		}
+		if p.ID == 0 {
+			return 0, fmt.Errorf("invalid product #%d: missing ID", len(ps)+1)
+		}
+		if ids[p.ID] {
+			return 0, fmt.Errorf("invalid product #%d: duplicate ID: %d", len(ps)+1, p.ID)
+		}
+		if msg := p.Validate(); msg != "" {
+			return 0, fmt.Errorf("invalid product #%d (ID: %d): %s", len(ps)+1, p.ID, msg)
+		}
+		ids[p.ID] = true
+		ps = append(ps, p)
+	}
+
+	for i, p := range ps {
+		if err := put(p); err != nil {
+			return i, err
+		}
+	}
+	return len(ps), nil
+}
+
+// dumpLogic implements the admin call dumping a snapshot of the catalog.
+// The snapshot is sent as the response, not a JSONResp (unless there is an error).
+func dumpLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	// Check the store before sending anything, so errors can still be reported in a JSONResp
+	st := storeOf(r)
+	if _, err := st.AllIDs(); err != nil {
+		logOf(r).Error("Error getting all product IDs", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="catalog.snapshot"`)
+	if err := Dump(st, w); err != nil {
+		// Response is already being sent, can only log
+		logOf(r).Error("Error dumping snapshot", "err", err)
+	}
+	return nil
+}
+
+// restoreLogic implements the admin call restoring a snapshot.
+// Expects the request body to be the snapshot.
+// Events are published for the restored products, and their changes are audited.
+func restoreLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	ci := callInfoOf(r)
+	st := storeOf(r)
+	putter, ok := st.(Putter)
+	if !ok {
+		return &JSONResp{Error: "Restore failed: " + ErrPutUnsupported.Error()}
+	}
+
+	now := time.Now()
+	count, err := restore(r.Body, func(p *Product) error {
+		evType := EventUpdated
+		before, err := st.Load(p.ID)
+		if err == ErrInvalidId {
+			evType, before = EventCreated, nil
+		} else if err != nil {
+			return err
+		}
+		if err := putter.Put(p); err != nil {
+			return err
+		}
+		eventBus.publish(evType, before, p)
+		ci.changes = append(ci.changes, productChange{before: before, after: p.Clone(), at: now})
+		return nil
+	})
+	if err != nil {
+		logOf(r).Error("Error restoring snapshot", "err", err)
+		return &JSONResp{Error: "Restore failed: " + err.Error(), Data: struct{ Count int }{count}}
+	}
+
+	return &JSONResp{Success: true, Data: struct{ Count int }{count}}
+}
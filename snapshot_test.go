@@ -0,0 +1,131 @@
+package productws_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/icza/productws"
+	"github.com/icza/productws/auditsink"
+	"github.com/icza/productws/inmemstore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotOf returns a snapshot of the products.
+func snapshotOf(t *testing.T, ps ...*productws.Product) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.Encode(&productws.SnapshotHeader{Format: productws.SnapshotFormat, Version: productws.SnapshotVersion})
+	for _, p := range ps {
+		if err := enc.Encode(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func testProduct(id productws.ID, name string) *productws.Product {
+	return &productws.Product{ID: id, Name: name, Desc: "d", Prices: map[string]productws.Price{"USD": {Value: 1, Multiplier: 1}}}
+}
+
+func TestRestoreValidatesFirst(t *testing.T) {
+	cases := []struct {
+		name   string
+		ps     []*productws.Product
+		expErr string
+	}{
+		{"invalid last", []*productws.Product{testProduct(1, "a"), testProduct(2, "b"), testProduct(3, "")},
+			"invalid product #3 (ID: 3): Name must be specified!"},
+		{"missing ID", []*productws.Product{testProduct(1, "a"), testProduct(0, "b")},
+			"invalid product #2: missing ID"},
+		{"duplicate ID", []*productws.Product{testProduct(1, "a"), testProduct(1, "b")},
+			"invalid product #2: duplicate ID: 1"},
+	}
+
+	for _, c := range cases {
+		st := inmemstore.NewInmemStore()
+		count, err := productws.Restore(strings.NewReader(snapshotOf(t, c.ps...)), st)
+		if err == nil || err.Error() != c.expErr {
+			t.Errorf("[%s] Expected error %q, got: %v", c.name, c.expErr, err)
+		}
+		if ids, _ := st.AllIDs(); count != 0 || len(ids) != 0 {
+			t.Errorf("[%s] Expected nothing restored, got count: %d, IDs: %v", c.name, count, ids)
+		}
+	}
+}
+
+func TestRestoreLogicEvents(t *testing.T) {
+	st := inmemstore.NewInmemStore()
+	if err := st.Save(testProduct(0, "old")); err != nil { // Gets ID 1
+		t.Fatal(err)
+	}
+	defer func(st productws.Store, b *productws.EventBus) {
+		productws.SetStore(st)
+		productws.SetEventBus(b)
+	}(productws.CurrentStore(), productws.Events())
+	productws.SetStore(st)
+	bus := productws.NewEventBus(10)
+	productws.SetEventBus(bus)
+
+	body := snapshotOf(t, testProduct(1, "restored"), testProduct(5, "new"))
+	r := httptest.NewRequest(http.MethodPost, "/admin/restore", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, r)
+	if !strings.Contains(rec.Body.String(), `"Success":true`) {
+		t.Fatalf("Restore failed: %s", rec.Body)
+	}
+
+	_, events, _, cancel := bus.Subscribe(0)
+	cancel()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got: %d", len(events))
+	}
+	if e := events[0]; e.Type != productws.EventUpdated || e.ID != 1 || e.Product.Name != "restored" {
+		t.Errorf("Expected updated event of product 1, got: %+v", e)
+	}
+	if e := events[1]; e.Type != productws.EventCreated || e.ID != 5 {
+		t.Errorf("Expected created event of product 5, got: %+v", e)
+	}
+}
+
+func TestRestoreLogicAudit(t *testing.T) {
+	st := inmemstore.NewInmemStore()
+	if err := st.Save(testProduct(0, "old")); err != nil { // Gets ID 1
+		t.Fatal(err)
+	}
+	defer func(st productws.Store, s productws.AuditSink) {
+		productws.SetStore(st)
+		productws.SetAuditSink(s)
+	}(productws.CurrentStore(), productws.CurrentAuditSink())
+	productws.SetStore(st)
+	sink := auditsink.NewMemSink()
+	productws.SetAuditSink(sink)
+
+	start := time.Now()
+	body := snapshotOf(t, testProduct(1, "restored"), testProduct(5, "new"))
+	r := httptest.NewRequest(http.MethodPost, "/admin/restore", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, r)
+	if !strings.Contains(rec.Body.String(), `"Success":true`) {
+		t.Fatalf("Restore failed: %s", rec.Body)
+	}
+
+	es, err := sink.Query(&productws.AuditFilter{Op: "restore"})
+	if err != nil || len(es) != 2 {
+		t.Fatalf("Expected 2 audit entries, got: %d, %v", len(es), err)
+	}
+	if e := es[0]; e.ID != 1 || e.Before == nil || e.Before.Name != "old" || e.After.Name != "restored" {
+		t.Errorf("Expected entry of updating product 1, got: %+v", e)
+	}
+	if e := es[1]; e.ID != 5 || e.Before != nil || e.After.Name != "new" {
+		t.Errorf("Expected entry of creating product 5, got: %+v", e)
+	}
+	for _, e := range es {
+		if e.Time.Before(start) {
+			t.Errorf("Expected time of the restore, got: %v", e.Time)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+/*
+
+Package spanexport contains productws.SpanExporter implementations, safe for concurrent use.
+
+*/
+package spanexport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/icza/productws"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MemExporter is an in-memory span exporter, useful for tests.
+// Safe for concurrent use.
+type MemExporter struct {
+	// Exported spans in order of export
+	spans []*productws.Span
+
+	// Mutex to protect concurrent access to the exporter
+	mux sync.Mutex
+}
+
+// NewMemExporter returns a new in-memory span exporter.
+func NewMemExporter() *MemExporter {
+	return &MemExporter{}
+}
+
+// ExportSpan implements SpanExporter.ExportSpan().
+func (e *MemExporter) ExportSpan(s *productws.Span) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	e.spans = append(e.spans, s)
+}
+
+// Spans returns the exported spans in order of export.
+func (e *MemExporter) Spans() []*productws.Span {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	return append([]*productws.Span(nil), e.spans...)
+}
+
+// Reset removes all exported spans.
+func (e *MemExporter) Reset() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	e.spans = nil
+}
+
+// FileExporter is a span exporter which appends spans to a file in the
+// OTLP/JSON format (the format of the OpenTelemetry Collector file exporter):
+// one JSON ExportTraceServiceRequest per line, each holding a single span.
+// Safe for concurrent use.
+type FileExporter struct {
+	// Name of the service, recorded as the service.name resource attribute
+	service string
+
+	// The file to write spans to
+	f *os.File
+
+	// Mutex to serialize writes
+	mux sync.Mutex
+}
+
+// NewFileExporter returns a new FileExporter which appends spans to the named file,
+// creating it if it does not exist. service is recorded as the service.name resource attribute.
+func NewFileExporter(name, service string) (*FileExporter, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{service: service, f: f}, nil
+}
+
+// ExportSpan implements SpanExporter.ExportSpan().
+// Write errors are logged.
+func (e *FileExporter) ExportSpan(s *productws.Span) {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{{"service.name", otlpValue{StringValue: &e.service}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/icza/productws"},
+			Spans: []otlpSpan{toOTLP(s)},
+		}},
+	}}}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		productws.Logger().Error("Failed to encode span", "traceID", s.TraceID.String(), "err", err)
+		return
+	}
+	data = append(data, '\n')
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if _, err := e.f.Write(data); err != nil {
+		productws.Logger().Error("Failed to write span", "file", e.f.Name(), "err", err)
+	}
+}
+
+// Close closes the file of the exporter.
+func (e *FileExporter) Close() error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	return e.f.Close()
+}
+
+// Types of the OTLP/JSON encoding of spans.
+// IDs are hex encoded, int64 values and timestamps are encoded as decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Flags             uint32         `json:"flags,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+
+	otlpStatusError = 2
+)
+
+// toOTLP converts a span to its OTLP/JSON representation.
+func toOTLP(s *productws.Span) otlpSpan {
+	sp := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Flags:             uint32(s.Flags),
+		Name:              s.Name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+	}
+	if s.ParentID != (productws.SpanID{}) {
+		sp.ParentSpanID = s.ParentID.String()
+	}
+	if s.Kind == productws.SpanKindServer {
+		sp.Kind = otlpKindServer
+	}
+	if s.Error != "" {
+		sp.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+	}
+
+	keys := make([]string, 0, len(s.Attributes))
+	for k := range s.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var v otlpValue
+		switch a := s.Attributes[k].(type) {
+		case string:
+			v.StringValue = &a
+		case bool:
+			v.BoolValue = &a
+		case int:
+			i := strconv.Itoa(a)
+			v.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(a, 10)
+			v.IntValue = &i
+		case float64:
+			v.DoubleValue = &a
+		default:
+			str := fmt.Sprint(a)
+			v.StringValue = &str
+		}
+		sp.Attributes = append(sp.Attributes, otlpKeyValue{k, v})
+	}
+
+	return sp
+}
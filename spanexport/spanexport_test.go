@@ -0,0 +1,114 @@
+package spanexport
+
+import (
+	"encoding/json"
+	"github.com/icza/productws"
+	"github.com/icza/productws/inmemstore"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID = "00f067aa0ba902b7"
+)
+
+// call performs an API call with the traceparent header through the registered handlers.
+func call(t *testing.T, path, traceparent string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set(productws.TraceparentHeader, traceparent)
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Call %s failed with status %d: %s", path, rec.Code, rec.Body)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	e := NewMemExporter()
+	productws.SetSpanExporter(e)
+	defer productws.SetSpanExporter(nil)
+	productws.SetStore(inmemstore.NewInmemStore())
+
+	for _, flags := range []string{"01", "00"} {
+		e.Reset()
+		call(t, "/list", "00-"+testTraceID+"-"+testParentID+"-"+flags)
+
+		spans := e.Spans()
+		var server *productws.Span
+		for _, s := range spans {
+			if s.Kind == productws.SpanKindServer {
+				server = s
+			}
+		}
+		if server == nil {
+			t.Fatalf("[flags: %s] No server span exported", flags)
+		}
+		if server.TraceID.String() != testTraceID || server.ParentID.String() != testParentID {
+			t.Errorf("[flags: %s] Server span does not continue the trace: %s %s", flags, server.TraceID, server.ParentID)
+		}
+		if tp := server.Traceparent(); !strings.HasSuffix(tp, "-"+flags) {
+			t.Errorf("[flags: %s] Flags not propagated, traceparent: %s", flags, tp)
+		}
+
+		children := 0
+		for _, s := range spans {
+			if s == server {
+				continue
+			}
+			children++
+			if s.TraceID != server.TraceID || s.ParentID != server.SpanID || s.Flags != server.Flags {
+				t.Errorf("[flags: %s] Store span %q is not a child of the server span", flags, s.Name)
+			}
+		}
+		if children == 0 {
+			t.Errorf("[flags: %s] No store spans exported", flags)
+		}
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "spans.json")
+	e, err := NewFileExporter(name, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	productws.SetSpanExporter(e)
+	defer productws.SetSpanExporter(nil)
+	productws.SetStore(inmemstore.NewInmemStore())
+
+	call(t, "/list", "00-"+testTraceID+"-"+testParentID+"-01")
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var req otlpRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatalf("Invalid line %q: %v", line, err)
+		}
+		sp := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		if sp.TraceID != testTraceID || sp.Flags != 1 {
+			t.Errorf("Unexpected span: %+v", sp)
+		}
+		if sp.Kind == otlpKindServer {
+			found = true
+			if sp.ParentSpanID != testParentID {
+				t.Errorf("Expected parent span ID %s, got: %s", testParentID, sp.ParentSpanID)
+			}
+		}
+	}
+	if !found {
+		t.Error("No server span exported")
+	}
+}
@@ -0,0 +1,330 @@
+/*
+
+Built-in middlewares.
+
+*/
+
+package storemw
+
+import (
+	"errors"
+	"github.com/icza/productws"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// isFailure tells if err is a failure of the store.
+// productws.ErrInvalidId and productws.ErrPutUnsupported are valid outcomes, not failures.
+func isFailure(err error) bool {
+	return err != nil && err != productws.ErrInvalidId && err != productws.ErrPutUnsupported
+}
+
+// Timing returns a Middleware which measures the duration of Store method calls,
+// and reports them to observe.
+func Timing(observe func(c Call, d time.Duration, err error)) Middleware {
+	return Intercept(func(c Call, invoke func() error) error {
+		start := time.Now()
+		err := invoke()
+		observe(c, time.Since(start), err)
+		return err
+	})
+}
+
+// MethodStats holds statistics of a Store method.
+type MethodStats struct {
+	Calls  uint64        // Number of calls
+	Errors uint64        // Number of failed calls (productws.ErrInvalidId is not a failure)
+	Total  time.Duration // Total duration of the calls
+	Max    time.Duration // Max duration of a call
+}
+
+// Metrics collects per-method statistics of Store method calls.
+// Safe for concurrent use.
+type Metrics struct {
+	// Mutex to protect concurrent access to stats
+	mux sync.Mutex
+
+	// Stats by method name
+	stats map[string]*MethodStats
+}
+
+// NewMetrics returns a new Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{stats: map[string]*MethodStats{}}
+}
+
+// Middleware returns a Middleware which collects statistics into m.
+func (m *Metrics) Middleware() Middleware {
+	return Timing(m.Observe)
+}
+
+// Observe records a Store method call.
+func (m *Metrics) Observe(c Call, d time.Duration, err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	ms := m.stats[c.Method]
+	if ms == nil {
+		ms = new(MethodStats)
+		m.stats[c.Method] = ms
+	}
+	ms.Calls++
+	if isFailure(err) {
+		ms.Errors++
+	}
+	ms.Total += d
+	if d > ms.Max {
+		ms.Max = d
+	}
+}
+
+// Stats returns the statistics by method name.
+func (m *Metrics) Stats() map[string]MethodStats {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	stats := make(map[string]MethodStats, len(m.stats))
+	for method, ms := range m.stats {
+		stats[method] = *ms
+	}
+	return stats
+}
+
+// Prometheus returns a Middleware which records Store method calls in the store operation
+// metrics served by the metrics path of productws (see productws.ObserveStoreCall()).
+func Prometheus() Middleware {
+	return Timing(func(c Call, d time.Duration, err error) {
+		productws.ObserveStoreCall(c.Method, d, err)
+	})
+}
+
+// Logging returns a Middleware which logs Store method calls.
+// If onlyErrors is true, only failed calls are logged.
+func Logging(onlyErrors bool) Middleware {
+	return Intercept(func(c Call, invoke func() error) error {
+		start := time.Now()
+		err := invoke()
+		if isFailure(err) {
+			productws.Logger().Error("Store call failed", "method", c.Method, "id", int64(c.ID), "duration", time.Since(start), "err", err)
+		} else if !onlyErrors {
+			productws.Logger().Info("Store call", "method", c.Method, "id", int64(c.ID), "duration", time.Since(start))
+		}
+		return err
+	})
+}
+
+// RetryOptions holds options of the Retry middleware.
+type RetryOptions struct {
+	Attempts       int           // Max number of attempts (including the first), default: 3
+	InitialBackoff time.Duration // Wait time before the first retry (doubled for each retry), default: 50ms
+	MaxBackoff     time.Duration // Max wait time between attempts, default: 1s
+
+	// Tells if a failed call may be retried.
+	// By default failures are retried, except creating new products (which is not idempotent)
+	// and ErrCircuitOpen.
+	Retryable func(c Call, err error) bool
+}
+
+// defaultRetryable is the default RetryOptions.Retryable.
+func defaultRetryable(c Call, err error) bool {
+	if !isFailure(err) || err == ErrCircuitOpen {
+		return false
+	}
+	return !(c.Method == MethodSave && c.ID == 0)
+}
+
+// Retry returns a Middleware which retries failed Store method calls with exponential backoff.
+// opts is optional, defaults are used for zero values.
+func Retry(opts *RetryOptions) Middleware {
+	o := RetryOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Attempts <= 0 {
+		o.Attempts = 3
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = 50 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Second
+	}
+	if o.Retryable == nil {
+		o.Retryable = defaultRetryable
+	}
+
+	return Intercept(func(c Call, invoke func() error) error {
+		backoff := o.InitialBackoff
+		for attempt := 1; ; attempt++ {
+			err := invoke()
+			if err == nil || attempt >= o.Attempts || !o.Retryable(c, err) {
+				return err
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > o.MaxBackoff {
+				backoff = o.MaxBackoff
+			}
+		}
+	})
+}
+
+// ErrCircuitOpen is returned by the CircuitBreaker middleware while the circuit is open.
+var ErrCircuitOpen = errors.New("Store circuit breaker is open")
+
+// BreakerOptions holds options of the CircuitBreaker middleware.
+type BreakerOptions struct {
+	Threshold int           // Number of consecutive failures opening the circuit, default: 5
+	Cooldown  time.Duration // Time after which an open circuit lets a trial call through, default: 30s
+}
+
+// Circuit breaker states
+const (
+	stateClosed   = "closed"
+	stateOpen     = "open"
+	stateHalfOpen = "half-open"
+)
+
+// breaker is the state of a circuit breaker.
+type breaker struct {
+	opts BreakerOptions
+
+	// Mutex to protect concurrent access to the state
+	mux sync.Mutex
+
+	state    string
+	failures int       // Consecutive failures
+	openedAt time.Time // Time when the circuit was opened
+}
+
+// CircuitBreaker returns a Middleware which stops calling the store after consecutive
+// failures, and fails fast with ErrCircuitOpen instead (which handlers report as
+// productws.MsgGeneralStoreErr). After a cooldown period a single trial call is let through:
+// if it succeeds, the circuit is closed, else it stays open for another cooldown period.
+// opts is optional, defaults are used for zero values.
+func CircuitBreaker(opts *BreakerOptions) Middleware {
+	b := &breaker{state: stateClosed}
+	if opts != nil {
+		b.opts = *opts
+	}
+	if b.opts.Threshold <= 0 {
+		b.opts.Threshold = 5
+	}
+	if b.opts.Cooldown <= 0 {
+		b.opts.Cooldown = 30 * time.Second
+	}
+
+	return Intercept(func(c Call, invoke func() error) error {
+		if !b.allow() {
+			return ErrCircuitOpen
+		}
+		err := invoke()
+		b.done(isFailure(err))
+		return err
+	})
+}
+
+// allow tells if a call may go through.
+func (b *breaker) allow() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.opts.Cooldown {
+			return false
+		}
+		b.setState(stateHalfOpen) // Let this call through as the trial
+		return true
+	case stateHalfOpen:
+		return false // Trial call in progress
+	}
+	return true
+}
+
+// done records the outcome of a call.
+func (b *breaker) done(failed bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state != stateClosed {
+			b.setState(stateClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == stateHalfOpen || b.state == stateClosed && b.failures >= b.opts.Threshold {
+		b.openedAt = time.Now()
+		if b.state != stateOpen {
+			b.setState(stateOpen)
+		}
+	}
+}
+
+// setState changes the state of the breaker.
+// Must be called with the mutex held.
+func (b *breaker) setState(state string) {
+	productws.Logger().Warn("Store circuit breaker state change", "from", b.state, "to", state)
+	b.state = state
+}
+
+// ErrInjected is the default error returned by the FaultInjection middleware.
+var ErrInjected = errors.New("Injected store fault")
+
+// FaultOptions holds options of the FaultInjection middleware.
+type FaultOptions struct {
+	ErrorRate float64 // Probability of failing a call (0..1), failed calls do not reach the store
+	Err       error   // Error to fail calls with, default: ErrInjected
+
+	// Random latency added to calls, between MinLatency and MaxLatency
+	MinLatency, MaxLatency time.Duration
+
+	Methods []string // Methods to affect (Method* constants), all if empty
+	Seed    int64    // Random seed, current time is used if 0
+}
+
+// FaultInjection returns a Middleware which injects random latency and errors
+// into Store method calls, to test how callers behave when the store misbehaves.
+func FaultInjection(opts FaultOptions) Middleware {
+	if opts.Err == nil {
+		opts.Err = ErrInjected
+	}
+	if opts.MaxLatency < opts.MinLatency {
+		opts.MaxLatency = opts.MinLatency
+	}
+	methods := map[string]bool{}
+	for _, m := range opts.Methods {
+		methods[m] = true
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+
+	rnd := rand.New(rand.NewSource(opts.Seed))
+	var rndMux sync.Mutex // rand.Rand is not safe for concurrent use
+
+	return Intercept(func(c Call, invoke func() error) error {
+		if len(methods) > 0 && !methods[c.Method] {
+			return invoke()
+		}
+
+		rndMux.Lock()
+		latency := opts.MinLatency
+		if d := opts.MaxLatency - opts.MinLatency; d > 0 {
+			latency += time.Duration(rnd.Int63n(int64(d)))
+		}
+		fail := rnd.Float64() < opts.ErrorRate
+		rndMux.Unlock()
+
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if fail {
+			return opts.Err
+		}
+		return invoke()
+	})
+}
@@ -0,0 +1,134 @@
+/*
+
+Package storemw contains a Store middleware framework, and built-in middlewares for
+timing, metrics, retries, circuit breaking, logging and fault injection.
+
+Middlewares wrap a Store and may act before and after each Store method call. They can be
+composed with Chain, e.g.:
+
+    st = storemw.Chain(st,
+        storemw.Logging(true),
+        storemw.CircuitBreaker(nil),
+        storemw.Retry(nil),
+    )
+
+The stores returned by the middlewares implement the optional Store interfaces
+(productws.Putter, productws.Pinger and io.Closer), forwarding them to the wrapped store.
+
+*/
+package storemw
+
+import (
+	"context"
+	"github.com/icza/productws"
+	"io"
+)
+
+// Names of the Store methods, passed to interceptors.
+const (
+	MethodAllIDs = "AllIDs"
+	MethodSave   = "Save"
+	MethodLoad   = "Load"
+	MethodPut    = "Put"
+)
+
+// Middleware wraps a Store, returns the wrapped Store.
+type Middleware func(productws.Store) productws.Store
+
+// Chain wraps st with the middlewares.
+// The first middleware is the outermost, it sees calls first.
+func Chain(st productws.Store, mws ...Middleware) productws.Store {
+	for i := len(mws) - 1; i >= 0; i-- {
+		st = mws[i](st)
+	}
+	return st
+}
+
+// Call describes a Store method call.
+type Call struct {
+	Method string       // Name of the called method, one of the Method* constants
+	ID     productws.ID // ID of the product (0 for AllIDs and for saving new products)
+}
+
+// Interceptor intercepts a Store method call.
+// invoke calls the next store (and may be called any number of times);
+// the returned error is returned to the caller.
+type Interceptor func(c Call, invoke func() error) error
+
+// Intercept returns a Middleware which passes all Store method calls through f.
+func Intercept(f Interceptor) Middleware {
+	return func(next productws.Store) productws.Store {
+		return &interceptStore{next: next, f: f}
+	}
+}
+
+// interceptStore is a Store which passes calls through an interceptor.
+type interceptStore struct {
+	next productws.Store
+	f    Interceptor
+}
+
+// AllIDs implements Store.AllIDs().
+func (s *interceptStore) AllIDs() (ids []productws.ID, err error) {
+	err = s.f(Call{Method: MethodAllIDs}, func() (err error) {
+		ids, err = s.next.AllIDs()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Save implements Store.Save().
+func (s *interceptStore) Save(p *productws.Product) error {
+	return s.f(Call{Method: MethodSave, ID: p.ID}, func() error {
+		return s.next.Save(p)
+	})
+}
+
+// Load implements Store.Load().
+func (s *interceptStore) Load(id productws.ID) (p *productws.Product, err error) {
+	err = s.f(Call{Method: MethodLoad, ID: id}, func() (err error) {
+		p, err = s.next.Load(id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Put implements productws.Putter if the next store implements it,
+// else productws.ErrPutUnsupported is returned (without calling the interceptor).
+func (s *interceptStore) Put(p *productws.Product) error {
+	putter, ok := s.next.(productws.Putter)
+	if !ok {
+		return productws.ErrPutUnsupported
+	}
+	return s.f(Call{Method: MethodPut, ID: p.ID}, func() error {
+		return putter.Put(p)
+	})
+}
+
+// Ping implements productws.Pinger, pings the next store if it implements productws.Pinger
+// (without calling the interceptor).
+func (s *interceptStore) Ping(ctx context.Context) error {
+	if p, ok := s.next.(productws.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Unwrap returns the next store.
+func (s *interceptStore) Unwrap() productws.Store {
+	return s.next
+}
+
+// Close implements io.Closer, closes the next store if it implements io.Closer.
+func (s *interceptStore) Close() error {
+	if c, ok := s.next.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+/*
+
+Package storetest contains the contract test of productws.Store implementations.
+
+Store implementations should run it in their tests, e.g.:
+
+    func TestStore(t *testing.T) {
+        storetest.TestStore(t, func(t *testing.T) productws.Store {
+            return NewMyStore()
+        })
+    }
+
+*/
+package storetest
+
+import (
+	"github.com/icza/productws"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// TestStore tests the contract of productws.Store (and of productws.Putter if implemented).
+// newStore must return a new, empty store for each call; stores implementing io.Closer
+// are closed at the end of their test.
+// Stores must be safe for concurrent use, and must detach saved and returned products
+// from the stored ones (like the in-memory store does).
+func TestStore(t *testing.T, newStore func(t *testing.T) productws.Store) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, st productws.Store)
+	}{
+		{"Empty", testEmpty},
+		{"SaveLoad", testSaveLoad},
+		{"Update", testUpdate},
+		{"InvalidID", testInvalidID},
+		{"Detached", testDetached},
+		{"AllIDs", testAllIDs},
+		{"Put", testPut},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st := newStore(t)
+			if c, ok := st.(io.Closer); ok {
+				defer c.Close()
+			}
+			test.f(t, st)
+		})
+	}
+}
+
+// newProduct returns a new, valid product.
+func newProduct(name string) *productws.Product {
+	return &productws.Product{
+		Name:   name,
+		Desc:   "Description of " + name,
+		Tags:   []string{"t1", "t2"},
+		Prices: map[string]productws.Price{productws.DefaultCurrency: {Value: 1234, Multiplier: 100}},
+	}
+}
+
+// save saves p, failing the test on error.
+func save(t *testing.T, st productws.Store, p *productws.Product) {
+	t.Helper()
+	if err := st.Save(p); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+}
+
+// load loads the product with the given ID, failing the test on error.
+func load(t *testing.T, st productws.Store, id productws.ID) *productws.Product {
+	t.Helper()
+	p, err := st.Load(id)
+	if err != nil {
+		t.Fatalf("Load(%d) failed: %v", id, err)
+	}
+	return p
+}
+
+// allIDs returns the sorted IDs of the store, failing the test on error.
+func allIDs(t *testing.T, st productws.Store) []productws.ID {
+	t.Helper()
+	ids, err := st.AllIDs()
+	if err != nil {
+		t.Fatalf("AllIDs failed: %v", err)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// checkEqual checks if got equals exp.
+func checkEqual(t *testing.T, exp, got *productws.Product) {
+	t.Helper()
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Expected product %+v, got: %+v", exp, got)
+	}
+}
+
+func testEmpty(t *testing.T, st productws.Store) {
+	if ids := allIDs(t, st); len(ids) != 0 {
+		t.Errorf("Expected no IDs in a new store, got: %v", ids)
+	}
+}
+
+func testSaveLoad(t *testing.T, st productws.Store) {
+	p1, p2 := newProduct("p1"), newProduct("p2")
+	save(t, st, p1)
+	save(t, st, p2)
+
+	if p1.ID == 0 || p2.ID == 0 || p1.ID == p2.ID {
+		t.Fatalf("Expected distinct, non-zero IDs, got: %d, %d", p1.ID, p2.ID)
+	}
+	checkEqual(t, p1, load(t, st, p1.ID))
+	checkEqual(t, p2, load(t, st, p2.ID))
+}
+
+func testUpdate(t *testing.T, st productws.Store) {
+	p := newProduct("p")
+	save(t, st, p)
+	load(t, st, p.ID) // Caching stores may cache it
+
+	p.Name, p.Tags = "updated", nil
+	p.Prices["EUR"] = productws.Price{Value: 99, Multiplier: 1}
+	id := p.ID
+	save(t, st, p)
+
+	if p.ID != id {
+		t.Errorf("Update changed the ID from %d to %d", id, p.ID)
+	}
+	checkEqual(t, p, load(t, st, id))
+	if ids := allIDs(t, st); len(ids) != 1 {
+		t.Errorf("Expected 1 ID after update, got: %v", ids)
+	}
+}
+
+func testInvalidID(t *testing.T, st productws.Store) {
+	p := newProduct("p")
+	save(t, st, p)
+
+	if _, err := st.Load(p.ID + 1000); err != productws.ErrInvalidId {
+		t.Errorf("Expected ErrInvalidId loading unknown ID, got: %v", err)
+	}
+
+	p2 := newProduct("p2")
+	p2.ID = p.ID + 1000
+	if err := st.Save(p2); err != productws.ErrInvalidId {
+		t.Errorf("Expected ErrInvalidId saving unknown ID, got: %v", err)
+	}
+	if _, err := st.Load(p2.ID); err != productws.ErrInvalidId {
+		t.Errorf("Expected ErrInvalidId loading unknown ID after failed save, got: %v", err)
+	}
+	if ids := allIDs(t, st); len(ids) != 1 {
+		t.Errorf("Expected 1 ID, got: %v", ids)
+	}
+}
+
+func testDetached(t *testing.T, st productws.Store) {
+	p := newProduct("p")
+	save(t, st, p)
+	exp := p.Clone()
+
+	// Modifying the saved product must not affect the store
+	p.Name = "modified"
+	p.Tags[0] = "modified"
+	p.Prices["EUR"] = productws.Price{Value: 1, Multiplier: 1}
+	checkEqual(t, exp, load(t, st, exp.ID))
+
+	// Modifying a loaded product must not affect the store
+	p2 := load(t, st, exp.ID)
+	p2.Name = "modified"
+	p2.Tags[0] = "modified"
+	p2.Prices["EUR"] = productws.Price{Value: 1, Multiplier: 1}
+	checkEqual(t, exp, load(t, st, exp.ID))
+}
+
+func testAllIDs(t *testing.T, st productws.Store) {
+	var exp []productws.ID
+	for i := 0; i < 5; i++ {
+		allIDs(t, st) // Caching stores may cache them
+		p := newProduct("p")
+		save(t, st, p)
+		exp = append(exp, p.ID)
+
+		if ids := allIDs(t, st); !reflect.DeepEqual(ids, exp) {
+			t.Errorf("Expected IDs %v, got: %v", exp, ids)
+		}
+	}
+}
+
+func testPut(t *testing.T, st productws.Store) {
+	putter, ok := st.(productws.Putter)
+	if !ok {
+		t.Skip("Store does not implement Putter")
+	}
+
+	p := newProduct("p")
+	save(t, st, p)
+	load(t, st, p.ID) // Caching stores may cache it
+
+	// Replace an existing product
+	p.Name = "put"
+	if err := putter.Put(p); err != nil {
+		if err == productws.ErrPutUnsupported {
+			t.Skip("Store does not support Put")
+		}
+		t.Fatalf("Put failed: %v", err)
+	}
+	checkEqual(t, p, load(t, st, p.ID))
+
+	// Put a new product with an ID
+	p2 := newProduct("p2")
+	p2.ID = p.ID + 100
+	if err := putter.Put(p2); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	checkEqual(t, p2, load(t, st, p2.ID))
+
+	// Generated IDs must not collide with put IDs
+	for i := 0; i < 3; i++ {
+		p3 := newProduct("p3")
+		save(t, st, p3)
+		if p3.ID == p.ID || p3.ID == p2.ID {
+			t.Errorf("Generated ID %d collides with a put ID", p3.ID)
+		}
+	}
+	checkEqual(t, p2, load(t, st, p2.ID))
+	if ids := allIDs(t, st); len(ids) != 5 {
+		t.Errorf("Expected 5 IDs, got: %v", ids)
+	}
+
+	if err := putter.Put(newProduct("noid")); err == nil {
+		t.Error("Expected error putting a product with zero ID, got none")
+	}
+}
+
+func testConcurrent(t *testing.T, st productws.Store) {
+	const workers, count = 8, 20
+
+	var mux sync.Mutex
+	seen := map[productws.ID]bool{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				p := newProduct("p")
+				if err := st.Save(p); err != nil {
+					t.Errorf("Save failed: %v", err)
+					return
+				}
+				if _, err := st.Load(p.ID); err != nil {
+					t.Errorf("Load(%d) failed: %v", p.ID, err)
+				}
+				if _, err := st.AllIDs(); err != nil {
+					t.Errorf("AllIDs failed: %v", err)
+				}
+
+				mux.Lock()
+				if seen[p.ID] {
+					t.Errorf("Duplicate ID generated: %d", p.ID)
+				}
+				seen[p.ID] = true
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ids := allIDs(t, st); len(ids) != workers*count {
+		t.Errorf("Expected %d IDs, got: %d", workers*count, len(ids))
+	}
+}
@@ -0,0 +1,211 @@
+/*
+
+Package tlsutil contains utilities for serving productws over TLS: certificate loading
+with automatic reload, client CA loading for mutual TLS, and a self-signed development
+certificate generator.
+
+*/
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/icza/productws"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is the default min interval of checking certificate files for changes.
+const DefaultReloadInterval = 10 * time.Second
+
+// CertReloader provides a certificate loaded from files, reloading it when the files change.
+// Use its GetCertificate method as tls.Config.GetCertificate.
+// Safe for concurrent use.
+type CertReloader struct {
+	certFile, keyFile string
+	interval          time.Duration // Min interval of checking the files for changes
+
+	// Mutex to protect concurrent access to the fields below
+	mux sync.Mutex
+
+	cert      *tls.Certificate
+	modTime   time.Time // Latest modification time of the files when loaded
+	lastCheck time.Time // Time of the last check for changes
+}
+
+// NewCertReloader loads the certificate and key from the specified PEM files, and returns a
+// CertReloader which checks the files for changes at most every interval (DefaultReloadInterval
+// if interval is not positive). If the files change, the certificate is reloaded; if reloading
+// fails, the error is logged and the previous certificate stays in use.
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.load(modTime); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key files.
+func (cr *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load loads the certificate.
+// Must be called with the mutex held (or before the reloader is shared).
+func (cr *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert, cr.modTime, cr.lastCheck = &cert, modTime, time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files changed.
+// Can be used as tls.Config.GetCertificate.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+
+	if time.Since(cr.lastCheck) < cr.interval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		productws.Logger().Error("Failed to check certificate files", "err", err)
+		return cr.cert, nil
+	}
+	if modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	if err := cr.load(modTime); err != nil {
+		productws.Logger().Error("Failed to reload certificate, keeping the previous one", "certFile", cr.certFile, "err", err)
+		return cr.cert, nil
+	}
+	productws.Logger().Info("Certificate reloaded", "certFile", cr.certFile)
+	return cr.cert, nil
+}
+
+// LoadCertPool loads a pool of CA certificates from a PEM bundle file,
+// e.g. to verify client certificates (tls.Config.ClientCAs).
+func LoadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + name)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns a TLS config for serving with the certificate of cr.
+// If clientCAs is not nil, clients must present a certificate signed by one of the CAs
+// (mutual TLS), else client certificates are not requested. TLS 1.2 is the min version.
+func ServerConfig(cr *CertReloader, clientCAs *x509.CertPool) *tls.Config {
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+	if clientCAs != nil {
+		conf.ClientCAs = clientCAs
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf
+}
+
+// GenerateSelfSigned generates a self-signed certificate and an ECDSA P-256 key for local
+// development, and writes them to certFile and keyFile in PEM format.
+//
+// The certificate is valid for the specified hosts (DNS names or IP addresses) for validFor,
+// and its common name is the first host. It can be used both as a server and a client
+// certificate, and it is also a CA certificate: to test mutual TLS, a generated client
+// certificate may be used as the client CA bundle of the server.
+func GenerateSelfSigned(certFile, keyFile string, hosts []string, validFor time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"productws development"}},
+		NotBefore:             now.Add(-time.Hour), // Tolerate clock skew
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if len(hosts) > 0 {
+		tmpl.Subject.CommonName = hosts[0]
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	return writePEM(keyFile, "PRIVATE KEY", keyDer, 0600)
+}
+
+// writePEM writes a PEM block to a file.
+func writePEM(name, typ string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
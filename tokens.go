@@ -0,0 +1,239 @@
+/*
+
+Token based authentication: login, bearer tokens and logout.
+
+*/
+
+package productws
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Token is an issued authentication token.
+// The token value itself is only known by the client, only its hash is stored.
+type Token struct {
+	Hash      string    // SHA-256 hash of the token value, hex encoded
+	Principal string    // Identity of the token owner
+	Created   time.Time // Issue time
+	Expires   time.Time // Expiration time
+	IP        string    `json:",omitempty"` // IP address the token is bound to (empty if not bound)
+}
+
+// ErrInvalidToken is returned by TokenStore if no token exists with the specified hash.
+var ErrInvalidToken = errors.New("Invalid token")
+
+// TokenStore is the persistence of issued tokens.
+type TokenStore interface {
+	// SaveToken saves a token. An existing token with the same hash is replaced.
+	SaveToken(t *Token) error
+
+	// LoadToken loads the token with the specified hash.
+	// ErrInvalidToken is returned if no token exists with the hash.
+	LoadToken(hash string) (*Token, error)
+
+	// DeleteToken deletes the token with the specified hash.
+	// ErrInvalidToken is returned if no token exists with the hash.
+	DeleteToken(hash string) error
+
+	// RenewToken sets the expiration time of the token with the specified hash, if it still exists.
+	// ErrInvalidToken is returned if no token exists with the hash.
+	// Must be atomic: a token deleted concurrently (e.g. by logout) must not be brought back.
+	RenewToken(hash string, expires time.Time) error
+}
+
+// TokenOptions holds options of token authentication.
+type TokenOptions struct {
+	TTL time.Duration // Time-to-live of tokens, default: 1h
+
+	// Tells if the expiration of tokens should be extended by TTL when they are used
+	Sliding bool
+
+	// Max lifetime of tokens regardless of sliding renewal, 0 means unlimited
+	MaxLifetime time.Duration
+
+	// Tells if tokens should be bound to the IP address they were issued to
+	BindIP bool
+}
+
+// tokenAuth is the token Authenticator.
+type tokenAuth struct {
+	ts    TokenStore
+	login Authenticator // Authenticates login credentials
+	opts  TokenOptions
+}
+
+// Token authenticator, token authentication is disabled if nil
+var tokens *tokenAuth
+
+// EnableTokens enables token authentication.
+//
+// Callers exchange their credentials for a token with the login API call; login credentials
+// are authenticated with the login Authenticator. API calls may then be authenticated with the
+// token, sent in the "Authorization: Bearer <token>" header. Tokens are accepted in addition to
+// the credentials of the Authenticator set by SetAuthenticator() (if any).
+// The logout API call revokes the token of the call.
+// opts is optional, defaults are used for zero values.
+// See package tokenstore for a TokenStore implementation.
+// Must be done prior to starting the web service.
+func EnableTokens(ts TokenStore, login Authenticator, opts *TokenOptions) {
+	t := &tokenAuth{ts: ts, login: login}
+	if opts != nil {
+		t.opts = *opts
+	}
+	if t.opts.TTL <= 0 {
+		t.opts.TTL = time.Hour
+	}
+	tokens = t
+}
+
+// hashToken returns the hash of a token value.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// bearerToken returns the bearer token of a request, the empty string if it has none.
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// remoteIP returns the IP address of the remote end of a request.
+func remoteIP(r *http.Request) string {
+	if i := strings.LastIndexByte(r.RemoteAddr, ':'); i >= 0 {
+		return strings.Trim(r.RemoteAddr[:i], "[]")
+	}
+	return r.RemoteAddr
+}
+
+// Authenticate implements Authenticator.Authenticate().
+// Expired tokens are deleted, and tokens are renewed if sliding renewal is enabled.
+func (t *tokenAuth) Authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", ErrNoCredentials
+	}
+
+	hash := hashToken(token)
+	tk, err := t.ts.LoadToken(hash)
+	if err != nil {
+		if err == ErrInvalidToken {
+			return "", ErrInvalidCredentials
+		}
+		return "", err
+	}
+
+	now := time.Now()
+	if !now.Before(tk.Expires) {
+		if err := t.ts.DeleteToken(hash); err != nil && err != ErrInvalidToken {
+			logOf(r).Error("Error deleting expired token", "err", err)
+		}
+		return "", ErrInvalidCredentials
+	}
+	if tk.IP != "" && tk.IP != remoteIP(r) {
+		return "", ErrInvalidCredentials
+	}
+
+	// Renew if sliding, but only if at least half of the TTL elapsed, to spare writes
+	if t.opts.Sliding && tk.Expires.Sub(now) < t.opts.TTL/2 {
+		expires := now.Add(t.opts.TTL)
+		if t.opts.MaxLifetime > 0 {
+			if max := tk.Created.Add(t.opts.MaxLifetime); expires.After(max) {
+				expires = max
+			}
+		}
+		if err := t.ts.RenewToken(hash, expires); err != nil {
+			if err == ErrInvalidToken {
+				return "", ErrInvalidCredentials // Revoked (logged out) in the mean time
+			}
+			logOf(r).Error("Error renewing token", "err", err)
+		}
+	}
+
+	return tk.Principal, nil
+}
+
+// Challenge implements Authenticator.Challenge().
+func (t *tokenAuth) Challenge() string {
+	return `Bearer realm="productws"`
+}
+
+// newToken returns a new random token value.
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // Never happens, crypto/rand.Read always succeeds
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// loginLogic implements the login call: exchanges credentials for a token.
+// The credentials are authenticated with the login Authenticator (e.g. Basic auth credentials).
+// Returns the token and its expiration time.
+func loginLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if tokens == nil {
+		return &JSONResp{Error: "Token authentication is not enabled!"}
+	}
+
+	principal, err := tokens.login.Authenticate(r)
+	if err != nil {
+		if err != ErrNoCredentials {
+			logOf(r).Warn("Login failed", "remoteAddr", r.RemoteAddr, "err", err)
+		}
+		w.Header().Set("WWW-Authenticate", tokens.login.Challenge())
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	token, now := newToken(), time.Now()
+	tk := &Token{Hash: hashToken(token), Principal: principal, Created: now, Expires: now.Add(tokens.opts.TTL)}
+	if tokens.opts.MaxLifetime > 0 && tokens.opts.MaxLifetime < tokens.opts.TTL {
+		tk.Expires = now.Add(tokens.opts.MaxLifetime)
+	}
+	if tokens.opts.BindIP {
+		tk.IP = remoteIP(r)
+	}
+	if err := tokens.ts.SaveToken(tk); err != nil {
+		logOf(r).Error("Error saving token", "err", err)
+		return &JSONResp{Error: "Token store unavailable"}
+	}
+
+	callInfoOf(r).caller = principal
+	return &JSONResp{Success: true, Data: struct {
+		Token   string
+		Expires time.Time
+	}{token, tk.Expires}}
+}
+
+// logoutLogic implements the logout call: revokes the token the call is authenticated with.
+func logoutLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if tokens == nil {
+		return &JSONResp{Error: "Token authentication is not enabled!"}
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		return &JSONResp{Error: "Not authenticated with a token!"}
+	}
+	if err := tokens.ts.DeleteToken(hashToken(token)); err != nil {
+		if err == ErrInvalidToken {
+			return &JSONResp{Error: "Invalid token!"}
+		}
+		logOf(r).Error("Error deleting token", "err", err)
+		return &JSONResp{Error: "Token store unavailable"}
+	}
+
+	return &JSONResp{Success: true}
+}
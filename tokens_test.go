@@ -0,0 +1,239 @@
+package productws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTokenStore is an in-memory TokenStore.
+type testTokenStore struct {
+	mux sync.Mutex
+	m   map[string]*Token
+
+	// Optional function called by LoadToken after loading a token
+	afterLoad func()
+}
+
+func newTestTokenStore() *testTokenStore {
+	return &testTokenStore{m: map[string]*Token{}}
+}
+
+func (s *testTokenStore) SaveToken(t *Token) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	t2 := *t
+	s.m[t.Hash] = &t2
+	return nil
+}
+
+func (s *testTokenStore) LoadToken(hash string) (*Token, error) {
+	s.mux.Lock()
+	t := s.m[hash]
+	s.mux.Unlock()
+	if t == nil {
+		return nil, ErrInvalidToken
+	}
+	if s.afterLoad != nil {
+		s.afterLoad()
+	}
+	t2 := *t
+	return &t2, nil
+}
+
+func (s *testTokenStore) DeleteToken(hash string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.m[hash] == nil {
+		return ErrInvalidToken
+	}
+	delete(s.m, hash)
+	return nil
+}
+
+func (s *testTokenStore) RenewToken(hash string, expires time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	t := s.m[hash]
+	if t == nil {
+		return ErrInvalidToken
+	}
+	t.Expires = expires
+	return nil
+}
+
+// addTestToken saves a token of the principal to the store, returns the token value.
+func (s *testTokenStore) addTestToken(principal string, created, expires time.Time) string {
+	token := newToken()
+	s.SaveToken(&Token{Hash: hashToken(token), Principal: principal, Created: created, Expires: expires})
+	return token
+}
+
+func TestTokenLogoutDuringRenewal(t *testing.T) {
+	defer func(t *tokenAuth) { tokens = t }(tokens)
+
+	ts := newTestTokenStore()
+	EnableTokens(ts, userAuth{}, &TokenOptions{TTL: time.Hour, Sliding: true})
+	now := time.Now()
+	token := ts.addTestToken("bob", now.Add(-time.Hour), now.Add(time.Minute)) // Due for renewal
+
+	// Logout right after the token is loaded for authentication:
+	ts.afterLoad = func() {
+		ts.afterLoad = nil
+		r := httptest.NewRequest("POST", "/logout", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if resp := logoutLogic(httptest.NewRecorder(), r, nil); !resp.Success {
+			t.Errorf("Logout failed: %+v", resp)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if principal, err := tokens.Authenticate(r); err != ErrInvalidCredentials {
+		t.Errorf("Expected error: %v, got: %q, %v", ErrInvalidCredentials, principal, err)
+	}
+	if _, err := ts.LoadToken(hashToken(token)); err != ErrInvalidToken {
+		t.Errorf("Expected logged out token to stay deleted, got: %v", err)
+	}
+	if _, err := tokens.Authenticate(r); err != ErrInvalidCredentials {
+		t.Errorf("Expected logged out token to be rejected, got: %v", err)
+	}
+}
+
+func TestTokenLogoutRenewRace(t *testing.T) {
+	defer func(t *tokenAuth) { tokens = t }(tokens)
+
+	ts := newTestTokenStore()
+	EnableTokens(ts, userAuth{}, &TokenOptions{TTL: time.Hour, Sliding: true})
+
+	for i := 0; i < 100; i++ {
+		now := time.Now()
+		token := ts.addTestToken("bob", now.Add(-time.Hour), now.Add(time.Minute))
+		r := httptest.NewRequest("GET", "/list", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			tokens.Authenticate(r)
+		}()
+		go func() {
+			defer wg.Done()
+			logoutLogic(httptest.NewRecorder(), r, nil)
+		}()
+		wg.Wait()
+
+		if _, err := tokens.Authenticate(r); err != ErrInvalidCredentials {
+			t.Fatalf("Expected logged out token to be rejected, got: %v", err)
+		}
+	}
+}
+
+func TestTokenAuthenticate(t *testing.T) {
+	defer func(t *tokenAuth) { tokens = t }(tokens)
+
+	now := time.Now()
+	cases := []struct {
+		name       string
+		opts       TokenOptions
+		created    time.Time
+		expires    time.Time
+		ip         string
+		expErr     error
+		expExpires time.Time // Zero if not renewed
+	}{
+		{"valid", TokenOptions{TTL: time.Hour}, now, now.Add(time.Hour), "", nil, time.Time{}},
+		{"expired", TokenOptions{TTL: time.Hour}, now.Add(-time.Hour), now, "", ErrInvalidCredentials, time.Time{}},
+		{"expired, sliding", TokenOptions{TTL: time.Hour, Sliding: true}, now.Add(-time.Hour), now.Add(-time.Second), "",
+			ErrInvalidCredentials, time.Time{}},
+		{"not renewed yet", TokenOptions{TTL: time.Hour, Sliding: true}, now, now.Add(50 * time.Minute), "", nil, time.Time{}},
+		{"renewed", TokenOptions{TTL: time.Hour, Sliding: true}, now.Add(-time.Hour), now.Add(time.Minute), "",
+			nil, now.Add(time.Hour)},
+		{"renewal capped", TokenOptions{TTL: time.Hour, Sliding: true, MaxLifetime: 90 * time.Minute},
+			now.Add(-time.Hour), now.Add(time.Minute), "", nil, now.Add(30 * time.Minute)},
+		{"bound to IP", TokenOptions{TTL: time.Hour}, now, now.Add(time.Hour), "192.0.2.1", nil, time.Time{}},
+		{"bound to other IP", TokenOptions{TTL: time.Hour}, now, now.Add(time.Hour), "192.0.2.2", ErrInvalidCredentials, time.Time{}},
+	}
+
+	for _, c := range cases {
+		ts := newTestTokenStore()
+		EnableTokens(ts, userAuth{}, &c.opts)
+		token := newToken()
+		ts.SaveToken(&Token{Hash: hashToken(token), Principal: "bob", Created: c.created, Expires: c.expires, IP: c.ip})
+
+		r := httptest.NewRequest("GET", "/list", nil) // RemoteAddr is 192.0.2.1:1234
+		r.Header.Set("Authorization", "Bearer "+token)
+		principal, err := tokens.Authenticate(r)
+		if err != c.expErr || err == nil && principal != "bob" {
+			t.Errorf("[%s] Expected error: %v, got: %q, %v", c.name, c.expErr, principal, err)
+			continue
+		}
+
+		tk, loadErr := ts.LoadToken(hashToken(token))
+		switch {
+		case !c.expires.After(now): // Expired
+			if loadErr != ErrInvalidToken {
+				t.Errorf("[%s] Expected expired token to be deleted, got: %v", c.name, loadErr)
+			}
+		case c.expExpires.IsZero():
+			if loadErr != nil || !tk.Expires.Equal(c.expires) {
+				t.Errorf("[%s] Expected unchanged expiration, got: %+v, %v", c.name, tk, loadErr)
+			}
+		default:
+			if loadErr != nil || tk.Expires.Sub(c.expExpires).Abs() > time.Second {
+				t.Errorf("[%s] Expected expiration: %v, got: %+v, %v", c.name, c.expExpires, tk, loadErr)
+			}
+		}
+	}
+}
+
+func TestLoginLogout(t *testing.T) {
+	defer func(t *tokenAuth) { tokens = t }(tokens)
+
+	EnableTokens(newTestTokenStore(), userAuth{}, nil)
+
+	// Login without credentials fails:
+	w := httptest.NewRecorder()
+	if resp := loginLogic(w, httptest.NewRequest("POST", "/login", nil), nil); resp != nil || w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got: %d, %+v", w.Code, resp)
+	}
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.Header.Set("X-User", "bob")
+	resp := loginLogic(httptest.NewRecorder(), r, nil)
+	if resp == nil || !resp.Success {
+		t.Fatalf("Expected successful login, got: %+v", resp)
+	}
+	data := resp.Data.(struct {
+		Token   string
+		Expires time.Time
+	})
+	if exp := time.Now().Add(time.Hour); data.Expires.Sub(exp).Abs() > time.Second {
+		t.Errorf("Expected expiration: %v (default TTL), got: %v", exp, data.Expires)
+	}
+
+	r = httptest.NewRequest("GET", "/list", nil)
+	r.Header.Set("Authorization", "Bearer "+data.Token)
+	if principal, err := tokens.Authenticate(r); err != nil || principal != "bob" {
+		t.Errorf("Expected principal bob, got: %q, %v", principal, err)
+	}
+
+	if resp := logoutLogic(httptest.NewRecorder(), r, nil); !resp.Success {
+		t.Errorf("Expected successful logout, got: %+v", resp)
+	}
+	if _, err := tokens.Authenticate(r); err != ErrInvalidCredentials {
+		t.Errorf("Expected logged out token to be rejected, got: %v", err)
+	}
+	if resp := logoutLogic(httptest.NewRecorder(), r, nil); resp.Success {
+		t.Errorf("Expected second logout to fail, got: %+v", resp)
+	}
+
+	// Unknown tokens are rejected:
+	r.Header.Set("Authorization", "Bearer "+newToken())
+	if _, err := tokens.Authenticate(r); err != ErrInvalidCredentials {
+		t.Errorf("Expected unknown token to be rejected, got: %v", err)
+	}
+}
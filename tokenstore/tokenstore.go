@@ -0,0 +1,94 @@
+/*
+
+Package tokenstore contains productws.TokenStore implementations, safe for concurrent use.
+
+*/
+package tokenstore
+
+import (
+	"github.com/icza/productws"
+	"sync"
+	"time"
+)
+
+// Number of saves after which expired tokens are swept
+const sweepInterval = 1000
+
+// memStore is an in-memory token store implementation.
+type memStore struct {
+	// Map storing tokens, mapped from their hash
+	m map[string]*productws.Token
+
+	// Mutex to protect concurrent access to the store
+	mux sync.RWMutex
+
+	// Number of saves since the last sweep of expired tokens
+	saves int
+}
+
+// NewMemStore returns a new in-memory TokenStore implementation.
+// Expired tokens are removed periodically.
+// Safe for concurrent use.
+func NewMemStore() productws.TokenStore {
+	return &memStore{m: map[string]*productws.Token{}}
+}
+
+// SaveToken implements TokenStore.SaveToken().
+// This implementation never returns an error.
+func (s *memStore) SaveToken(t *productws.Token) error {
+	t2 := *t
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.m[t.Hash] = &t2
+
+	if s.saves++; s.saves >= sweepInterval {
+		s.saves = 0
+		now := time.Now()
+		for hash, t := range s.m {
+			if !now.Before(t.Expires) {
+				delete(s.m, hash)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadToken implements TokenStore.LoadToken().
+func (s *memStore) LoadToken(hash string) (*productws.Token, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	t := s.m[hash]
+	if t == nil {
+		return nil, productws.ErrInvalidToken
+	}
+	t2 := *t
+	return &t2, nil
+}
+
+// DeleteToken implements TokenStore.DeleteToken().
+func (s *memStore) DeleteToken(hash string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.m[hash] == nil {
+		return productws.ErrInvalidToken
+	}
+	delete(s.m, hash)
+	return nil
+}
+
+// RenewToken implements TokenStore.RenewToken().
+func (s *memStore) RenewToken(hash string, expires time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	t := s.m[hash]
+	if t == nil {
+		return productws.ErrInvalidToken
+	}
+	t.Expires = expires
+	return nil
+}
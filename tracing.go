@@ -0,0 +1,269 @@
+/*
+
+Tracing of API calls and store operations, with W3C Trace Context propagation.
+
+*/
+
+package productws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header carrying the trace and parent span IDs.
+const TraceparentHeader = "traceparent"
+
+// TraceFlagSampled is the sampled flag of the W3C trace flags.
+// Spans of new traces are sampled; spans continuing a trace inherit the flags of their parent.
+const TraceFlagSampled byte = 0x01
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// String returns the lowercase hex representation of the ID.
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanID identifies a span.
+type SpanID [8]byte
+
+// String returns the lowercase hex representation of the ID.
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// Span kinds
+const (
+	SpanKindServer   = "server"   // Span of an API call
+	SpanKindInternal = "internal" // Span of an internal operation (e.g. a store operation)
+)
+
+// Span is a timed operation of a trace.
+// Methods of a nil *Span are no-ops, so callers don't have to check if tracing is enabled.
+type Span struct {
+	TraceID  TraceID
+	SpanID   SpanID
+	ParentID SpanID // Zero if the span is a root span
+	Flags    byte   // W3C trace flags (e.g. TraceFlagSampled), propagated from the parent
+	Name     string
+	Kind     string // One of the SpanKind* constants
+	Start    time.Time
+	End      time.Time
+
+	// Attributes of the span, e.g. "http.status_code"
+	Attributes map[string]interface{}
+
+	// Error message if the operation failed, empty otherwise
+	Error string
+
+	// Mutex to protect concurrent access to attributes and the error
+	mux sync.Mutex
+}
+
+// SpanExporter exports ended spans.
+type SpanExporter interface {
+	// ExportSpan exports an ended span.
+	// The span must not be modified.
+	ExportSpan(s *Span)
+}
+
+// Span exporter, tracing is disabled if nil
+var spanExporter SpanExporter
+
+// SetSpanExporter sets the exporter of spans, which enables tracing.
+// Tracing is disabled by default (and if e is nil).
+// Package spanexport contains exporter implementations.
+// Must be done prior to starting the web service.
+func SetSpanExporter(e SpanExporter) {
+	spanExporter = e
+}
+
+// newSpanID returns a new random span ID.
+func newSpanID() (id SpanID) {
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err) // Never happens, crypto/rand.Read always succeeds
+	}
+	return
+}
+
+// startSpan starts a new root or child span if tracing is enabled, else returns nil.
+// If parent is nil, the trace ID and parent span ID are taken from the traceparent
+// header of r (if r is not nil and it has a valid one), else a new trace is started.
+func startSpan(parent *Span, r *http.Request, name, kind string) *Span {
+	if spanExporter == nil {
+		return nil
+	}
+
+	s := &Span{SpanID: newSpanID(), Name: name, Kind: kind, Start: time.Now(), Attributes: map[string]interface{}{}}
+	switch {
+	case parent != nil:
+		s.TraceID, s.ParentID, s.Flags = parent.TraceID, parent.SpanID, parent.Flags
+	case r != nil && parseTraceparent(r.Header.Get(TraceparentHeader), &s.TraceID, &s.ParentID, &s.Flags):
+	default:
+		if _, err := rand.Read(s.TraceID[:]); err != nil {
+			panic(err) // Never happens, crypto/rand.Read always succeeds
+		}
+		s.Flags = TraceFlagSampled
+	}
+	return s
+}
+
+// parseTraceparent parses a traceparent header value into traceID, parentID and flags.
+// Reports whether v is valid.
+func parseTraceparent(v string, traceID *TraceID, parentID *SpanID, flags *byte) bool {
+	// Format: version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	// Later versions may append fields, version ff is invalid.
+	// All fields are lowercase hex.
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return false
+	}
+	var ver, fl [1]byte
+	var tid TraceID
+	var pid SpanID
+	for _, f := range []struct {
+		s   string
+		dst []byte
+	}{{parts[0], ver[:]}, {parts[1], tid[:]}, {parts[2], pid[:]}, {parts[3], fl[:]}} {
+		if len(f.s) != 2*len(f.dst) || strings.ToLower(f.s) != f.s {
+			return false
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.s)); err != nil {
+			return false
+		}
+	}
+	if tid == (TraceID{}) || pid == (SpanID{}) {
+		return false
+	}
+	*traceID, *parentID, *flags = tid, pid, fl[0]
+	return true
+}
+
+// Traceparent returns the traceparent header value identifying the span as the parent.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.TraceID.String() + "-" + s.SpanID.String() + "-" + hex.EncodeToString([]byte{s.Flags})
+}
+
+// SetAttr sets an attribute of the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	s.Attributes[key] = value
+	s.mux.Unlock()
+}
+
+// SetError marks the span failed with the specified error message.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	s.Error = msg
+	s.mux.Unlock()
+}
+
+// finish ends the span and exports it.
+func (s *Span) finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if e := spanExporter; e != nil {
+		e.ExportSpan(s)
+	}
+}
+
+// spanKey is the context key under which the current *Span is stored.
+type spanKey struct{}
+
+// SpanFromContext returns the current span stored in ctx, nil if there is none.
+// The context of requests passed to API call logic carries the span of the call.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// InjectTraceparent sets the traceparent header in h from the current span of ctx
+// (if there is one), so the span of a called service becomes a child of the current span.
+func InjectTraceparent(ctx context.Context, h http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		h.Set(TraceparentHeader, s.Traceparent())
+	}
+}
+
+// tracingStore is a Store which records a child span of an API call span for each store operation.
+// Forwards the optional Putter and io.Closer interfaces.
+type tracingStore struct {
+	Store
+	parent *Span
+}
+
+// trace starts a span of a store operation.
+// The returned function ends the span, it must be called with the result of the operation.
+func (s tracingStore) trace(method string, id ID) func(err error) {
+	span := startSpan(s.parent, nil, "Store."+method, SpanKindInternal)
+	if id != 0 {
+		span.SetAttr("productws.product_id", int64(id))
+	}
+	return func(err error) {
+		if err != nil && err != ErrInvalidId {
+			span.SetError(err.Error())
+		}
+		span.finish()
+	}
+}
+
+// AllIDs implements Store.AllIDs().
+func (s tracingStore) AllIDs() (ids []ID, err error) {
+	defer func(end func(error)) { end(err) }(s.trace("AllIDs", 0))
+	return s.Store.AllIDs()
+}
+
+// Save implements Store.Save().
+func (s tracingStore) Save(p *Product) (err error) {
+	defer func(end func(error)) { end(err) }(s.trace("Save", p.ID))
+	return s.Store.Save(p)
+}
+
+// Load implements Store.Load().
+func (s tracingStore) Load(id ID) (p *Product, err error) {
+	defer func(end func(error)) { end(err) }(s.trace("Load", id))
+	return s.Store.Load(id)
+}
+
+// Put implements Putter if the wrapped store does.
+func (s tracingStore) Put(p *Product) (err error) {
+	putter, ok := s.Store.(Putter)
+	if !ok {
+		return ErrPutUnsupported
+	}
+	defer func(end func(error)) { end(err) }(s.trace("Put", p.ID))
+	return putter.Put(p)
+}
+
+// Close implements io.Closer, closes the wrapped store if it implements io.Closer.
+func (s tracingStore) Close() error {
+	if c, ok := s.Store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// storeOf returns the Store to be used by the logic of an API call request.
+// If tracing is enabled, the returned store records store operations as child spans
+// of the span of the call.
+func storeOf(r *http.Request) Store {
+	if ci := callInfoOf(r); ci.span != nil {
+		return tracingStore{Store: store, parent: ci.span}
+	}
+	return store
+}
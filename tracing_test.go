@@ -0,0 +1,111 @@
+package productws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// nopExporter is a SpanExporter discarding spans.
+type nopExporter struct{}
+
+func (nopExporter) ExportSpan(s *Span) {}
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		tid = "4bf92f3577b34da6a3ce929d0e0e4736"
+		pid = "00f067aa0ba902b7"
+	)
+	cases := []struct {
+		v        string
+		ok       bool
+		expFlags byte
+	}{
+		{"00-" + tid + "-" + pid + "-01", true, 0x01},
+		{"00-" + tid + "-" + pid + "-00", true, 0x00},
+		{"00-" + tid + "-" + pid + "-09", true, 0x09},
+		{" 00-" + tid + "-" + pid + "-01 ", true, 0x01},
+		{"01-" + tid + "-" + pid + "-01-future", true, 0x01}, // Later versions may append fields
+		{"00-" + tid + "-" + pid + "-01-extra", false, 0},    // Version 00 has exactly 4 fields
+		{"ff-" + tid + "-" + pid + "-01", false, 0},
+		{"0x-" + tid + "-" + pid + "-01", false, 0},
+		{"000-" + tid + "-" + pid + "-01", false, 0},
+		{"00-" + tid + "-" + pid + "-zz", false, 0},
+		{"00-" + tid + "-" + pid + "-0g", false, 0},
+		{"00-" + tid + "-" + pid + "-0A", false, 0},
+		{"00-" + tid + "-" + pid + "-1", false, 0},
+		{"00-" + tid + "-" + pid, false, 0},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + pid + "-01", false, 0},
+		{"00-" + tid + "-00F067AA0BA902B7-01", false, 0},
+		{"00-" + tid[:30] + "-" + pid + "-01", false, 0},
+		{"00-" + tid + "-" + pid[:14] + "-01", false, 0},
+		{"00-00000000000000000000000000000000-" + pid + "-01", false, 0},
+		{"00-" + tid + "-0000000000000000-01", false, 0},
+		{"00-" + tid[:31] + "x-" + pid + "-01", false, 0},
+		{"", false, 0},
+	}
+
+	for _, c := range cases {
+		var traceID TraceID
+		var parentID SpanID
+		var flags byte
+		ok := parseTraceparent(c.v, &traceID, &parentID, &flags)
+		if ok != c.ok {
+			t.Errorf("[v: %q] Expected ok: %v, got: %v", c.v, c.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if traceID.String() != tid || parentID.String() != pid || flags != c.expFlags {
+			t.Errorf("[v: %q] Got trace ID: %s, parent ID: %s, flags: %02x", c.v, traceID, parentID, flags)
+		}
+	}
+}
+
+func TestTraceparentPropagation(t *testing.T) {
+	defer func(e SpanExporter) { spanExporter = e }(spanExporter)
+	spanExporter = nopExporter{}
+
+	const in = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+
+	r := httptest.NewRequest(http.MethodGet, "/list", nil)
+	r.Header.Set(TraceparentHeader, in)
+	s := startSpan(nil, r, "list", SpanKindServer)
+	if s.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Span does not continue the trace: %s %s", s.TraceID, s.ParentID)
+	}
+	if s.Flags != 0 {
+		t.Errorf("Expected flags 00 of the incoming header, got: %02x", s.Flags)
+	}
+
+	child := startSpan(s, nil, "Store.Load", SpanKindInternal)
+	if child.TraceID != s.TraceID || child.ParentID != s.SpanID || child.Flags != s.Flags {
+		t.Errorf("Child span does not continue the span: %+v", child)
+	}
+
+	// Outgoing header: same trace, the current span as the parent, flags of the trace (not sampled)
+	h := http.Header{}
+	InjectTraceparent(context.WithValue(context.Background(), spanKey{}, child), h)
+	if exp := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + child.SpanID.String() + "-00"; h.Get(TraceparentHeader) != exp {
+		t.Errorf("Expected outgoing traceparent %q, got: %q", exp, h.Get(TraceparentHeader))
+	}
+
+	// New traces are sampled
+	r.Header.Set(TraceparentHeader, "invalid")
+	root := startSpan(nil, r, "list", SpanKindServer)
+	if root.ParentID != (SpanID{}) || root.TraceID == s.TraceID || root.Flags != TraceFlagSampled {
+		t.Errorf("Expected a new sampled root span, got: %+v", root)
+	}
+	if tp := root.Traceparent(); tp != "00-"+root.TraceID.String()+"-"+root.SpanID.String()+"-01" {
+		t.Errorf("Unexpected traceparent of root span: %q", tp)
+	}
+
+	// No header is set without a span
+	h = http.Header{}
+	InjectTraceparent(context.Background(), h)
+	if v := h.Get(TraceparentHeader); v != "" {
+		t.Errorf("Expected no traceparent, got: %q", v)
+	}
+}
@@ -8,6 +8,10 @@ package productws
 
 import (
 	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Default currency, must be present in all products.
@@ -30,7 +34,7 @@ type Price struct {
 
 // Validate validates a Price.
 // Returns an empty string if price is valid, else an error message.
-func (p *Price) Validate() string {
+func (p Price) Validate() string {
 	if p.Value < 0 {
 		return "Price Value must be non-negative!"
 	}
@@ -41,9 +45,73 @@ func (p *Price) Validate() string {
 	return ""
 }
 
+// String returns the decimal representation of the real price, e.g. "1.99".
+// The representation is exact if Multiplier is a power of 10.
+// Invalid prices (non-positive Multiplier) are represented like "Value/Multiplier".
+func (p Price) String() string {
+	if p.Multiplier < 1 {
+		return strconv.FormatInt(p.Value, 10) + "/" + strconv.FormatInt(p.Multiplier, 10)
+	}
+
+	digits := 0
+	for m := p.Multiplier; m > 1 && m%10 == 0; m /= 10 {
+		digits++
+	}
+	if pow10(digits) != p.Multiplier {
+		return strconv.FormatFloat(float64(p.Value)/float64(p.Multiplier), 'f', -1, 64)
+	}
+
+	sign, abs := "", uint64(p.Value)
+	if p.Value < 0 {
+		sign, abs = "-", -abs // Also correct for math.MinInt64
+	}
+	s := strconv.FormatUint(abs, 10)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+// ParsePrice parses a decimal price like "19.99".
+// The Multiplier of the result is 10^(number of fraction digits), e.g.
+//     ParsePrice("19.99") // returns Price{Value: 1999, Multiplier: 100}
+func ParsePrice(s string) (Price, error) {
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" || strings.ContainsAny(intPart+fracPart, "+-") || len(fracPart) > 18 {
+		return Price{}, errors.New("invalid price: " + strconv.Quote(s))
+	}
+
+	value, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return Price{}, errors.New("invalid price: " + strconv.Quote(s))
+	}
+
+	return Price{Value: value, Multiplier: pow10(len(fracPart))}, nil
+}
+
+// pow10 returns 10^n.
+func pow10(n int) int64 {
+	p := int64(1)
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
 // ID is the type of product IDs.
 type ID int64
 
+// sortIDs sorts IDs in increasing order.
+func sortIDs(ids []ID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
 // Product models a product.
 type Product struct {
 	ID   ID     // Unique product ID
@@ -55,6 +123,11 @@ type Product struct {
 
 	// Price points, mapped from currency (e.g. "USD")
 	Prices map[string]Price
+
+	// Audit metadata, managed by the server (values sent by clients are ignored)
+	CreatedAt time.Time // Time of creation
+	UpdatedAt time.Time // Time of last modification
+	UpdatedBy string    // Identity of the caller who last modified the product
 }
 
 // Validate validates a product.
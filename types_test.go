@@ -0,0 +1,78 @@
+package productws
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPriceString(t *testing.T) {
+	cases := []struct {
+		p   Price
+		exp string
+	}{
+		{Price{Value: 199, Multiplier: 100}, "1.99"},
+		{Price{Value: 5, Multiplier: 100}, "0.05"},
+		{Price{Value: 100, Multiplier: 100}, "1.00"},
+		{Price{Value: 0, Multiplier: 100}, "0.00"},
+		{Price{Value: 42, Multiplier: 1}, "42"},
+		{Price{Value: -5, Multiplier: 100}, "-0.05"},
+		{Price{Value: -199, Multiplier: 100}, "-1.99"},
+		{Price{Value: -42, Multiplier: 1}, "-42"},
+		{Price{Value: math.MinInt64, Multiplier: 1}, "-9223372036854775808"},
+		{Price{Value: math.MinInt64, Multiplier: 1000}, "-9223372036854775.808"},
+		{Price{Value: 3, Multiplier: 4}, "0.75"},
+		{Price{Value: -3, Multiplier: 4}, "-0.75"},
+		{Price{Value: 7, Multiplier: 0}, "7/0"},
+		{Price{Value: 7, Multiplier: -10}, "7/-10"},
+	}
+	for _, c := range cases {
+		if got := c.p.String(); got != c.exp {
+			t.Errorf("%+v: expected %q, got: %q", c.p, c.exp, got)
+		}
+	}
+}
+
+func TestParsePrice(t *testing.T) {
+	cases := []struct {
+		s   string
+		exp Price
+		ok  bool
+	}{
+		{"19.99", Price{Value: 1999, Multiplier: 100}, true},
+		{"0.05", Price{Value: 5, Multiplier: 100}, true},
+		{"42", Price{Value: 42, Multiplier: 1}, true},
+		{"42.", Price{Value: 42, Multiplier: 1}, true},
+		{".5", Price{Value: 5, Multiplier: 10}, true},
+		{"1.000", Price{Value: 1000, Multiplier: 1000}, true},
+		{"", Price{}, false},
+		{".", Price{}, false},
+		{"-1.99", Price{}, false},
+		{"+1.99", Price{}, false},
+		{"1.-5", Price{}, false},
+		{"1.2.3", Price{}, false},
+		{"abc", Price{}, false},
+		{"0.1234567890123456789", Price{}, false},
+		{"99999999999999999999", Price{}, false},
+	}
+	for _, c := range cases {
+		got, err := ParsePrice(c.s)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("%q: expected ok: %v, got error: %v", c.s, c.ok, err)
+			continue
+		}
+		if got != c.exp {
+			t.Errorf("%q: expected %+v, got: %+v", c.s, c.exp, got)
+		}
+	}
+
+	// String() must give back a parsable representation
+	for _, s := range []string{"19.99", "0.05", "42", "1.000"} {
+		p, err := ParsePrice(s)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", s, err)
+		}
+		if got := p.String(); got != s {
+			t.Errorf("Round trip of %q gave: %q", s, got)
+		}
+	}
+}
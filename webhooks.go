@@ -0,0 +1,685 @@
+/*
+
+Outgoing webhooks notifying subscribers about product changes.
+
+*/
+
+package productws
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook is a webhook subscription.
+type Webhook struct {
+	ID  string // Unique ID of the subscription, generated by the server
+	URL string // URL to POST event payloads to
+
+	// Secret used to sign payloads (HMAC-SHA256).
+	// Generated if not specified on creation; only returned by the create call.
+	Secret string `json:",omitempty"`
+
+	// Event types to deliver (Event* constants); all events if empty
+	Events []string `json:",omitempty"`
+
+	Created time.Time // Time of subscription
+}
+
+// Wants tells if the webhook subscribed to the event type.
+func (wh *Webhook) Wants(typ string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, t := range wh.Events {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors to use by webhook store implementations.
+var (
+	ErrInvalidWebhookID = errors.New("Invalid Webhook ID")
+)
+
+// WebhookStore defines the interface for the persistent layer of webhook subscriptions.
+type WebhookStore interface {
+	// AllWebhooks returns all webhook subscriptions.
+	AllWebhooks() ([]*Webhook, error)
+
+	// SaveWebhook saves a webhook subscription (existing subscription with the same ID is replaced).
+	SaveWebhook(wh *Webhook) error
+
+	// DeleteWebhook deletes a webhook subscription.
+	// ErrInvalidWebhookID should be returned if no subscription exists with the specified ID.
+	DeleteWebhook(id string) error
+}
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"   // Delivery is in progress (waiting for retry)
+	DeliveryDelivered = "delivered" // Delivered successfully
+	DeliveryDead      = "dead"      // All attempts failed, delivery is in the dead-letter list
+)
+
+// Delivery describes the delivery of an event to a webhook.
+type Delivery struct {
+	ID        string // Unique ID of the delivery
+	WebhookID string // ID of the webhook
+	URL       string // URL of the webhook
+	EventSeq  uint64 // Sequence number of the delivered event
+	EventType string // Type of the delivered event
+	Status    string // Status, one of the Delivery* constants
+
+	Attempts       int       // Number of attempts made
+	LastAttempt    time.Time // Time of the last attempt
+	LastStatusCode int       `json:",omitempty"` // HTTP status code received at the last attempt
+	LastError      string    `json:",omitempty"` // Error of the last attempt
+	NextAttempt    time.Time // Time of the next attempt (zero if not pending)
+}
+
+// WebhookOptions holds options of webhook deliveries.
+type WebhookOptions struct {
+	MaxAttempts    int           // Max attempts to deliver an event, default: 5
+	InitialBackoff time.Duration // Wait time before the first retry (doubled for each retry), default: 1s
+	MaxBackoff     time.Duration // Max wait time between retries, default: 5m
+	Workers        int           // Max number of concurrent delivery attempts, default: 10
+
+	// HTTP client to use, default: client with 10s timeout, refusing to connect to internal addresses
+	// (unless AllowInternal is set). A custom client is used as is.
+	Client *http.Client
+
+	// Tells if webhook URLs may point to internal (loopback, private, link-local and unspecified)
+	// addresses. Unsafe if untrusted callers may subscribe webhooks: they could make the server
+	// send requests to internal services (server-side request forgery).
+	AllowInternal bool
+
+	// Max number of completed deliveries kept for inspection, default: 1000.
+	// Dead deliveries are kept separately (up to the same limit).
+	HistorySize int
+}
+
+// Header names of webhook requests
+const (
+	WebhookEventHeader     = "X-Productws-Event"     // Type of the event
+	WebhookDeliveryHeader  = "X-Productws-Delivery"  // ID of the delivery
+	WebhookSignatureHeader = "X-Productws-Signature" // Signature of the payload: "sha256=" + hex HMAC
+)
+
+// SignWebhookPayload returns the signature of a webhook payload, as sent
+// in the WebhookSignatureHeader.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature verifies the signature of a webhook payload.
+// Webhook receivers may use this to verify the requests.
+func VerifyWebhookSignature(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhookPayload(secret, payload)), []byte(signature))
+}
+
+// webhookDispatcher delivers events to webhook subscribers.
+type webhookDispatcher struct {
+	ws   WebhookStore
+	opts WebhookOptions
+
+	// Mutex to protect the delivery lists
+	mux sync.Mutex
+
+	pending   map[string]*Delivery // Pending deliveries, mapped from ID
+	completed []*Delivery          // Completed (delivered) deliveries, oldest first
+	dead      []*Delivery          // Dead-letter list, oldest first
+
+	// Delivery attempts waiting for retry, protected by mux
+	retries retryQueue
+
+	// Delivery attempts to be made by the workers
+	queue chan *webhookJob
+
+	// Channel to wake the retry scheduler when a retry is added
+	wake chan struct{}
+
+	// Channel to signal the dispatcher to stop, and to close it once
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// webhookJob is a delivery to be attempted.
+type webhookJob struct {
+	dl      *Delivery
+	secret  string
+	payload []byte
+	backoff time.Duration // Wait time before the next retry
+}
+
+// retryQueue is a min-heap of jobs waiting for retry, ordered by their next attempt.
+// Implements heap.Interface.
+type retryQueue []*webhookJob
+
+func (q retryQueue) Len() int            { return len(q) }
+func (q retryQueue) Less(i, j int) bool  { return q[i].dl.NextAttempt.Before(q[j].dl.NextAttempt) }
+func (q retryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *retryQueue) Push(x interface{}) { *q = append(*q, x.(*webhookJob)) }
+func (q *retryQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return j
+}
+
+// Webhook dispatcher, nil if webhooks are not enabled
+var webhooks *webhookDispatcher
+
+// EnableWebhooks enables webhooks, subscriptions are persisted in the specified WebhookStore.
+// opts is optional, defaults are used for zero values.
+// Must be done prior to starting the web service.
+func EnableWebhooks(ws WebhookStore, opts *WebhookOptions) {
+	webhooks = newWebhookDispatcher(ws, opts)
+	go webhooks.run()
+}
+
+// newWebhookDispatcher returns a new webhook dispatcher, using defaults for zero values of opts.
+// Starts the delivery workers and the retry scheduler, but not receiving events (see run()).
+func newWebhookDispatcher(ws WebhookStore, opts *WebhookOptions) *webhookDispatcher {
+	d := &webhookDispatcher{ws: ws, pending: map[string]*Delivery{},
+		wake: make(chan struct{}, 1), stop: make(chan struct{})}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if d.opts.MaxAttempts <= 0 {
+		d.opts.MaxAttempts = 5
+	}
+	if d.opts.InitialBackoff <= 0 {
+		d.opts.InitialBackoff = time.Second
+	}
+	if d.opts.MaxBackoff <= 0 {
+		d.opts.MaxBackoff = 5 * time.Minute
+	}
+	if d.opts.Client == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		if !d.opts.AllowInternal {
+			dialer.Control = denyInternal
+		}
+		d.opts.Client = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DialContext: dialer.DialContext}}
+	}
+	if d.opts.HistorySize <= 0 {
+		d.opts.HistorySize = 1000
+	}
+	if d.opts.Workers <= 0 {
+		d.opts.Workers = 10
+	}
+
+	d.queue = make(chan *webhookJob, d.opts.Workers)
+	for i := 0; i < d.opts.Workers; i++ {
+		go d.work()
+	}
+	go d.scheduleRetries()
+
+	return d
+}
+
+// errInternalAddress is the error of connecting to an internal address.
+var errInternalAddress = errors.New("connecting to internal address denied")
+
+// internalIP tells if ip is a loopback, private, link-local, unspecified or multicast address.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || ip.To4() != nil && ip.To4()[0] == 0
+}
+
+// denyInternal is a net.Dialer Control function denying connections to internal addresses.
+// It checks the resolved address being connected to, so host names resolving to (or redirects
+// pointing to) internal addresses are denied too.
+func denyInternal(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return errInternalAddress
+	}
+	return nil
+}
+
+// StopWebhooks stops the webhook dispatcher if webhooks are enabled.
+// Pending deliveries are abandoned. It is safe to call it multiple times.
+func StopWebhooks() {
+	if webhooks != nil {
+		webhooks.close()
+	}
+}
+
+// close stops the dispatcher, it is safe to call it multiple times.
+func (d *webhookDispatcher) close() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
+// run receives events from the event bus and starts their deliveries.
+func (d *webhookDispatcher) run() {
+	seq := eventBus.Seq()
+	for {
+		events, replay, missed, cancel := eventBus.Subscribe(seq)
+		if missed {
+			d.lost(seq, replay)
+		}
+		for _, e := range replay {
+			d.dispatch(e)
+			seq = e.Seq
+		}
+	loop:
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break loop // Dropped, resubscribe from the last seq
+				}
+				d.dispatch(e)
+				seq = e.Seq
+			case <-d.stop:
+				cancel()
+				return
+			}
+		}
+		cancel()
+	}
+}
+
+// lost records the events lost after the event with sequence number since: the dispatcher
+// fell behind and the events before the first replayed one are no longer buffered by the bus.
+// A dead delivery is recorded for each lost event and webhook (the event types are unknown),
+// so lost events show up in the dead-letter list.
+func (d *webhookDispatcher) lost(since uint64, replay []*Event) {
+	if len(replay) == 0 {
+		// since is ahead of the bus (e.g. it was replaced), lost events are unknown
+		logger.Error("Webhook events may have been lost, event bus is behind", "since", since)
+		return
+	}
+
+	from, to := since+1, replay[0].Seq-1
+	logger.Error("Webhook events lost, dispatcher fell behind", "from", from, "to", to)
+
+	whs, err := d.ws.AllWebhooks()
+	if err != nil {
+		logger.Error("Error getting webhooks, lost events not recorded", "err", err)
+		return
+	}
+
+	if max := uint64(d.opts.HistorySize); to-from >= max {
+		from = to - max + 1 // Older ones would be dropped from the dead-letter list anyway
+	}
+	now := time.Now()
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	for seq := from; seq <= to; seq++ {
+		for _, wh := range whs {
+			dl := &Delivery{ID: newRandomID(), WebhookID: wh.ID, URL: wh.URL, EventSeq: seq,
+				Status: DeliveryDead, LastAttempt: now, LastError: "event lost, dispatcher fell behind"}
+			d.dead = appendBounded(d.dead, dl, d.opts.HistorySize)
+		}
+	}
+}
+
+// dispatch starts the deliveries of an event to the subscribed webhooks.
+func (d *webhookDispatcher) dispatch(e *Event) {
+	whs, err := d.ws.AllWebhooks()
+	if err != nil {
+		logger.Error("Error getting webhooks, event not delivered", "seq", e.Seq, "err", err)
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("Failed to encode event", "seq", e.Seq, "err", err)
+		return
+	}
+
+	for _, wh := range whs {
+		if !wh.Wants(e.Type) {
+			continue
+		}
+		dl := &Delivery{ID: newRandomID(), WebhookID: wh.ID, URL: wh.URL,
+			EventSeq: e.Seq, EventType: e.Type, Status: DeliveryPending}
+		d.mux.Lock()
+		d.pending[dl.ID] = dl
+		d.mux.Unlock()
+
+		if !d.enqueue(&webhookJob{dl: dl, secret: wh.Secret, payload: payload, backoff: d.opts.InitialBackoff}) {
+			return
+		}
+	}
+}
+
+// enqueue queues a delivery attempt for the workers, blocking while all workers are busy.
+// Returns false if the dispatcher is stopped.
+func (d *webhookDispatcher) enqueue(j *webhookJob) bool {
+	select {
+	case d.queue <- j:
+		return true
+	case <-d.stop:
+		return false
+	}
+}
+
+// forget abandons the pending deliveries of a deleted webhook: their retries are removed,
+// and attempts already queued or in progress are not recorded.
+func (d *webhookDispatcher) forget(webhookID string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	for id, dl := range d.pending {
+		if dl.WebhookID == webhookID {
+			delete(d.pending, id)
+		}
+	}
+
+	retries := d.retries[:0]
+	for _, j := range d.retries {
+		if j.dl.WebhookID != webhookID {
+			retries = append(retries, j)
+		}
+	}
+	for i := len(retries); i < len(d.retries); i++ {
+		d.retries[i] = nil
+	}
+	d.retries = retries
+	heap.Init(&d.retries)
+}
+
+// abandoned tells if the delivery has been abandoned (its webhook was deleted).
+// Must be called with the mutex held.
+func (d *webhookDispatcher) abandoned(dl *Delivery) bool {
+	return d.pending[dl.ID] == nil
+}
+
+// work makes the queued delivery attempts until the dispatcher is stopped.
+func (d *webhookDispatcher) work() {
+	for {
+		select {
+		case j := <-d.queue:
+			d.attempt(j)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// attempt makes a delivery attempt. If it fails, it schedules a retry with exponential backoff,
+// or moves the delivery to the dead-letter list if no more attempts are allowed.
+// Abandoned deliveries (see forget()) are not attempted.
+func (d *webhookDispatcher) attempt(j *webhookJob) {
+	dl := j.dl
+
+	d.mux.Lock()
+	abandoned := d.abandoned(dl)
+	d.mux.Unlock()
+	if abandoned {
+		return
+	}
+
+	code, err := d.post(dl, j.secret, j.payload)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.abandoned(dl) {
+		return
+	}
+
+	dl.Attempts++
+	dl.LastAttempt, dl.LastStatusCode, dl.LastError = time.Now(), code, ""
+	if err != nil {
+		dl.LastError = err.Error()
+	}
+
+	if err == nil || dl.Attempts >= d.opts.MaxAttempts {
+		delete(d.pending, dl.ID)
+		dl.NextAttempt = time.Time{}
+		if err == nil {
+			dl.Status = DeliveryDelivered
+			d.completed = appendBounded(d.completed, dl, d.opts.HistorySize)
+		} else {
+			dl.Status = DeliveryDead
+			d.dead = appendBounded(d.dead, dl, d.opts.HistorySize)
+			logger.Warn("Webhook delivery failed", "delivery", dl.ID, "url", dl.URL, "attempts", dl.Attempts, "err", err)
+		}
+		return
+	}
+
+	dl.NextAttempt = dl.LastAttempt.Add(j.backoff)
+	if j.backoff *= 2; j.backoff > d.opts.MaxBackoff {
+		j.backoff = d.opts.MaxBackoff
+	}
+	heap.Push(&d.retries, j)
+
+	select {
+	case d.wake <- struct{}{}:
+	default: // Scheduler is already woken
+	}
+}
+
+// scheduleRetries queues the delivery attempts waiting for retry when they are due,
+// until the dispatcher is stopped.
+func (d *webhookDispatcher) scheduleRetries() {
+	for {
+		var due []*webhookJob
+		wait := time.Hour // Woken anyway if a retry is added
+
+		d.mux.Lock()
+		now := time.Now()
+		for len(d.retries) > 0 && !d.retries[0].dl.NextAttempt.After(now) {
+			due = append(due, heap.Pop(&d.retries).(*webhookJob))
+		}
+		if len(d.retries) > 0 {
+			wait = d.retries[0].dl.NextAttempt.Sub(now)
+		}
+		d.mux.Unlock()
+
+		for _, j := range due {
+			if !d.enqueue(j) {
+				return
+			}
+		}
+		if len(due) > 0 {
+			continue // Time passed while queueing, more may be due
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.wake:
+		case <-d.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// post makes a delivery attempt. Returns the received HTTP status code
+// and an error if delivery failed.
+func (d *webhookDispatcher) post(dl *Delivery, secret string, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, dl.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, dl.EventType)
+	req.Header.Set(WebhookDeliveryHeader, dl.ID)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, payload))
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliveries returns copies of the deliveries of the specified webhook and status
+// (zero values do not filter).
+func (d *webhookDispatcher) deliveries(webhookID, status string) []Delivery {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	res := []Delivery{}
+	add := func(dl *Delivery) {
+		if (webhookID == "" || dl.WebhookID == webhookID) && (status == "" || dl.Status == status) {
+			res = append(res, *dl)
+		}
+	}
+	for _, dl := range d.pending {
+		add(dl)
+	}
+	for _, dl := range d.completed {
+		add(dl)
+	}
+	for _, dl := range d.dead {
+		add(dl)
+	}
+	return res
+}
+
+// appendBounded appends a delivery to a list, keeping at most max elements (dropping the oldest).
+func appendBounded(list []*Delivery, dl *Delivery, max int) []*Delivery {
+	if len(list) >= max {
+		list = append(list[:0], list[len(list)-max+1:]...)
+	}
+	return append(list, dl)
+}
+
+// newRandomID returns a new random ID (16 hex digits).
+func newRandomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // Never happens, crypto/rand.Read always succeeds
+	}
+	return hex.EncodeToString(b)
+}
+
+// addWebhookLogic implements subscribing a webhook.
+// Expects the request body to be a JSON webhook; only URL, Secret and Events are used.
+// URLs of internal IP addresses are rejected unless allowed by WebhookOptions.AllowInternal
+// (host names are checked when connecting).
+// Returns the webhook including its (generated) ID and Secret.
+func addWebhookLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if webhooks == nil {
+		return &JSONResp{Error: "Webhooks are not enabled!"}
+	}
+
+	wh := new(Webhook)
+	if err := json.NewDecoder(r.Body).Decode(wh); err != nil {
+		logOf(r).Warn("Error decoding request", "err", err)
+		http.Error(w, "Can't decode input JSON", http.StatusBadRequest)
+		return nil
+	}
+
+	if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &JSONResp{Error: "URL must be a valid http or https URL!"}
+	} else if ip := net.ParseIP(u.Hostname()); ip != nil && internalIP(ip) && !webhooks.opts.AllowInternal {
+		return &JSONResp{Error: "URL must not point to an internal address!"}
+	}
+	for _, t := range wh.Events {
+		switch t {
+		case EventCreated, EventUpdated, EventPricesChanged, EventDeleted:
+		default:
+			return &JSONResp{Error: "Invalid event type: " + t}
+		}
+	}
+
+	wh.ID, wh.Created = newRandomID(), time.Now()
+	if wh.Secret == "" {
+		wh.Secret = newRandomID() + newRandomID()
+	}
+
+	if err := webhooks.ws.SaveWebhook(wh); err != nil {
+		logOf(r).Error("Error saving webhook", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	return &JSONResp{Success: true, Data: wh}
+}
+
+// listWebhooksLogic implements listing webhook subscriptions.
+// Secrets are not returned.
+func listWebhooksLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if webhooks == nil {
+		return &JSONResp{Error: "Webhooks are not enabled!"}
+	}
+
+	whs, err := webhooks.ws.AllWebhooks()
+	if err != nil {
+		logOf(r).Error("Error getting webhooks", "err", err)
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	res := make([]Webhook, len(whs))
+	for i, wh := range whs {
+		res[i] = *wh
+		res[i].Secret = ""
+	}
+
+	return &JSONResp{Success: true, Data: res}
+}
+
+// delWebhookLogic implements deleting a webhook subscription, its pending deliveries are abandoned.
+// Expects the request body to be a JSON webhook, only its ID is used.
+func delWebhookLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if webhooks == nil {
+		return &JSONResp{Error: "Webhooks are not enabled!"}
+	}
+
+	wh := new(Webhook)
+	if err := json.NewDecoder(r.Body).Decode(wh); err != nil {
+		logOf(r).Warn("Error decoding request", "err", err)
+		http.Error(w, "Can't decode input JSON", http.StatusBadRequest)
+		return nil
+	}
+
+	if err := webhooks.ws.DeleteWebhook(wh.ID); err != nil {
+		logOf(r).Warn("Error deleting webhook", "webhook", wh.ID, "err", err)
+		if err == ErrInvalidWebhookID {
+			return &JSONResp{Error: MsgInvalidIDErr}
+		}
+		return &JSONResp{Error: MsgGeneralStoreErr}
+	}
+
+	webhooks.forget(wh.ID)
+
+	return &JSONResp{Success: true, Data: struct{ ID string }{wh.ID}}
+}
+
+// deliveriesLogic implements inspecting webhook deliveries.
+// The webhook and status URL query parameters may be used to filter deliveries,
+// e.g. status=dead lists the dead-letter list.
+func deliveriesLogic(w http.ResponseWriter, r *http.Request, ch *callHandler) *JSONResp {
+	if webhooks == nil {
+		return &JSONResp{Error: "Webhooks are not enabled!"}
+	}
+
+	q := r.URL.Query()
+	return &JSONResp{Success: true, Data: webhooks.deliveries(q.Get("webhook"), q.Get("status"))}
+}
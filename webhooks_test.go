@@ -0,0 +1,359 @@
+package productws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhookStore is a WebhookStore holding a fixed list of webhooks.
+type testWebhookStore []*Webhook
+
+func (s testWebhookStore) AllWebhooks() ([]*Webhook, error) { return s, nil }
+func (s testWebhookStore) SaveWebhook(wh *Webhook) error    { return nil }
+func (s testWebhookStore) DeleteWebhook(id string) error    { return nil }
+
+// webhookReceiver is a webhook receiver recording the received requests.
+// It responds with the status codes of statuses in turn (the last one repeated), 200 if empty.
+type webhookReceiver struct {
+	statuses []int
+
+	mux      sync.Mutex
+	headers  []http.Header
+	bodies   [][]byte
+	received []time.Time
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	wr.mux.Lock()
+	defer wr.mux.Unlock()
+
+	wr.headers = append(wr.headers, r.Header)
+	wr.bodies = append(wr.bodies, body)
+	wr.received = append(wr.received, time.Now())
+
+	status := http.StatusOK
+	if n := len(wr.statuses); n > 0 {
+		status = wr.statuses[n-1]
+		if len(wr.received) <= n {
+			status = wr.statuses[len(wr.received)-1]
+		}
+	}
+	w.WriteHeader(status)
+}
+
+func (wr *webhookReceiver) count() int {
+	wr.mux.Lock()
+	defer wr.mux.Unlock()
+	return len(wr.received)
+}
+
+// waitFor waits until cond is true, fails the test if it doesn't happen in 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+	}
+}
+
+// newTestDispatcher returns a webhook dispatcher delivering to the receiver, and the test server.
+// Internal addresses are allowed (the test server listens on loopback).
+func newTestDispatcher(wr *webhookReceiver, opts *WebhookOptions, whs ...*Webhook) (*webhookDispatcher, *httptest.Server) {
+	srv := httptest.NewServer(wr)
+	for _, wh := range whs {
+		wh.URL = srv.URL
+	}
+	o := WebhookOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.AllowInternal = true
+	return newWebhookDispatcher(testWebhookStore(whs), &o), srv
+}
+
+func testEvent(typ string) *Event {
+	return &Event{Seq: 7, Type: typ, ID: 3, Time: time.Now(), Product: &Product{ID: 3, Name: "p"}}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	wr := &webhookReceiver{}
+	d, srv := newTestDispatcher(wr, nil,
+		&Webhook{ID: "a", Secret: "s3cret"},
+		&Webhook{ID: "b", Secret: "other", Events: []string{EventDeleted}},
+	)
+	defer srv.Close()
+	defer d.close()
+
+	d.dispatch(testEvent(EventUpdated))
+	waitFor(t, "delivery", func() bool { return len(d.deliveries("a", DeliveryDelivered)) == 1 })
+
+	if n := wr.count(); n != 1 {
+		t.Fatalf("Expected 1 request (webhook b is not subscribed), got: %d", n)
+	}
+	h, body := wr.headers[0], wr.bodies[0]
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if exp, got := "sha256="+hex.EncodeToString(mac.Sum(nil)), h.Get(WebhookSignatureHeader); got != exp {
+		t.Errorf("Expected signature %q, got: %q", exp, got)
+	}
+	if !VerifyWebhookSignature("s3cret", body, h.Get(WebhookSignatureHeader)) {
+		t.Error("VerifyWebhookSignature rejected a valid signature")
+	}
+	if VerifyWebhookSignature("other", body, h.Get(WebhookSignatureHeader)) {
+		t.Error("VerifyWebhookSignature accepted a signature of a different secret")
+	}
+	if VerifyWebhookSignature("s3cret", append(body, ' '), h.Get(WebhookSignatureHeader)) {
+		t.Error("VerifyWebhookSignature accepted a modified payload")
+	}
+
+	if got := h.Get(WebhookEventHeader); got != EventUpdated {
+		t.Errorf("Expected event header %q, got: %q", EventUpdated, got)
+	}
+	if dl := d.deliveries("a", ""); h.Get(WebhookDeliveryHeader) != dl[0].ID {
+		t.Errorf("Expected delivery header %q, got: %q", dl[0].ID, h.Get(WebhookDeliveryHeader))
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	wr := &webhookReceiver{statuses: []int{500, 500, 200}}
+	opts := &WebhookOptions{MaxAttempts: 5, InitialBackoff: 20 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	d, srv := newTestDispatcher(wr, opts, &Webhook{ID: "a", Secret: "s"})
+	defer srv.Close()
+	defer d.close()
+
+	d.dispatch(testEvent(EventCreated))
+	waitFor(t, "delivery", func() bool { return len(d.deliveries("a", DeliveryDelivered)) == 1 })
+
+	dl := d.deliveries("a", "")[0]
+	if dl.Attempts != 3 || dl.LastStatusCode != 200 || dl.LastError != "" || !dl.NextAttempt.IsZero() {
+		t.Errorf("Unexpected delivery: %+v", dl)
+	}
+
+	// Backoff is doubled, capped at MaxBackoff
+	for i, min := range []time.Duration{20 * time.Millisecond, 30 * time.Millisecond} {
+		if wait := wr.received[i+1].Sub(wr.received[i]); wait < min {
+			t.Errorf("Expected retry #%d after at least %v, got: %v", i+1, min, wait)
+		}
+	}
+	if n := len(d.deliveries("", DeliveryDead)); n != 0 {
+		t.Errorf("Expected no dead deliveries, got: %d", n)
+	}
+}
+
+func TestWebhookDead(t *testing.T) {
+	wr := &webhookReceiver{statuses: []int{503}}
+	opts := &WebhookOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	d, srv := newTestDispatcher(wr, opts, &Webhook{ID: "a", Secret: "s"})
+	defer srv.Close()
+	defer d.close()
+
+	d.dispatch(testEvent(EventPricesChanged))
+	waitFor(t, "dead delivery", func() bool { return len(d.deliveries("", DeliveryDead)) == 1 })
+
+	dl := d.deliveries("", DeliveryDead)[0]
+	if dl.WebhookID != "a" || dl.EventSeq != 7 || dl.EventType != EventPricesChanged {
+		t.Errorf("Unexpected delivery: %+v", dl)
+	}
+	if dl.Attempts != 3 || dl.LastStatusCode != 503 || dl.LastError == "" {
+		t.Errorf("Expected 3 failed attempts with status 503, got: %+v", dl)
+	}
+	if n := wr.count(); n != 3 {
+		t.Errorf("Expected 3 requests, got: %d", n)
+	}
+	if n := len(d.deliveries("", DeliveryPending)); n != 0 {
+		t.Errorf("Expected no pending deliveries, got: %d", n)
+	}
+}
+
+func TestWebhookWorkers(t *testing.T) {
+	var mux sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		if inFlight++; inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mux.Unlock()
+		<-release
+		mux.Lock()
+		inFlight--
+		mux.Unlock()
+	}))
+	defer srv.Close()
+
+	var whs testWebhookStore
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		whs = append(whs, &Webhook{ID: id, URL: srv.URL, Secret: "s"})
+	}
+	d := newWebhookDispatcher(whs, &WebhookOptions{Workers: 2, AllowInternal: true})
+	defer d.close()
+
+	go d.dispatch(testEvent(EventCreated)) // Blocks while the workers are busy
+	waitFor(t, "2 requests in flight", func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return inFlight == 2
+	})
+	time.Sleep(50 * time.Millisecond) // Give a chance to exceed the limit
+	close(release)
+
+	waitFor(t, "deliveries", func() bool { return len(d.deliveries("", DeliveryDelivered)) == len(whs) })
+	if maxInFlight != 2 {
+		t.Errorf("Expected max 2 concurrent deliveries, got: %d", maxInFlight)
+	}
+}
+
+func TestStopWebhooksTwice(t *testing.T) {
+	defer func(d *webhookDispatcher) { webhooks = d }(webhooks)
+	webhooks = newWebhookDispatcher(testWebhookStore(nil), nil)
+
+	StopWebhooks()
+	StopWebhooks() // Must not panic
+}
+
+func TestWebhookForget(t *testing.T) {
+	wr := &webhookReceiver{statuses: []int{500}}
+	opts := &WebhookOptions{MaxAttempts: 100, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	d, srv := newTestDispatcher(wr, opts, &Webhook{ID: "a", Secret: "s"}, &Webhook{ID: "b", Secret: "s"})
+	defer srv.Close()
+	defer d.close()
+
+	d.dispatch(testEvent(EventCreated))
+	waitFor(t, "retries", func() bool { return wr.count() >= 4 })
+
+	d.forget("a")
+	if dls := d.deliveries("a", ""); len(dls) != 0 {
+		t.Errorf("Expected no deliveries of deleted webhook, got: %+v", dls)
+	}
+	if dls := d.deliveries("b", DeliveryPending); len(dls) != 1 {
+		t.Errorf("Expected pending delivery of webhook b, got: %+v", dls)
+	}
+
+	d.forget("b")
+	time.Sleep(30 * time.Millisecond) // Let attempts in progress finish
+	n := wr.count()
+	time.Sleep(50 * time.Millisecond)
+	if n2 := wr.count(); n2 != n {
+		t.Errorf("Expected no more attempts after deletion, got: %d", n2-n)
+	}
+	d.mux.Lock()
+	if len(d.retries) != 0 || len(d.dead) != 0 {
+		t.Errorf("Expected no retries and dead deliveries, got: %d, %d", len(d.retries), len(d.dead))
+	}
+	d.mux.Unlock()
+}
+
+func TestWebhookLostEvents(t *testing.T) {
+	defer SetEventBus(eventBus)
+	SetEventBus(NewEventBus(2))
+
+	unblock := make(chan struct{})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-unblock })
+	srv := httptest.NewServer(blocking)
+	defer srv.Close()
+
+	d := newWebhookDispatcher(testWebhookStore{{ID: "a", URL: srv.URL, Secret: "s"}}, &WebhookOptions{Workers: 1, AllowInternal: true})
+	defer d.close()
+	go d.run()
+
+	waitFor(t, "subscription", func() bool {
+		eventBus.mux.Lock()
+		defer eventBus.mux.Unlock()
+		return len(eventBus.subs) == 1
+	})
+
+	// With the receiver blocked, the dispatcher falls behind and gets dropped by the bus:
+	const count = 10
+	for i := 0; i < count; i++ {
+		eventBus.Publish(EventCreated, &Product{ID: 1})
+	}
+	close(unblock)
+
+	waitFor(t, "deliveries", func() bool { return len(d.deliveries("a", "")) == count })
+
+	seqs := map[uint64]bool{}
+	lost := 0
+	for _, dl := range d.deliveries("a", "") {
+		seqs[dl.EventSeq] = true
+		if dl.Status == DeliveryDead {
+			lost++
+			if dl.EventType != "" || dl.LastError == "" {
+				t.Errorf("Unexpected lost delivery: %+v", dl)
+			}
+		}
+	}
+	if lost == 0 {
+		t.Errorf("Expected lost events in the dead-letter list")
+	}
+	for seq := uint64(1); seq <= count; seq++ {
+		if !seqs[seq] {
+			t.Errorf("Missing delivery of event %d", seq)
+		}
+	}
+}
+
+func TestWebhookInternalAddress(t *testing.T) {
+	defer func(d *webhookDispatcher) { webhooks = d }(webhooks)
+
+	wr := &webhookReceiver{}
+	srv := httptest.NewServer(wr)
+	defer srv.Close()
+
+	webhooks = newWebhookDispatcher(testWebhookStore{{ID: "a", URL: srv.URL, Secret: "s"}}, &WebhookOptions{MaxAttempts: 1})
+	defer webhooks.close()
+
+	cases := []struct {
+		url    string
+		expErr string // Empty if success is expected
+	}{
+		{"https://example.com/hook", ""},
+		{"http://example.com:8080/hook", ""},
+		{"http://localhost/hook", ""}, // Denied when connecting
+		{"http://8.8.8.8/hook", ""},
+		{"ftp://example.com/hook", "URL must be a valid http or https URL!"},
+		{"/hook", "URL must be a valid http or https URL!"},
+		{"http://127.0.0.1:8081/hook", "URL must not point to an internal address!"},
+		{"http://[::1]/hook", "URL must not point to an internal address!"},
+		{"http://10.1.2.3/hook", "URL must not point to an internal address!"},
+		{"http://192.168.0.1/hook", "URL must not point to an internal address!"},
+		{"http://169.254.169.254/latest/meta-data", "URL must not point to an internal address!"},
+		{"http://[fe80::1]/hook", "URL must not point to an internal address!"},
+		{"http://0.0.0.0/hook", "URL must not point to an internal address!"},
+		{"http://[::ffff:127.0.0.1]/hook", "URL must not point to an internal address!"},
+	}
+	for _, c := range cases {
+		resp, _ := callAs("", addWebhookLogic, &Webhook{URL: c.url})
+		if c.expErr == "" && !resp.Success || c.expErr != "" && resp.Error != c.expErr {
+			t.Errorf("[%s] Expected error %q, got: %+v", c.url, c.expErr, resp)
+		}
+	}
+
+	// Deliveries to internal addresses are denied when connecting:
+	webhooks.dispatch(testEvent(EventCreated))
+	waitFor(t, "dead delivery", func() bool { return len(webhooks.deliveries("a", DeliveryDead)) == 1 })
+	if dl := webhooks.deliveries("a", "")[0]; !strings.Contains(dl.LastError, errInternalAddress.Error()) {
+		t.Errorf("Expected internal address error, got: %q", dl.LastError)
+	}
+	if n := wr.count(); n != 0 {
+		t.Errorf("Expected no requests to internal address, got: %d", n)
+	}
+
+	// Unless allowed:
+	webhooks.opts.AllowInternal = true
+	if resp, _ := callAs("", addWebhookLogic, &Webhook{URL: "http://127.0.0.1:8081/hook"}); !resp.Success {
+		t.Errorf("Expected internal URL to be allowed, got: %+v", resp)
+	}
+}
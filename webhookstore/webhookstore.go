@@ -0,0 +1,153 @@
+/*
+
+Package webhookstore contains productws.WebhookStore implementations, safe for concurrent use.
+
+*/
+package webhookstore
+
+import (
+	"encoding/json"
+	"github.com/icza/productws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// memStore is an in-memory webhook store implementation.
+// Optionally it persists webhooks to a file.
+type memStore struct {
+	// Map storing webhooks, mapped from their ID
+	m map[string]*productws.Webhook
+
+	// Mutex to protect concurrent access to the store
+	mux sync.RWMutex
+
+	// Optional name of the file to persist webhooks to
+	name string
+}
+
+// NewMemStore returns a new in-memory WebhookStore implementation.
+// Safe for concurrent use.
+func NewMemStore() productws.WebhookStore {
+	return &memStore{m: map[string]*productws.Webhook{}}
+}
+
+// NewFileStore returns a new WebhookStore implementation which persists
+// webhooks to the named file (as a JSON array).
+// Existing webhooks are loaded from the file if it exists.
+// Safe for concurrent use.
+func NewFileStore(name string) (productws.WebhookStore, error) {
+	s := &memStore{m: map[string]*productws.Webhook{}, name: name}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	var whs []*productws.Webhook
+	if err := json.Unmarshal(data, &whs); err != nil {
+		return nil, err
+	}
+	for _, wh := range whs {
+		s.m[wh.ID] = wh
+	}
+
+	return s, nil
+}
+
+// AllWebhooks implements WebhookStore.AllWebhooks().
+// Webhooks are returned in order of creation.
+// This implementation never returns an error.
+func (s *memStore) AllWebhooks() ([]*productws.Webhook, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.all(), nil
+}
+
+// SaveWebhook implements WebhookStore.SaveWebhook().
+func (s *memStore) SaveWebhook(wh *productws.Webhook) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	wh2 := *wh // Copy to be safe!
+	wh2.Events = append([]string(nil), wh.Events...)
+	old := s.m[wh.ID]
+	s.m[wh.ID] = &wh2
+
+	if err := s.persist(); err != nil {
+		// Restore previous state
+		if old == nil {
+			delete(s.m, wh.ID)
+		} else {
+			s.m[wh.ID] = old
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteWebhook implements WebhookStore.DeleteWebhook().
+// productws.ErrInvalidWebhookID is returned if no webhook exists with the specified ID.
+func (s *memStore) DeleteWebhook(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	old := s.m[id]
+	if old == nil {
+		return productws.ErrInvalidWebhookID
+	}
+	delete(s.m, id)
+
+	if err := s.persist(); err != nil {
+		s.m[id] = old // Restore previous state
+		return err
+	}
+	return nil
+}
+
+// all returns copies of all webhooks in order of creation.
+// Must be called with the mutex held.
+func (s *memStore) all() []*productws.Webhook {
+	whs := make([]*productws.Webhook, 0, len(s.m))
+	for _, wh := range s.m {
+		wh2 := *wh
+		whs = append(whs, &wh2)
+	}
+	sort.Slice(whs, func(i, j int) bool { return whs[i].Created.Before(whs[j].Created) })
+	return whs
+}
+
+// persist writes all webhooks to the file if the store has one.
+// The file is replaced atomically.
+// Must be called with the write lock held.
+func (s *memStore) persist() error {
+	if s.name == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.all(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.name), filepath.Base(s.name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.name)
+}
@@ -0,0 +1,316 @@
+/*
+
+WebSocket API mirroring the REST API calls.
+
+*/
+
+package productws
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations only available on the WebSocket API
+const (
+	wsOpSubscribe   = "subscribe"   // Subscribe to change notifications
+	wsOpUnsubscribe = "unsubscribe" // Unsubscribe from change notifications
+	wsOpEvent       = "event"       // Change notification (sent by the server)
+)
+
+// wsRequest is a request message received on the WebSocket API.
+type wsRequest struct {
+	ReqID string // Client supplied request ID, sent back in the response
+	Op    string // Operation (name of the API call)
+
+	ID    ID              // Product ID, for the details call
+	Query string          // Optional URL query, e.g. list filters
+	Data  json.RawMessage // Request body, e.g. the product to create
+
+	// Sequence number to resume notifications from, for the subscribe call (0: from now on)
+	Since uint64
+}
+
+// wsResp is a response message sent on the WebSocket API.
+type wsResp struct {
+	ReqID string `json:",omitempty"` // Request ID of the request being responded
+	*JSONResp
+}
+
+// Timing parameters of WebSocket connections
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingPeriod   = wsPongTimeout * 9 / 10
+)
+
+// wsUpgrader upgrades HTTP connections to WebSocket.
+var wsUpgrader = websocket.Upgrader{CheckOrigin: checkWSOrigin}
+
+// Origins allowed to open WebSocket connections besides the origin of the server
+var wsOrigins []string
+
+// SetWebSocketOrigins sets the origins (e.g. "https://example.com") of web pages allowed to open
+// WebSocket connections, besides pages served by the server itself. "*" allows all origins.
+//
+// Browsers send cookies and cached credentials (e.g. HTTP Basic) with WebSocket upgrade requests
+// of any page, and unlike API calls, WebSocket connections are not subject to CORS, so pages of
+// other origins could act on behalf of the user (cross-site WebSocket hijacking). Hence by default
+// only requests without an Origin header (non-browser clients) and same-origin requests are allowed.
+// Must be done prior to starting the web service.
+func SetWebSocketOrigins(origins ...string) {
+	wsOrigins = origins
+}
+
+// checkWSOrigin tells if the origin of a WebSocket upgrade request is allowed.
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range wsOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket API connection.
+type wsConn struct {
+	conn *websocket.Conn
+	r    *http.Request // The upgrade request
+
+	// Mutex to serialize writes to conn
+	wmux sync.Mutex
+
+	// Cancels the event subscription, nil if not subscribed (only accessed by the read loop)
+	cancelSub func()
+}
+
+// wsHandler serves the WebSocket API.
+//
+// Clients send JSON request messages naming an operation (the same as the REST API calls:
+// create, list, details, update, setprices), and receive JSONResp messages extended with
+// the ReqID of the request. Change notifications can be requested with the subscribe
+// operation; notifications are sent as JSONResp messages with the "event" Op and an Event as Data.
+//
+// If authentication is enabled, the upgrade request must be authenticated, and request
+// messages are authenticated with the credentials of the upgrade request.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("WebSocket upgrade failed", "remoteAddr", r.RemoteAddr, "origin", r.Header.Get("Origin"), "err", err)
+		return // Upgrader already replied with an error
+	}
+
+	c := &wsConn{conn: conn, r: r}
+	defer c.close()
+
+	conn.SetReadLimit(maxBodySize) // Connection is closed if a larger message is received
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.pinger(done)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Warn("WebSocket read error", "remoteAddr", r.RemoteAddr, "err", err)
+			}
+			return
+		}
+		req := new(wsRequest)
+		if err := json.Unmarshal(data, req); err != nil {
+			c.send(&wsResp{JSONResp: &JSONResp{Error: "Can't decode input JSON"}})
+			continue
+		}
+		c.send(&wsResp{ReqID: req.ReqID, JSONResp: c.handle(req)})
+	}
+}
+
+// handle handles a request message, returns the response.
+func (c *wsConn) handle(req *wsRequest) *JSONResp {
+	switch req.Op {
+	case wsOpSubscribe:
+		return c.subscribe(req.Since)
+	case wsOpUnsubscribe:
+		c.unsubscribe()
+		return &JSONResp{Op: req.Op, Success: true}
+	}
+
+	ch := productCalls[req.Op]
+	if ch == nil {
+		return &JSONResp{Op: req.Op, Error: "Unknown operation: " + req.Op}
+	}
+
+	// Build an HTTP request equivalent to the REST API call:
+	u := &url.URL{Path: "/" + ch.op, RawQuery: req.Query}
+	if ch.op == opDetails {
+		u.Path += "/" + strconv.FormatInt(int64(req.ID), 10)
+	}
+	r, err := http.NewRequest(ch.expMethod, u.String(), bytes.NewReader(req.Data))
+	if err != nil {
+		return &JSONResp{Op: req.Op, Error: "Invalid request: " + err.Error()}
+	}
+	r = r.WithContext(c.r.Context())
+	r.Header = c.r.Header.Clone()
+	r.Header.Del(RequestIDHeader) // Each message is a separate call with its own request ID
+	r.RemoteAddr, r.TLS = c.r.RemoteAddr, c.r.TLS
+	r = withCallInfo(r, newCallInfo(r, ch.op))
+
+	// Metrics, access log and span are recorded just like for REST API calls:
+	rec := &wsRecorder{header: http.Header{}}
+	if jsonResp := ch.serve(rec, r, false); jsonResp != nil {
+		return jsonResp
+	}
+
+	// Logic responded with an HTTP error:
+	return &JSONResp{Op: req.Op, Error: strings.TrimSpace(rec.body.String())}
+}
+
+// subscribe subscribes the connection to change notifications, returns the response.
+// An existing subscription is replaced.
+// The caller must be allowed to receive change events just like on the events path,
+// and only events within the tags of its permission are sent (see scopeEvent()).
+func (c *wsConn) subscribe(since uint64) *JSONResp {
+	c.unsubscribe()
+
+	// Credentials of the upgrade request are checked again, they may have been revoked since
+	rec := &wsRecorder{header: http.Header{}}
+	ci, jsonResp := authorizeEvents(rec, c.r)
+	if ci == nil {
+		if jsonResp == nil {
+			jsonResp = &JSONResp{Error: strings.TrimSpace(rec.body.String())}
+		}
+		jsonResp.Op = wsOpSubscribe
+		return jsonResp
+	}
+
+	if since == 0 {
+		since = eventBus.Seq()
+	}
+
+	events, replay, missed, cancel := eventBus.Subscribe(since)
+	done := make(chan struct{})
+	c.cancelSub = func() { close(done) }
+	go c.deliver(ci, since, done, events, replay, missed, cancel)
+
+	return &JSONResp{Op: wsOpSubscribe, Success: true, Data: struct{ Seq uint64 }{eventBus.Seq()}}
+}
+
+// deliver sends the events of a subscription (made with EventBus.Subscribe() from since) until done is closed.
+// If the bus drops the subscription because the connection can't keep up with the events, it resubscribes
+// from the last event; if events were lost meanwhile, the client is told to resync.
+func (c *wsConn) deliver(ci *callInfo, since uint64, done <-chan struct{},
+	events <-chan *Event, replay []*Event, missed bool, cancel func()) {
+	defer func() { cancel() }() // cancel is replaced when resubscribing
+
+	sendEvent := func(e *Event) {
+		since = e.Seq
+		if e = ci.scopeEvent(e); e != nil {
+			c.send(&wsResp{JSONResp: &JSONResp{Op: wsOpEvent, Success: true, Data: e}})
+		}
+	}
+
+	for {
+		if missed {
+			c.send(&wsResp{JSONResp: &JSONResp{Op: wsOpEvent, Error: "Events missed, resync required"}})
+		}
+		for _, e := range replay {
+			sendEvent(e)
+		}
+
+	receive:
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break receive // Dropped by the bus
+				}
+				sendEvent(e)
+			case <-done:
+				return
+			}
+		}
+
+		ci.log.Warn("WebSocket subscriber dropped by the event bus, resubscribing", "caller", ci.caller, "since", since)
+		events, replay, missed, cancel = eventBus.Subscribe(since)
+	}
+}
+
+// unsubscribe cancels the subscription of the connection if it has one.
+func (c *wsConn) unsubscribe() {
+	if c.cancelSub != nil {
+		c.cancelSub()
+		c.cancelSub = nil
+	}
+}
+
+// send sends a message on the connection.
+// Errors are logged, the read loop will detect the broken connection.
+func (c *wsConn) send(resp *wsResp) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteJSON(resp); err != nil {
+		logger.Warn("Failed to send WebSocket message", "remoteAddr", c.r.RemoteAddr, "err", err)
+	}
+}
+
+// pinger sends pings periodically until done is closed.
+func (c *wsConn) pinger(done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.wmux.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			c.wmux.Unlock()
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// close cancels the subscription and closes the connection.
+func (c *wsConn) close() {
+	c.unsubscribe()
+	c.conn.Close()
+}
+
+// wsRecorder is an http.ResponseWriter which records the response
+// written by call logic (used for HTTP errors).
+type wsRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *wsRecorder) Header() http.Header         { return rec.header }
+func (rec *wsRecorder) Write(p []byte) (int, error) { return rec.body.Write(p) }
+func (rec *wsRecorder) WriteHeader(int)             {}
@@ -0,0 +1,177 @@
+package productws
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckWSOrigin(t *testing.T) {
+	defer func(o []string) { wsOrigins = o }(wsOrigins)
+
+	cases := []struct {
+		origins []string
+		origin  string
+		exp     bool
+	}{
+		{nil, "", true}, // Non-browser client
+		{nil, "http://api.example.com:8081", true},
+		{nil, "https://API.example.com:8081", true},
+		{nil, "http://evil.example.com", false},
+		{nil, "http://api.example.com", false}, // Different port
+		{nil, "null", false},
+		{[]string{"https://shop.example.com"}, "https://shop.example.com", true},
+		{[]string{"https://shop.example.com"}, "http://shop.example.com", false},
+		{[]string{"https://shop.example.com"}, "http://evil.example.com", false},
+		{[]string{"*"}, "http://evil.example.com", true},
+	}
+
+	for _, c := range cases {
+		wsOrigins = c.origins
+		r := httptest.NewRequest("GET", "http://api.example.com:8081/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := checkWSOrigin(r); got != c.exp {
+			t.Errorf("[origins: %v, origin: %q] Expected: %v, got: %v", c.origins, c.origin, c.exp, got)
+		}
+	}
+}
+
+// dialWS opens a WebSocket connection to the server with the specified request header.
+func dialWS(t *testing.T, srv *httptest.Server, h http.Header) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), h)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// wsTestResp is a response message of the WebSocket API.
+type wsTestResp struct {
+	Op      string
+	Success bool
+	Error   string
+	Data    json.RawMessage
+}
+
+func TestWSSubscribeAPIKeyScope(t *testing.T) {
+	defer func(a *apiKeyAuth, b *EventBus) { apiKeys, eventBus = a, b }(apiKeys, eventBus)
+
+	ks := newTestKeyStore()
+	EnableAPIKeys(ks)
+	eventBus = NewEventBus(10)
+
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+
+	// Key without the events scope can't subscribe
+	conn := dialWS(t, srv, http.Header{APIKeyHeader: {ks.addTestKey([]string{opList}, nil)}})
+	defer conn.Close()
+	var resp wsTestResp
+	conn.WriteJSON(wsRequest{Op: wsOpSubscribe})
+	if err := conn.ReadJSON(&resp); err != nil || resp.Success || resp.Error != MsgForbiddenErr {
+		t.Errorf("Expected error: %q, got: %+v, %v", MsgForbiddenErr, resp, err)
+	}
+
+	// Key restricted to the books tag only gets events of books
+	conn = dialWS(t, srv, http.Header{APIKeyHeader: {ks.addTestKey([]string{opEvents}, []string{"books"})}})
+	defer conn.Close()
+	conn.WriteJSON(wsRequest{Op: wsOpSubscribe})
+	if err := conn.ReadJSON(&resp); err != nil || !resp.Success {
+		t.Fatalf("Expected success, got: %+v, %v", resp, err)
+	}
+
+	eventBus.Publish(EventCreated, &Product{ID: 1, Tags: []string{"books"}})
+	eventBus.Publish(EventCreated, &Product{ID: 2, Tags: []string{"toys"}})
+	eventBus.Publish(EventCreated, &Product{ID: 3, Tags: []string{"toys", "books"}})
+
+	var ids []ID
+	for len(ids) == 0 || ids[len(ids)-1] != 3 {
+		var e Event
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		if err := json.Unmarshal(resp.Data, &e); err != nil || resp.Op != wsOpEvent {
+			t.Fatalf("Expected event, got: %+v, %v", resp, err)
+		}
+		ids = append(ids, e.ID)
+	}
+	if len(ids) != 2 || ids[0] != 1 {
+		t.Errorf("Expected events of products: [1 3], got: %v", ids)
+	}
+}
+
+func TestWSSubscriberDropped(t *testing.T) {
+	defer func(b *EventBus) { eventBus = b }(eventBus)
+	eventBus = NewEventBus(2)
+
+	connCh := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		connCh <- conn
+	}))
+	defer srv.Close()
+
+	client := dialWS(t, srv, nil)
+	defer client.Close()
+	c := &wsConn{conn: <-connCh, r: httptest.NewRequest("GET", "/ws", nil)}
+	defer c.close()
+
+	if resp := c.subscribe(0); !resp.Success {
+		t.Fatalf("Expected success, got: %+v", resp)
+	}
+
+	// Block sending, so the bus drops the subscriber:
+	c.wmux.Lock()
+	for i := 1; i <= 6; i++ {
+		eventBus.Publish(EventCreated, &Product{ID: ID(i)})
+	}
+	c.wmux.Unlock()
+
+	var seqs []uint64
+	missed := false
+	for len(seqs) == 0 || seqs[len(seqs)-1] != 6 {
+		var resp wsTestResp
+		if err := client.ReadJSON(&resp); err != nil {
+			t.Fatalf("Failed to read event (got: %v): %v", seqs, err)
+		}
+		if !resp.Success {
+			missed = true
+			continue
+		}
+		var e Event
+		json.Unmarshal(resp.Data, &e)
+		if len(seqs) > 0 && e.Seq <= seqs[len(seqs)-1] {
+			t.Errorf("Events out of order: %v, %d", seqs, e.Seq)
+		}
+		seqs = append(seqs, e.Seq)
+	}
+	if !missed {
+		t.Errorf("Expected missed message, got events: %v", seqs)
+	}
+}
+
+func TestWSReadLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer srv.Close()
+
+	conn := dialWS(t, srv, nil)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"ReqID":"`+strings.Repeat("x", maxBodySize)+`"}`))
+	var resp wsTestResp
+	err := conn.ReadJSON(&resp)
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("Expected close error %d, got: %+v, %v", websocket.CloseMessageTooBig, resp, err)
+	}
+}